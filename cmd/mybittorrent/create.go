@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultPieceCount is roughly how many pieces createTorrent aims for when it
+// picks the piece length itself.
+const defaultPieceCount = 1000
+
+// createOptions are the settings of a torrent createTorrent makes.
+type createOptions struct {
+	// trackers are the tiers of announce URLs. The first URL becomes
+	// "announce", and "announce-list" is only written when there are more.
+	trackers trackerTiers
+	webSeeds stringsFlag
+	// private sets "private" in the info dictionary (BEP 27), which
+	// changes the info hash.
+	private bool
+	// source sets "source" in the info dictionary, which also changes the
+	// info hash.
+	source string
+	// pieceLength is the length of each piece; 0 picks one from the total
+	// length with defaultPieceLength.
+	pieceLength int
+	comment     string
+	createdBy   string
+}
+
+// defaultPieceLength returns the smallest power of two between 16 KiB and
+// 16 MiB that keeps a torrent of total bytes at about defaultPieceCount
+// pieces or fewer.
+func defaultPieceLength(total int64) int {
+	pieceLength := minUsualPieceLength
+	for pieceLength < maxUsualPieceLength && (total+int64(pieceLength)-1)/int64(pieceLength) > defaultPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// createTorrent builds the metainfo of the file or directory at root. The
+// files of a directory are taken in lexical order of their paths, and their
+// pieces run across file boundaries as if they were one file.
+func createTorrent(root string, opts createOptions) (*TorrentFile, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		paths []string
+		files []FileEntry
+		total int64
+	)
+	if fi.Mode().IsRegular() {
+		paths = []string{abs}
+		total = fi.Size()
+	} else {
+		err = filepath.Walk(abs, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// Directories are implied by the paths of the files in them,
+			// and anything else, such as a symlink, has no data to hash.
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(abs, p)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, p)
+			files = append(files, FileEntry{Length: fi.Size(), Path: strings.Split(filepath.ToSlash(rel), "/")})
+			total += fi.Size()
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no files in %s", root)
+		}
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("nothing to share: %s is empty", root)
+	}
+
+	pieceLength := opts.pieceLength
+	if pieceLength == 0 {
+		pieceLength = defaultPieceLength(total)
+	}
+
+	h := &pieceHasher{pieceLength: pieceLength, h: sha1.New()}
+	for i, p := range paths {
+		length := total
+		if files != nil {
+			length = files[i].Length
+		}
+		if err := hashFile(h, p, length); err != nil {
+			return nil, err
+		}
+	}
+
+	torrent := &TorrentFile{
+		Comment:   opts.comment,
+		CreatedBy: opts.createdBy,
+		Info: TorrentInfo{
+			Name:        filepath.Base(abs),
+			Files:       files,
+			PieceLength: pieceLength,
+			Pieces:      h.sum(),
+			Source:      opts.source,
+		},
+	}
+	if files == nil {
+		torrent.Info.Length = total
+	}
+	if opts.private {
+		torrent.Info.Private = 1
+	}
+	if urls := opts.trackers.urls(); len(urls) > 0 {
+		torrent.Announce = urls[0]
+		if len(urls) > 1 {
+			// A trailing --tier leaves an empty tier behind.
+			torrent.AnnounceList = announceTiers(opts.trackers, "")
+		}
+	}
+	if len(opts.webSeeds) > 0 {
+		torrent.URLList = []string(opts.webSeeds)
+	}
+
+	return torrent, nil
+}
+
+// hashFile feeds the file at p to h, failing unless it holds exactly length
+// bytes, the size it had when it was listed.
+func hashFile(h *pieceHasher, p string, length int64) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(h, io.LimitReader(f, length+1))
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return fmt.Errorf("%s changed size while being hashed", p)
+	}
+
+	return nil
+}
+
+// pieceHasher hashes what is written to it in pieces of pieceLength bytes.
+type pieceHasher struct {
+	pieceLength int
+	h           hash.Hash
+	// n is how much of the current piece has been written.
+	n      int
+	pieces []byte
+}
+
+func (p *pieceHasher) Write(b []byte) (int, error) {
+	written := len(b)
+	for len(b) > 0 {
+		k := p.pieceLength - p.n
+		if k > len(b) {
+			k = len(b)
+		}
+		p.h.Write(b[:k])
+		p.n += k
+		b = b[k:]
+
+		if p.n == p.pieceLength {
+			p.pieces = p.h.Sum(p.pieces)
+			p.h.Reset()
+			p.n = 0
+		}
+	}
+
+	return written, nil
+}
+
+// sum returns the concatenated hashes of every piece, the last of which may
+// be short.
+func (p *pieceHasher) sum() []byte {
+	if p.n > 0 {
+		p.pieces = p.h.Sum(p.pieces)
+		p.h.Reset()
+		p.n = 0
+	}
+	return p.pieces
+}
+
+// trackerTiers collects the repeatable -a flag of create into tiers of
+// announce URLs, with tierBreak starting a new tier.
+//
+// Example:
+// - -a A -a B --tier -a C -> [[A B] [C]]
+type trackerTiers [][]string
+
+func (t *trackerTiers) String() string {
+	tiers := make([]string, 0, len(*t))
+	for _, tier := range *t {
+		tiers = append(tiers, strings.Join(tier, ","))
+	}
+	return strings.Join(tiers, " | ")
+}
+
+func (t *trackerTiers) Set(value string) error {
+	if value == "" {
+		return errors.New("empty announce URL")
+	}
+	if len(*t) == 0 {
+		*t = [][]string{nil}
+	}
+	last := len(*t) - 1
+	(*t)[last] = append((*t)[last], value)
+	return nil
+}
+
+// urls returns the URLs of every tier, in order.
+func (t trackerTiers) urls() []string {
+	var ret []string
+	for _, tier := range t {
+		ret = append(ret, tier...)
+	}
+	return ret
+}
+
+// tierBreak is the --tier flag of create, which ends the tier of the -a
+// flags before it. A --tier before any -a, or right after another, is a no-op.
+type tierBreak struct{ tiers *trackerTiers }
+
+func (b tierBreak) String() string   { return "" }
+func (b tierBreak) IsBoolFlag() bool { return true }
+
+func (b tierBreak) Set(string) error {
+	if n := len(*b.tiers); n > 0 && len((*b.tiers)[n-1]) > 0 {
+		*b.tiers = append(*b.tiers, nil)
+	}
+	return nil
+}
+
+// stringsFlag is a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
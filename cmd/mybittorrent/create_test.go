@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_defaultPieceLength(t *testing.T) {
+	tests := []struct {
+		total int64
+		want  int
+	}{
+		{total: 1, want: 16 << 10},
+		{total: 1000 * 16 << 10, want: 16 << 10},
+		{total: 1000*16<<10 + 1, want: 32 << 10},
+		{total: 700 << 20, want: 1 << 20},
+		{total: 1 << 40, want: 16 << 20},
+	}
+	for _, tt := range tests {
+		if got := defaultPieceLength(tt.total); got != tt.want {
+			t.Errorf("defaultPieceLength(%d) = %d, want %d", tt.total, got, tt.want)
+		}
+	}
+}
+
+// writeTestTree creates files of the given sizes under a new directory named
+// "data" and returns the directory together with their contents in the order
+// createTorrent hashes them.
+func writeTestTree(t *testing.T, sizes map[string]int) (string, []byte) {
+	t.Helper()
+
+	root := filepath.Join(t.TempDir(), "data")
+	contents := map[string][]byte{}
+	for name, size := range sizes {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		contents[name] = data
+
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var all []byte
+	filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			rel, _ := filepath.Rel(root, p)
+			all = append(all, contents[filepath.ToSlash(rel)]...)
+		}
+		return err
+	})
+
+	return root, all
+}
+
+func Test_runCreate_roundTrip(t *testing.T) {
+	// Pieces of 16 KiB run across the small files and the boundaries
+	// between them.
+	root, data := writeTestTree(t, map[string]int{
+		"a.bin":         20000,
+		"b/c.txt":       3000,
+		"b/d/e.bin":     30000,
+		"z-last.bin":    100,
+		"b/empty.bin":   0,
+		"b/d/tiny.bin":  7,
+		"b/d/tiny2.bin": 9,
+	})
+
+	dir := t.TempDir()
+	create := func(announce string) (string, *Metainfo) {
+		torrentFilepath := filepath.Join(dir, "out.torrent")
+		var out strings.Builder
+		err := runCreate([]string{"-o", torrentFilepath, "-a", announce, "-l", "16384", "--comment", "test data", root}, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := LoadTorrent(torrentFilepath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("Info Hash: %x\n", m.Info.InfoHash); out.String() != want {
+			t.Errorf("runCreate() got = %q, want %q", out.String(), want)
+		}
+		return torrentFilepath, m
+	}
+
+	_, m := create("http://127.0.0.1/announce")
+	info := m.Info
+	if info.Name != "data" || info.Length != int64(len(data)) || info.PieceLength != 16384 || m.Comment != "test data" {
+		t.Errorf("created torrent = %+v, comment %q", info, m.Comment)
+	}
+	wantPaths := [][]string{{"a.bin"}, {"b", "c.txt"}, {"b", "d", "e.bin"}, {"b", "d", "tiny.bin"}, {"b", "d", "tiny2.bin"}, {"b", "empty.bin"}, {"z-last.bin"}}
+	var gotPaths [][]string
+	for _, f := range info.Files {
+		gotPaths = append(gotPaths, f.Path)
+	}
+	if !reflect.DeepEqual(gotPaths, wantPaths) {
+		t.Errorf("created files = %q, want %q", gotPaths, wantPaths)
+	}
+
+	var out strings.Builder
+	if err := runValidate([]string{filepath.Join(dir, "out.torrent")}, &out); err != nil || out.String() != "ok\n" {
+		t.Errorf("runValidate() = %q, %v", out.String(), err)
+	}
+
+	// The pieces must match the files taken back to back, which the seeder
+	// serves and the download verifies.
+	var (
+		seeder  = newTestSeeder(t, &testTorrent{info: info, data: data})
+		tracker = newTestTracker(t, []string{seeder.addr()})
+	)
+	torrentFilepath, withTracker := create(tracker.URL + "/announce")
+	if withTracker.Info.InfoHash != info.InfoHash {
+		t.Errorf("info hash changed with the announce URL: %x vs %x", withTracker.Info.InfoHash, info.InfoHash)
+	}
+
+	outputDir := filepath.Join(dir, "out")
+	if err := runDownload([]string{"-o", outputDir, torrentFilepath}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for _, f := range info.Files {
+		b, err := os.ReadFile(filepath.Join(append([]string{outputDir}, f.Path...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %d bytes that differ from the %d bytes of the files", len(got), len(data))
+	}
+}
+
+func Test_createTorrent_singleFile(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(data)
+	p := filepath.Join(t.TempDir(), "single.bin")
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := createTorrent(p, createOptions{trackers: trackerTiers{{"http://127.0.0.1/announce"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newTestTorrentWithData(t, data, defaultPieceLength(int64(len(data))))
+	if torrent.Info.Name != "single.bin" || torrent.Info.Length != int64(len(data)) || torrent.Info.Files != nil {
+		t.Errorf("createTorrent() info = %+v", torrent.Info)
+	}
+	if !bytes.Equal(torrent.Info.Pieces, want.info.Pieces) {
+		t.Errorf("createTorrent() pieces = %x, want %x", torrent.Info.Pieces, want.info.Pieces)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.bin")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createTorrent(empty, createOptions{}); err == nil {
+		t.Error("createTorrent() of an empty file error = nil")
+	}
+}
+
+func Test_runCreate_trackersWebSeedsPrivate(t *testing.T) {
+	root, _ := writeTestTree(t, map[string]int{"a.bin": 1000, "b/c.bin": 2000})
+	dir := t.TempDir()
+
+	create := func(extra ...string) *Metainfo {
+		t.Helper()
+		torrentFilepath := filepath.Join(dir, "out.torrent")
+		args := append([]string{"-o", torrentFilepath}, extra...)
+		if err := runCreate(append(args, root), io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		m, err := LoadTorrent(torrentFilepath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	m := create(
+		"-a", "http://a.example/announce", "-a", "http://b.example/announce",
+		"--tier", "-a", "udp://c.example:6969",
+		"--webseed", "http://mirror1.example/pub/", "--webseed", "http://mirror2.example/pub",
+		"--private", "--tier",
+	)
+	wantTiers := [][]string{{"http://a.example/announce", "http://b.example/announce"}, {"udp://c.example:6969"}}
+	if m.Announce != "http://a.example/announce" || !reflect.DeepEqual(m.AnnounceList, wantTiers) {
+		t.Errorf("announce = %q, announce list = %q, want %q", m.Announce, m.AnnounceList, wantTiers)
+	}
+	if want := []string{"http://mirror1.example/pub/", "http://mirror2.example/pub/"}; !reflect.DeepEqual(m.Info.WebSeeds, want) {
+		t.Errorf("WebSeeds = %q, want %q", m.Info.WebSeeds, want)
+	}
+	if !m.Info.Private {
+		t.Error("Private = false, want true")
+	}
+
+	// A single tracker needs no announce-list.
+	public := create("-a", "http://a.example/announce")
+	if !reflect.DeepEqual(public.AnnounceList, [][]string{{"http://a.example/announce"}}) || public.Info.Private {
+		t.Errorf("announce list = %q, private = %v", public.AnnounceList, public.Info.Private)
+	}
+	if public.Info.InfoHash == m.Info.InfoHash {
+		t.Error("--private left the info hash unchanged")
+	}
+	commented := create("-a", "http://a.example/announce", "--comment", "hello")
+	if commented.Comment != "hello" || commented.Info.InfoHash != public.Info.InfoHash {
+		t.Errorf("--comment %q changed the info hash to %x from %x", commented.Comment, commented.Info.InfoHash, public.Info.InfoHash)
+	}
+}
+
+func Test_trackerTiers(t *testing.T) {
+	var tiers trackerTiers
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	fs.Var(&tiers, "a", "")
+	fs.Var(tierBreak{&tiers}, "tier", "")
+
+	if err := fs.Parse([]string{"--tier", "-a", "A", "--tier", "--tier", "-a", "B", "-a", "C", "--tier"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := (trackerTiers{{"A"}, {"B", "C"}, nil}); !reflect.DeepEqual(tiers, want) {
+		t.Errorf("tiers = %q, want %q", tiers, want)
+	}
+}
+
+func Test_runCreate_source(t *testing.T) {
+	root, _ := writeTestTree(t, map[string]int{"a.bin": 1000})
+	dir := t.TempDir()
+
+	create := func(name string, extra ...string) (string, *Info) {
+		t.Helper()
+		torrentFilepath := filepath.Join(dir, name)
+		args := append([]string{"-o", torrentFilepath, "-a", "http://a.example/announce", "--private"}, extra...)
+		if err := runCreate(append(args, root), io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		info, err := parseToInfo(torrentFilepath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return torrentFilepath, info
+	}
+
+	_, original := create("original.torrent")
+	siteA, a := create("a.torrent", "--source", "SITE-A")
+	_, b := create("b.torrent", "--source", "SITE-B")
+	if a.Source != "SITE-A" || b.Source != "SITE-B" {
+		t.Errorf("Source = %q and %q", a.Source, b.Source)
+	}
+	if a.InfoHash == b.InfoHash || a.InfoHash == original.InfoHash {
+		t.Errorf("info hashes %x, %x and %x without source are not all different", a.InfoHash, b.InfoHash, original.InfoHash)
+	}
+
+	// Taking the source out of the info dictionary gives back the
+	// torrent made without one.
+	content, err := os.ReadFile(siteA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := bytes.Replace(content, []byte("6:source6:SITE-A"), nil, 1)
+	m, err := ParseMetainfo(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Info.InfoHash != original.InfoHash {
+		t.Errorf("info hash without source = %x, want %x", m.Info.InfoHash, original.InfoHash)
+	}
+
+	var out strings.Builder
+	if err := runInfo([]string{siteA}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Private: yes\nSource: SITE-A\n") {
+		t.Errorf("runInfo() got = %q, want the source", out.String())
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxStringPrealloc is the longest string Decoder allocates room for before
+// reading it.
+const maxStringPrealloc = 4 << 20
+
+// Decoder reads bencoded values one at a time from a stream. It produces the
+// same values as decodeBencode and, for malformed input, the same
+// *SyntaxError, with Offset counted from the start of the stream.
+//
+// Like encoding/json's Decoder it buffers its input, so it may read past the
+// value it returns; the next call to Decode continues right after it.
+type Decoder struct {
+	r *bufio.Reader
+	// offset is how many bytes of the stream have been consumed, where the
+	// next error would be reported.
+	offset int
+	// MaxDepth limits how deeply lists and dictionaries nest; values nested
+	// more deeply fail with ErrMaxDepth.
+	MaxDepth int
+	// MaxStringLength limits the declared length of strings, which are
+	// copied out of the stream.
+	MaxStringLength int
+	// DisallowDuplicateKeys makes a key that repeats within a dictionary an
+	// error instead of overwriting the earlier value.
+	DisallowDuplicateKeys bool
+	// DisallowUnsortedKeys makes a key out of sorted order an error instead
+	// of a warning.
+	DisallowUnsortedKeys bool
+	// LenientIntegers accepts integers with leading zeros or written as -0,
+	// adding a warning for each.
+	LenientIntegers bool
+	// Warnings collects what the spec forbids but was tolerated, such as
+	// keys found out of sorted order.
+	Warnings []string
+	depth    int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), MaxDepth: defaultMaxDepth, MaxStringLength: defaultMaxStringLength}
+}
+
+// Decode reads the next value. It returns io.EOF when the stream ends before
+// a value starts, and a *SyntaxError wrapping io.ErrUnexpectedEOF when it
+// ends inside one.
+func (d *Decoder) Decode() (interface{}, error) {
+	if _, err := d.r.Peek(1); err != nil {
+		return nil, err
+	}
+
+	return d.decodeValue()
+}
+
+func (d *Decoder) decodeValue() (interface{}, error) {
+	start := d.offset
+	c, err := d.peek()
+	if err != nil {
+		return nil, d.endOfInput(err, "unexpected end of input")
+	}
+	if (c == 'l' || c == 'd') && d.depth == d.MaxDepth {
+		return nil, &SyntaxError{Offset: start, Msg: ErrMaxDepth.Error(), Err: ErrMaxDepth}
+	}
+
+	switch {
+	case isDigit(c):
+		return d.decodeString()
+	case c == 'i':
+		return d.decodeInt()
+	case c == 'l':
+		d.readByte()
+		d.depth++
+		defer func() { d.depth-- }()
+
+		ret := []interface{}{}
+		for {
+			end, err := d.consumeEnd()
+			if err != nil {
+				return nil, d.endOfInput(err, "unterminated list")
+			}
+			if end {
+				return ret, nil
+			}
+
+			value, err := d.decodeValue()
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, value)
+		}
+	case c == 'd':
+		d.readByte()
+		d.depth++
+		defer func() { d.depth-- }()
+
+		var (
+			ret     = map[string]interface{}{}
+			prevKey string
+		)
+		for {
+			end, err := d.consumeEnd()
+			if err != nil {
+				return nil, d.endOfInput(err, "unterminated dictionary")
+			}
+			if end {
+				return ret, nil
+			}
+
+			keyStart := d.offset
+			key, err := d.decodeValue()
+			if err != nil {
+				return nil, err
+			}
+			str, ok := key.([]byte)
+			if !ok {
+				return nil, syntaxErrorf(keyStart, "dictionary key is %s, not a string", withArticle(bencodeKind(key)))
+			}
+			if _, dup := ret[string(str)]; dup {
+				if d.DisallowDuplicateKeys {
+					return nil, syntaxErrorf(keyStart, "duplicate dictionary key %q", str)
+				}
+			} else if len(ret) > 0 && string(str) < prevKey {
+				if d.DisallowUnsortedKeys {
+					return nil, syntaxErrorf(keyStart, "dictionary key %q is out of order", str)
+				}
+				d.Warnings = append(d.Warnings, fmt.Sprintf("dictionary key %q is out of order", str))
+			}
+			prevKey = string(str)
+
+			end, err = d.consumeEnd()
+			if err != nil {
+				return nil, d.endOfInput(err, fmt.Sprintf("key %q has no value", str))
+			}
+			if end {
+				return nil, syntaxErrorf(d.offset-1, "key %q has no value", str)
+			}
+
+			value, err := d.decodeValue()
+			if err != nil {
+				return nil, err
+			}
+			ret[string(str)] = value
+		}
+	default:
+		return nil, syntaxErrorf(start, "unexpected %q", c)
+	}
+}
+
+// decodeInt reads an integer, checking its digits like scanInt does.
+func (d *Decoder) decodeInt() (int64, error) {
+	start := d.offset
+	d.readByte()
+
+	var digits []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return 0, d.endOfInput(err, "unterminated integer")
+		}
+		if c == 'e' {
+			break
+		}
+		digits = append(digits, c)
+	}
+
+	ret, err := parseBencodeInt(string(digits), false)
+	if err != nil && d.LenientIntegers {
+		if lenient, lenientErr := parseBencodeInt(string(digits), true); lenientErr == nil {
+			d.Warnings = append(d.Warnings, fmt.Sprintf("integer %q is not canonical", digits))
+			return lenient, nil
+		}
+	}
+	if err != nil {
+		return 0, &SyntaxError{Offset: start + 1, Msg: err.Error(), Err: err}
+	}
+
+	return ret, nil
+}
+
+// decodeString reads a string, checking its length like scanString does.
+func (d *Decoder) decodeString() ([]byte, error) {
+	start := d.offset
+
+	var digits []byte
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return nil, d.endOfInput(err, "expected ':'")
+		}
+		if !isDigit(c) {
+			break
+		}
+		d.readByte()
+		digits = append(digits, c)
+	}
+	if c, _ := d.peek(); c != ':' {
+		return nil, syntaxErrorf(d.offset, "expected ':'")
+	}
+	d.readByte()
+
+	length, err := stringLength(digits, start, d.MaxStringLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copying grows the buffer with the data actually read, so a bogus
+	// length cannot make us allocate it up front. Lengths up to
+	// maxStringPrealloc are trusted, which covers the pieces string of all
+	// but the largest torrents in a single allocation.
+	var buf bytes.Buffer
+	if length <= maxStringPrealloc {
+		buf.Grow(length)
+	}
+	n, err := io.CopyN(&buf, d.r, int64(length))
+	d.offset += int(n)
+	if err != nil {
+		return nil, d.endOfInput(err, fmt.Sprintf("string of length %d runs past the end of input", length))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// consumeEnd reports whether the next byte terminates a list or dictionary,
+// consuming it if so.
+func (d *Decoder) consumeEnd() (bool, error) {
+	c, err := d.peek()
+	if err != nil {
+		return false, err
+	}
+	if c != 'e' {
+		return false, nil
+	}
+
+	d.readByte()
+
+	return true, nil
+}
+
+func (d *Decoder) peek() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err == nil {
+		d.offset++
+	}
+	return c, err
+}
+
+// endOfInput turns running out of input, given as err, into a *SyntaxError
+// at the current offset that wraps io.ErrUnexpectedEOF. Other read errors
+// are returned as they are.
+func (d *Decoder) endOfInput(err error, msg string) error {
+	if !errors.Is(err, io.EOF) {
+		return err
+	}
+	return &SyntaxError{Offset: d.offset, Msg: msg, Err: io.ErrUnexpectedEOF}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_Decoder_concatenated(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("d3:foo3:bare" + "l5:helloi52ee"))
+
+	want := []interface{}{
+		map[string]interface{}{"foo": []byte("bar")},
+		[]interface{}{[]byte("hello"), int64(52)},
+	}
+	for i, w := range want {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode() #%d error = %v", i, err)
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("Decode() #%d got = %v, want %v", i, got, w)
+		}
+	}
+
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Decode() at the end error = %v, want io.EOF", err)
+	}
+}
+
+func Test_Decoder_file(t *testing.T) {
+	content, err := os.ReadFile(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _, err := decodeBencode(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	got, err := NewDecoder(f).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() got = %v, want %v", got, want)
+	}
+}
+
+func Test_Decoder_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr error
+	}{
+		{name: "truncated string", input: "5:abc", wantErr: io.ErrUnexpectedEOF},
+		{name: "unterminated list", input: "l1:e", wantErr: io.ErrUnexpectedEOF},
+		{name: "unterminated integer", input: "i12", wantErr: io.ErrUnexpectedEOF},
+		{name: "integer out of range", input: "i9223372036854775808e", wantErr: errIntegerOutOfRange},
+		{name: "non-string key", input: "di1ei2ee"},
+		{name: "unexpected format", input: "x"},
+		{name: "runaway length", input: strings.Repeat("1", 100) + ":"},
+		{name: "length overflowing int64", input: "99999999999999999999:"},
+		{name: "length over the limit", input: "99999999999999:"},
+		{name: "sign inside length", input: "3-1:ab"},
+		{name: "too deep", input: strings.Repeat("l", 10000), wantErr: ErrMaxDepth},
+		{name: "duplicate key", input: "d1:ai1e1:ai2ee"},
+		{name: "unterminated dictionary", input: "d1:ai1e", wantErr: io.ErrUnexpectedEOF},
+		{name: "key at end of input", input: "d1:a", wantErr: io.ErrUnexpectedEOF},
+		{name: "key without a value", input: "d1:ae"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(strings.NewReader(tt.input))
+			dec.DisallowDuplicateKeys = true
+			_, err := dec.Decode()
+			if err == nil {
+				t.Fatal("Decode() error = nil, want an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_Decoder_strictness(t *testing.T) {
+	const input = "d1:bi03e1:ai1ee"
+
+	dec := NewDecoder(strings.NewReader(input))
+	dec.LenientIntegers = true
+	got, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"a": int64(1), "b": int64(3)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() got = %v, want %v", got, want)
+	}
+	wantWarnings := []string{`integer "03" is not canonical`, `dictionary key "a" is out of order`}
+	if !reflect.DeepEqual(dec.Warnings, wantWarnings) {
+		t.Errorf("Decode() warnings = %q, want %q", dec.Warnings, wantWarnings)
+	}
+
+	dec = NewDecoder(strings.NewReader(input))
+	if _, err := dec.Decode(); err == nil || err.Error() != `syntax error at byte 5: invalid integer "03": leading zero` {
+		t.Errorf("Decode() error = %v", err)
+	}
+
+	dec = NewDecoder(strings.NewReader("d1:bi3e1:ai1ee"))
+	dec.DisallowUnsortedKeys = true
+	if _, err := dec.Decode(); err == nil || err.Error() != `syntax error at byte 7: dictionary key "a" is out of order` {
+		t.Errorf("Decode() error = %v", err)
+	}
+}
+
+// Test_Decoder_sameErrors checks that Decoder reports malformed input with
+// the same *SyntaxError as decodeBencode, so a bad torrent gets the same
+// error from info as from decode -f.
+func Test_Decoder_sameErrors(t *testing.T) {
+	inputs := []string{
+		"",
+		"5hello",
+		"5",
+		"i42",
+		"i1x2e",
+		"i03e",
+		"i-0e",
+		"i9223372036854775808e",
+		"10:abc",
+		"d3:fool4:spam3eggee",
+		"li1e5:ab",
+		"d3:fooi1ei2ei3ee",
+		"di1e3:fooe",
+		"dl1:aei1ee",
+		"ld1:ad1:bi1eedei1ee",
+		"ll1:a",
+		"l",
+		"d3:foo3:bar",
+		"99999999999999999999:",
+		"99999999999999:",
+		strings.Repeat("1", 100) + ":",
+		"+3:abc",
+		"-1:a",
+		"3-1:ab",
+		"d3:foo",
+		"d3:fooe",
+		"d1:ad1:bee",
+		"x",
+		strings.Repeat("l", 200),
+	}
+	for _, input := range inputs {
+		_, _, want := decodeBencode([]byte(input))
+		if want == nil {
+			t.Fatalf("decodeBencode(%q) error = nil", input)
+		}
+		_, got := NewDecoder(strings.NewReader(input)).Decode()
+		if input == "" {
+			// A stream may hold no value at all.
+			if got != io.EOF {
+				t.Errorf("Decode(%q) error = %v, want io.EOF", input, got)
+			}
+			continue
+		}
+
+		var serr *SyntaxError
+		if !errors.As(got, &serr) {
+			t.Errorf("Decode(%q) error = %v, want a *SyntaxError", input, got)
+			continue
+		}
+		if got.Error() != want.Error() {
+			t.Errorf("Decode(%q) error = %q, want %q", input, got, want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "bad.torrent")
+	if err := os.WriteFile(path, []byte("d6:lengthi1x2ee"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	const want = `syntax error at byte 10: invalid integer "1x2"`
+	if _, err := LoadTorrent(path); err == nil || err.Error() != want {
+		t.Errorf("LoadTorrent() error = %v, want %q", err, want)
+	}
+	if err := runDecode([]string{"-f", path}, io.Discard); err == nil || err.Error() != want {
+		t.Errorf("runDecode() error = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Difference is one place where two decoded values differ. Path names it
+// like "info.piece length" or "announce-list[1]", and is empty for the
+// values themselves.
+type Difference struct {
+	Path string
+	Msg  string
+}
+
+func (d Difference) String() string {
+	if d.Path == "" {
+		return d.Msg
+	}
+	return d.Path + ": " + d.Msg
+}
+
+// Diff walks two decoded values side by side and returns where they differ,
+// in key order, such as
+//
+//	info.piece length: 262144 vs 262145
+//	info: key "private" only in a
+//
+// Lists are compared item by item as far as both go. Values of different
+// types are reported without looking inside them.
+func Diff(a, b interface{}) []Difference {
+	var ret []Difference
+	diffValues(a, b, "", &ret)
+	return ret
+}
+
+func diffValues(a, b interface{}, path string, ret *[]Difference) {
+	if kindA, kindB := bencodeKind(a), bencodeKind(b); kindA != kindB {
+		*ret = append(*ret, Difference{Path: path, Msg: kindA + " vs " + kindB})
+		return
+	}
+
+	switch a := a.(type) {
+	case []byte:
+		b := b.([]byte)
+		if string(a) == string(b) {
+			return
+		}
+		shownA, shownB := prettyString(a), prettyString(b)
+		if shownA != shownB {
+			*ret = append(*ret, Difference{Path: path, Msg: shownA + " vs " + shownB})
+			return
+		}
+		// Long binary strings that only differ past what prettyString shows,
+		// as pieces usually do.
+		i := 0
+		for a[i] == b[i] {
+			i++
+		}
+		*ret = append(*ret, Difference{Path: path, Msg: fmt.Sprintf("%d-byte strings differ from byte %d", len(a), i)})
+	case int64:
+		b := b.(int64)
+		if a != b {
+			*ret = append(*ret, Difference{Path: path, Msg: strconv.FormatInt(a, 10) + " vs " + strconv.FormatInt(b, 10)})
+		}
+	case []interface{}:
+		b := b.([]interface{})
+		if len(a) != len(b) {
+			*ret = append(*ret, Difference{Path: path, Msg: fmt.Sprintf("%d items vs %d", len(a), len(b))})
+		}
+		for i := 0; i < len(a) && i < len(b); i++ {
+			diffValues(a[i], b[i], fmt.Sprintf("%s[%d]", path, i), ret)
+		}
+	default:
+		dictA, _ := asDict(a)
+		dictB, _ := asDict(b)
+		diffDicts(dictA, dictB, path, ret)
+	}
+}
+
+func diffDicts(a, b map[string]interface{}, path string, ret *[]Difference) {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		valueA, inA := a[k]
+		valueB, inB := b[k]
+		switch {
+		case !inB:
+			*ret = append(*ret, Difference{Path: path, Msg: fmt.Sprintf("key %q only in a", k)})
+		case !inA:
+			*ret = append(*ret, Difference{Path: path, Msg: fmt.Sprintf("key %q only in b", k)})
+		default:
+			diffValues(valueA, valueB, joinPath(path, k), ret)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_Diff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b interface{}
+		want []string
+	}{
+		{
+			name: "equal",
+			a:    map[string]interface{}{"a": []interface{}{int64(1)}},
+			b:    map[string]interface{}{"a": []interface{}{int64(1)}},
+		},
+		{
+			name: "integer",
+			a:    map[string]interface{}{"info": map[string]interface{}{"piece length": int64(262144)}},
+			b:    map[string]interface{}{"info": map[string]interface{}{"piece length": int64(262145)}},
+			want: []string{"info.piece length: 262144 vs 262145"},
+		},
+		{
+			name: "keys on one side",
+			a:    map[string]interface{}{"info": map[string]interface{}{"private": int64(1)}},
+			b:    map[string]interface{}{"info": map[string]interface{}{}, "comment": []byte("x")},
+			want: []string{`key "comment" only in b`, `info: key "private" only in a`},
+		},
+		{
+			name: "list lengths",
+			a:    []interface{}{[]byte("a"), []byte("b"), []byte("c")},
+			b:    []interface{}{[]byte("a"), []byte("x")},
+			want: []string{"3 items vs 2", `[1]: "b" vs "x"`},
+		},
+		{
+			name: "types",
+			a:    map[string]interface{}{"l": []interface{}{int64(1)}, "n": int64(1)},
+			b:    map[string]interface{}{"l": []interface{}{[]byte("1")}, "n": map[string]interface{}{}},
+			want: []string{"l[0]: integer vs string", "n: integer vs dictionary"},
+		},
+		{
+			name: "long binary strings",
+			a:    []byte("\xff" + string(make([]byte, 39))),
+			b:    []byte("\xff" + string(make([]byte, 30)) + "\x01" + string(make([]byte, 8))),
+			want: []string{"40-byte strings differ from byte 31"},
+		},
+		{
+			name: "ordered against plain dictionary",
+			a:    &OrderedDict{Keys: []string{"a"}, Values: map[string]interface{}{"a": int64(1)}},
+			b:    map[string]interface{}{"a": int64(2)},
+			want: []string{"a: 1 vs 2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range Diff(tt.a, tt.b) {
+				got = append(got, d.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,898 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	blockSize = 16 * 1024
+	// maxBlockSize caps --block-size; peers commonly drop connections that
+	// ask for more.
+	maxBlockSize = 128 * 1024
+	// defaultBacklog is how many requests we keep in flight to a peer that
+	// did not advertise reqq, and maxBacklog caps what a reqq can ask for.
+	defaultBacklog = 5
+	maxBacklog     = 100
+	dialTimeout    = 3 * time.Second
+	// defaultStallTimeout is how long a download may go without completing a
+	// piece before the tracker is asked for fresh peers.
+	defaultStallTimeout = 30 * time.Second
+	// pieceTimeout bounds how long a single peer may take to deliver a piece.
+	pieceTimeout = 30 * time.Second
+	// defaultBlockTimeout is how long a requested block may take to arrive
+	// before it is requested again, at most maxBlockRetries times.
+	defaultBlockTimeout = 5 * time.Second
+	maxBlockRetries     = 2
+	// defaultMaxBadPieces is how many pieces a peer may deliver that fail
+	// verification before it is blocklisted for the rest of the download.
+	defaultMaxBadPieces = 3
+)
+
+// errPieceCanceled is returned by downloadPiece when another peer assembled
+// the piece first.
+var errPieceCanceled = errors.New("piece canceled")
+
+type pieceWork struct {
+	index  int
+	hash   [sha1.Size]byte
+	length int
+}
+
+type pieceResult struct {
+	index int
+	buf   []byte
+	// from is the peer that delivered buf, and elapsed how long it took
+	// from the first request.
+	from    *peerConn
+	elapsed time.Duration
+}
+
+// pieceSource records where a verified piece came from.
+type pieceSource struct {
+	peer    string
+	elapsed time.Duration
+}
+
+// peerBitfield is the set of pieces a peer has, as sent in a bitfield message.
+type peerBitfield []byte
+
+func (bf peerBitfield) hasPiece(index int) bool {
+	byteIndex, offset := index/8, index%8
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return false
+	}
+	return bf[byteIndex]>>(7-offset)&1 != 0
+}
+
+func (bf peerBitfield) setPiece(index int) {
+	byteIndex, offset := index/8, index%8
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - offset)
+}
+
+// writeManifest lists every piece index of a completed download together
+// with the SHA-1 of its data, one "<index> <hash>" line per piece. When
+// sources is given, each line also names the peer that delivered the piece
+// and how long it took: "<index> <hash> <peer> <duration>".
+func writeManifest(w io.Writer, info *Info, buf []byte, sources []pieceSource) error {
+	for i := 0; i*info.PieceLength < len(buf); i++ {
+		begin := i * info.PieceLength
+		sum := sha1.Sum(buf[begin : begin+info.PieceSize(i)])
+
+		var err error
+		if i < len(sources) {
+			_, err = fmt.Fprintf(w, "%d %x %s %v\n", i, sum, sources[i].peer, sources[i].elapsed.Round(time.Millisecond))
+		} else {
+			_, err = fmt.Fprintf(w, "%d %x\n", i, sum)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeManifestFile(path string, info *Info, buf []byte, sources []pieceSource) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = writeManifest(f, info, buf, sources)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// outputFile is what writeFileAtomic needs from an *os.File.
+type outputFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// createFile, renameFile and syncDir are the file system operations behind
+// writeFileAtomic, swapped out by tests to observe their order.
+var (
+	createFile = func(name string) (outputFile, error) {
+		return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	}
+	renameFile = os.Rename
+	syncDir    = func(dir string) error {
+		f, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return f.Sync()
+	}
+)
+
+// writeFileAtomic writes data to path+".part" and renames it to path, so path
+// never holds a partial download. With fsync the data is flushed to disk
+// before the rename and the rename itself afterwards, so that a crash cannot
+// leave path empty or truncated.
+func writeFileAtomic(path string, data []byte, fsync bool) (err error) {
+	partPath := path + ".part"
+
+	f, err := createFile(partPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(partPath)
+		}
+	}()
+
+	_, err = f.Write(data)
+	if err == nil && fsync {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = renameFile(partPath, path)
+	if err != nil {
+		return err
+	}
+
+	if fsync {
+		return syncDir(filepath.Dir(path))
+	}
+
+	return nil
+}
+
+// writeFiles writes the download data of a multi-file torrent as the files of
+// info under dir, each with writeFileAtomic. Padding files are not created,
+// but their bytes still count towards the offset of the files after them.
+// Empty files take up no bytes and are created empty.
+func writeFiles(dir string, info *Info, data []byte, fsync bool) error {
+	var offset int64
+	for _, f := range info.Files {
+		start := offset
+		offset += f.Length
+		if f.IsPadding() {
+			continue
+		}
+
+		p := filepath.Join(append([]string{dir}, f.Path...)...)
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(p, data[start:offset], fsync); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkPieceHash(pw *pieceWork, buf []byte) bool {
+	return pieceHashMatches(sha1.New, pw, buf)
+}
+
+// pieceHashMatches reports whether buf hashes to pw.hash with newHash.
+func pieceHashMatches(newHash func() hash.Hash, pw *pieceWork, buf []byte) bool {
+	h := newHash()
+	h.Write(buf)
+
+	return bytes.Equal(h.Sum(nil), pw.hash[:])
+}
+
+type downloader struct {
+	info  *Info
+	peers []string
+
+	// verifyPiece reports whether buf is the expected content of pw. It runs
+	// on the verification goroutine, never on a peer connection goroutine.
+	// By default it compares the piece hash computed with newHash.
+	verifyPiece func(pw *pieceWork, buf []byte) bool
+	newHash     func() hash.Hash
+
+	// announce, when set, is asked for fresh peers whenever no piece has
+	// completed for stallTimeout or every peer connection is gone.
+	announce     func() ([]string, error)
+	stallTimeout time.Duration
+
+	blockTimeout time.Duration
+	// blockSize is the largest block requested from any peer; a peer may
+	// lower it for itself in its extension handshake.
+	blockSize int
+	dialer    *net.Dialer
+	strategy  pieceStrategy
+
+	// maxBadPieces is how many failed pieces a peer may deliver before it
+	// is disconnected and never connected to again.
+	maxBadPieces int
+
+	mu    sync.Mutex
+	conns map[*peerConn]bool
+	// badPieces counts the pieces each peer address delivered that failed
+	// verification, and blocked holds the addresses that reached
+	// maxBadPieces.
+	badPieces map[string]int
+	blocked   map[string]bool
+
+	// sources is filled in by download with where each piece came from.
+	sources []pieceSource
+}
+
+func newDownloader(info *Info, peers []string) *downloader {
+	d := &downloader{
+		info:         info,
+		peers:        peers,
+		newHash:      sha1.New,
+		stallTimeout: defaultStallTimeout,
+		blockTimeout: defaultBlockTimeout,
+		blockSize:    blockSize,
+		dialer:       &net.Dialer{Timeout: dialTimeout},
+		strategy:     rarestStrategy{},
+		maxBadPieces: defaultMaxBadPieces,
+		conns:        map[*peerConn]bool{},
+		badPieces:    map[string]int{},
+		blocked:      map[string]bool{},
+	}
+	d.verifyPiece = func(pw *pieceWork, buf []byte) bool {
+		return pieceHashMatches(d.newHash, pw, buf)
+	}
+
+	return d
+}
+
+// download fetches every piece from the peers and returns the whole content.
+//
+// Peer goroutines take pieces from the scheduler and hand assembled pieces to
+// a single verification goroutine, so hashing never holds up network reads.
+// Pieces that fail verification go back to the scheduler to be downloaded
+// again, and a peer that keeps delivering them is blocklisted.
+func (d *downloader) download() ([]byte, error) {
+	numPieces := d.info.NumPieces()
+
+	pieces := make([]*pieceWork, numPieces)
+	for i := range pieces {
+		pieces[i] = &pieceWork{index: i, length: d.info.PieceSize(i), hash: d.info.PieceHashes[i]}
+	}
+	s := newScheduler(pieces, d.strategy)
+
+	var (
+		assembled = make(chan *pieceResult, numPieces)
+		verified  = make(chan *pieceResult)
+		exited    = make(chan struct{}, 1)
+		seen      = map[string]bool{}
+		active    int32
+		wg        sync.WaitGroup
+	)
+	connect := func(peer string) bool {
+		if seen[peer] || d.isBlocked(peer) {
+			return false
+		}
+		seen[peer] = true
+
+		wg.Add(1)
+		atomic.AddInt32(&active, 1)
+		go func() {
+			defer wg.Done()
+			// A failing peer only shrinks the pool; the scheduler hands its
+			// piece to someone else.
+			_ = d.runPeer(peer, s, assembled)
+
+			atomic.AddInt32(&active, -1)
+			select {
+			case exited <- struct{}{}:
+			default:
+			}
+		}()
+		return true
+	}
+
+	// The download loop below holds its own count so that assembled stays
+	// open while it may still connect to new peers.
+	wg.Add(1)
+	for _, peer := range d.peers {
+		connect(peer)
+	}
+	go func() {
+		wg.Wait()
+		close(assembled)
+	}()
+
+	go func() {
+		defer close(verified)
+		for res := range assembled {
+			if !d.verifyPiece(pieces[res.index], res.buf) {
+				// Drop a repeat offender before the piece is up for grabs
+				// again, so that it cannot take it straight back.
+				d.reportBadPiece(res.from)
+				s.requeue(res.index)
+				continue
+			}
+			s.complete(res.index)
+			verified <- res
+		}
+	}()
+
+	d.sources = make([]pieceSource, numPieces)
+
+	var (
+		buf   = make([]byte, d.info.Length)
+		done  int
+		stall = time.NewTimer(d.stallTimeout)
+	)
+	defer stall.Stop()
+
+loop:
+	for done < numPieces {
+		select {
+		case res := <-verified:
+			copy(buf[res.index*d.info.PieceLength:], res.buf)
+			d.sources[res.index] = pieceSource{peer: res.from.addr, elapsed: res.elapsed}
+			debugf("piece %d from %s in %v", res.index, res.from.addr, res.elapsed)
+			done++
+			resetTimer(stall, d.stallTimeout)
+			continue
+		case <-stall.C:
+		case <-exited:
+			if atomic.LoadInt32(&active) > 0 {
+				continue
+			}
+		}
+
+		// Nothing completed for a while or nobody is left to ask, so look
+		// for fresh peers instead of waiting on dead connections.
+		added := 0
+		for _, peer := range d.reannounce() {
+			if connect(peer) {
+				added++
+			}
+		}
+		if added == 0 && atomic.LoadInt32(&active) == 0 {
+			break loop
+		}
+		resetTimer(stall, d.stallTimeout)
+	}
+
+	s.close()
+	d.closeConns()
+	wg.Done()
+	go func() {
+		for range verified {
+		}
+	}()
+
+	if done < numPieces {
+		return nil, withExitCode(exitNetwork, fmt.Errorf("download incomplete: %d of %d pieces, no usable peers left", done, numPieces))
+	}
+
+	return buf, nil
+}
+
+// reannounce asks the tracker for the current peer list.
+func (d *downloader) reannounce() []string {
+	if d.announce == nil {
+		return nil
+	}
+
+	peers, err := d.announce()
+	if err != nil {
+		warnf("re-announce failed: %v", err)
+		return nil
+	}
+
+	return peers
+}
+
+// reportBadPiece records that pc delivered a piece that failed verification
+// and blocklists it once that has happened d.maxBadPieces times.
+func (d *downloader) reportBadPiece(pc *peerConn) {
+	d.mu.Lock()
+	d.badPieces[pc.addr]++
+	block := d.badPieces[pc.addr] >= d.maxBadPieces && !d.blocked[pc.addr]
+	if block {
+		d.blocked[pc.addr] = true
+	}
+	d.mu.Unlock()
+
+	if block {
+		warnf("blocklisting peer %s after %d corrupt pieces", pc.addr, d.maxBadPieces)
+		pc.close()
+	}
+}
+
+func (d *downloader) isBlocked(peer string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.blocked[peer]
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+func (d *downloader) closeConns() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for pc := range d.conns {
+		pc.close()
+	}
+}
+
+func (d *downloader) connect(peer string) (*peerConn, error) {
+	conn, err := d.dialer.Dial("tcp", peer)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reply, err := handshakeMessage(conn, d.info, clientPeerID)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pc := newPeerConn(peer, conn)
+	pc.blockTimeout = d.blockTimeout
+	pc.blockSize = d.blockSize
+
+	if reply[1+19+extensionByte]&extensionBit != 0 {
+		err = sendExtensionHandshake(conn, d.info)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	for pc.bitfield == nil {
+		msg, err := readPeerMessage(conn)
+		if err != nil {
+			conn.Close()
+			return nil, closedAfterHandshake(err)
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.id {
+		case bitfield:
+			pc.bitfield = peerBitfield(msg.payload)
+		case extended:
+			pc.handleExtended(msg.payload)
+		}
+	}
+
+	err = sendPeerMessage(conn, interested, []byte{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pc.startReading()
+
+	return pc, nil
+}
+
+func (d *downloader) runPeer(peer string, s *scheduler, assembled chan<- *pieceResult) error {
+	pc, err := d.connect(peer)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.conns[pc] = true
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.conns, pc)
+		d.mu.Unlock()
+
+		pc.close()
+		s.release(pc)
+	}()
+
+	for {
+		pw := s.next(pc)
+		if pw == nil {
+			return nil
+		}
+
+		start := time.Now()
+		buf, err := pc.downloadPiece(pw)
+		if errors.Is(err, errPieceCanceled) {
+			s.drop(pw.index, pc)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		losers, ok := s.assembled(pw.index, pc)
+		if !ok {
+			continue
+		}
+		for _, loser := range losers {
+			loser.cancelPiece(pw.index)
+		}
+		assembled <- &pieceResult{index: pw.index, buf: buf, from: pc, elapsed: time.Since(start)}
+	}
+}
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+type peerConn struct {
+	addr   string
+	conn   net.Conn
+	choked bool
+	// bitfield is only accessed under mu once the peer is handed to the
+	// scheduler; see hasPiece.
+	bitfield peerBitfield
+	// backlog is how many requests may be in flight at once, and blockSize
+	// the largest block requested.
+	backlog   int
+	blockSize int
+	// blockTimeout is how long a requested block may take before it is
+	// requested again.
+	blockTimeout time.Duration
+
+	// messages carries what the reader goroutine receives once the
+	// connection is set up. It is closed on the first read error, which is
+	// left in readErr.
+	messages chan *peerMessage
+	readErr  error
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// mu guards writes to conn and the fields below, which another peer's
+	// goroutine touches when it cancels a piece it assembled first.
+	mu sync.Mutex
+	// outstanding maps each request still waiting for its block to when
+	// it was last sent.
+	outstanding map[blockRequest]time.Time
+	// canceledPiece is the index of the piece another peer assembled first,
+	// or -1. Being an index, a cancel that comes in after this peer has
+	// moved on to another piece leaves that piece alone.
+	canceledPiece int
+}
+
+func newPeerConn(addr string, conn net.Conn) *peerConn {
+	return &peerConn{
+		addr:          addr,
+		conn:          conn,
+		choked:        true,
+		backlog:       defaultBacklog,
+		blockSize:     blockSize,
+		blockTimeout:  defaultBlockTimeout,
+		messages:      make(chan *peerMessage),
+		done:          make(chan struct{}),
+		outstanding:   map[blockRequest]time.Time{},
+		canceledPiece: -1,
+	}
+}
+
+// startReading hands every message read from conn to pc.messages, so that
+// waiting for a message can be combined with timers.
+func (pc *peerConn) startReading() {
+	go func() {
+		for {
+			msg, err := readPeerMessage(pc.conn)
+			if err != nil {
+				pc.readErr = err
+				close(pc.messages)
+				return
+			}
+			if msg == nil {
+				continue
+			}
+
+			select {
+			case pc.messages <- msg:
+			case <-pc.done:
+				return
+			}
+		}
+	}()
+}
+
+// close closes the connection and stops the reader goroutine.
+func (pc *peerConn) close() {
+	pc.doneOnce.Do(func() {
+		close(pc.done)
+		pc.conn.Close()
+	})
+}
+
+// handleExtended applies an extension protocol message. Only the extension
+// handshake matters to us; other extended messages are ignored.
+func (pc *peerConn) handleExtended(payload []byte) {
+	if len(payload) < 1 || payload[0] != extendedHandshakeID {
+		return
+	}
+
+	eh, err := parseExtensionHandshake(payload)
+	if err != nil {
+		return
+	}
+
+	if eh.reqq > 0 {
+		pc.backlog = eh.reqq
+		if pc.backlog > maxBacklog {
+			pc.backlog = maxBacklog
+		}
+	}
+	if eh.maxBlock > 0 && eh.maxBlock < pc.blockSize {
+		pc.blockSize = eh.maxBlock
+		debugf("peer %s: requesting blocks of at most %d bytes", pc.addr, pc.blockSize)
+	}
+}
+
+func (pc *peerConn) sendRequest(req blockRequest) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(req.index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(req.begin))
+	binary.BigEndian.PutUint32(payload[8:], uint32(req.length))
+
+	err := sendPeerMessage(pc.conn, request, payload)
+	if err != nil {
+		return err
+	}
+
+	pc.outstanding[req] = time.Now()
+
+	return nil
+}
+
+// received marks the block at begin of piece index as no longer outstanding
+// and reports whether it had been requested.
+func (pc *peerConn) received(index, begin, length int) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	req := blockRequest{index: index, begin: begin, length: length}
+	if _, ok := pc.outstanding[req]; !ok {
+		return false
+	}
+	delete(pc.outstanding, req)
+
+	return true
+}
+
+// expired returns the outstanding requests of piece index that were sent
+// more than pc.blockTimeout ago.
+func (pc *peerConn) expired(index int, now time.Time) []blockRequest {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	var ret []blockRequest
+	for req, sentAt := range pc.outstanding {
+		if req.index == index && now.Sub(sentAt) >= pc.blockTimeout {
+			ret = append(ret, req)
+		}
+	}
+
+	return ret
+}
+
+// cancelPiece sends a cancel for every outstanding request of piece index and
+// makes the running downloadPiece for it give up.
+func (pc *peerConn) cancelPiece(index int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.canceledPiece = index
+	for req := range pc.outstanding {
+		if req.index != index {
+			continue
+		}
+
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint32(payload[0:4], uint32(req.index))
+		binary.BigEndian.PutUint32(payload[4:8], uint32(req.begin))
+		binary.BigEndian.PutUint32(payload[8:], uint32(req.length))
+
+		// Failing to cancel only costs bandwidth; the blocks are ignored.
+		_ = sendPeerMessage(pc.conn, cancel, payload)
+		delete(pc.outstanding, req)
+	}
+}
+
+// hasPiece and setPiece access pc.bitfield, which the scheduler reads from
+// other peers' goroutines to work out piece availability.
+func (pc *peerConn) hasPiece(index int) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.bitfield.hasPiece(index)
+}
+
+func (pc *peerConn) setPiece(index int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.bitfield.setPiece(index)
+}
+
+// takeCancel reports whether piece index has been canceled, clearing the
+// cancel if so.
+func (pc *peerConn) takeCancel(index int) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.canceledPiece != index {
+		return false
+	}
+	pc.canceledPiece = -1
+
+	return true
+}
+
+// downloadPiece requests the blocks of pw, keeping up to pc.backlog requests
+// in flight, and returns the assembled piece once every block has arrived.
+//
+// A block that does not arrive within pc.blockTimeout is requested again, up
+// to maxBlockRetries times, after which the peer is given up on so that the
+// piece can go to another peer.
+func (pc *peerConn) downloadPiece(pw *pieceWork) ([]byte, error) {
+	var (
+		buf                            = make([]byte, pw.length)
+		downloaded, requested, backlog int
+		retries                        = map[blockRequest]int{}
+		deadline                       = time.NewTimer(pieceTimeout)
+		ticker                         = time.NewTicker(pc.blockTimeout / 4)
+	)
+	defer deadline.Stop()
+	defer ticker.Stop()
+
+	for downloaded < pw.length {
+		if pc.takeCancel(pw.index) {
+			return nil, errPieceCanceled
+		}
+
+		if !pc.choked {
+			for backlog < pc.backlog && requested < pw.length {
+				length := pc.blockSize
+				if pw.length-requested < length {
+					length = pw.length - requested
+				}
+
+				err := pc.sendRequest(blockRequest{index: pw.index, begin: requested, length: length})
+				if err != nil {
+					return nil, err
+				}
+
+				backlog++
+				requested += length
+			}
+		}
+
+		var msg *peerMessage
+		select {
+		case m, ok := <-pc.messages:
+			if !ok {
+				return nil, pc.readErr
+			}
+			msg = m
+		case now := <-ticker.C:
+			// A choked peer drops our requests, so they only time out
+			// while we are unchoked.
+			if pc.choked {
+				continue
+			}
+			for _, req := range pc.expired(pw.index, now) {
+				retries[req]++
+				if retries[req] > maxBlockRetries {
+					return nil, fmt.Errorf("block timed out. index: %d, begin: %d", req.index, req.begin)
+				}
+
+				err := pc.sendRequest(req)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case <-deadline.C:
+			return nil, fmt.Errorf("piece %d timed out", pw.index)
+		}
+
+		switch msg.id {
+		case unchoke:
+			pc.choked = false
+		case choke:
+			pc.choked = true
+		case have:
+			if len(msg.payload) != 4 {
+				return nil, errors.New("invalid have message")
+			}
+			pc.setPiece(int(binary.BigEndian.Uint32(msg.payload)))
+		case extended:
+			pc.handleExtended(msg.payload)
+		case piece:
+			if len(msg.payload) < 8 {
+				return nil, errors.New("invalid piece message")
+			}
+
+			var (
+				index = int(binary.BigEndian.Uint32(msg.payload[0:4]))
+				begin = int(binary.BigEndian.Uint32(msg.payload[4:8]))
+				block = msg.payload[8:]
+			)
+			// Blocks of a canceled piece, or answers to a request that was
+			// sent twice, may still be on the wire.
+			if !pc.received(index, begin, len(block)) {
+				continue
+			}
+			if index != pw.index || begin+len(block) > len(buf) {
+				return nil, fmt.Errorf("block out of range. index: %d, begin: %d, length: %d", index, begin, len(block))
+			}
+			copy(buf[begin:], block)
+
+			downloaded += len(block)
+			backlog--
+		}
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,905 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTorrent is a synthetic single-file torrent written to a temporary file.
+type testTorrent struct {
+	path string
+	info *Info
+	data []byte
+}
+
+func newTestTorrent(t *testing.T, length, pieceLength int) *testTorrent {
+	t.Helper()
+
+	data := make([]byte, length)
+	rand.New(rand.NewSource(int64(length))).Read(data)
+
+	return newTestTorrentWithData(t, data, pieceLength)
+}
+
+func newTestTorrentWithData(t *testing.T, data []byte, pieceLength int) *testTorrent {
+	t.Helper()
+
+	length := len(data)
+	pieces := ""
+	for begin := 0; begin < length; begin += pieceLength {
+		end := begin + pieceLength
+		if end > length {
+			end = length
+		}
+		sum := sha1.Sum(data[begin:end])
+		pieces += string(sum[:])
+	}
+
+	path, info := writeTestTorrentFile(t, map[string]interface{}{
+		"announce": "http://127.0.0.1/announce",
+		"info": map[string]interface{}{
+			"length":       length,
+			"name":         "test.bin",
+			"piece length": pieceLength,
+			"pieces":       pieces,
+		},
+	})
+
+	return &testTorrent{path: path, info: info, data: data}
+}
+
+// writeTestTorrentFile bencodes metainfo into a temporary .torrent file and
+// parses it back.
+func writeTestTorrentFile(t *testing.T, metainfo map[string]interface{}) (string, *Info) {
+	t.Helper()
+
+	path, m := writeTestMetainfo(t, metainfo)
+
+	return path, m.Info
+}
+
+// writeTestMetainfo is writeTestTorrentFile for tests that need the Metainfo
+// around the Info, such as its trackers.
+func writeTestMetainfo(t *testing.T, metainfo map[string]interface{}) (string, *Metainfo) {
+	t.Helper()
+
+	bencoded, err := bencode(metainfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, []byte(bencoded), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := LoadTorrent(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, m
+}
+
+// testSeeder is a peer that has every piece of a testTorrent and answers
+// requests for them.
+type testSeeder struct {
+	t        *testing.T
+	listener net.Listener
+	torrent  *testTorrent
+	peerID   []byte
+
+	// delay is how long the seeder waits before answering each request.
+	delay time.Duration
+	// reqq and maxBlock, when set, are advertised in an extension
+	// handshake. The seeder hangs up on requests larger than maxBlock.
+	reqq     int
+	maxBlock int
+	// drop, when set, is a request the seeder ignores the first time.
+	drop *blockRequest
+	// corrupt makes the seeder send garbage instead of the piece data.
+	corrupt bool
+
+	// served counts the blocks sent to clients and cancels the cancel
+	// messages received from them. maxOutstanding is the most requests a
+	// single client ever had in flight.
+	served         int64
+	cancels        int64
+	maxOutstanding int64
+	dropped        int64
+	oversized      int64
+
+	// servedPieces holds the indices of pieces the seeder sent blocks of.
+	mu           sync.Mutex
+	servedPieces map[int]bool
+}
+
+func newTestSeeder(t *testing.T, torrent *testTorrent, opts ...func(*testSeeder)) *testSeeder {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testSeeder{
+		t:        t,
+		listener: listener,
+		torrent:  torrent,
+		peerID:   []byte("-TS0001-000000000000"),
+
+		servedPieces: map[int]bool{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func withDelay(delay time.Duration) func(*testSeeder) {
+	return func(s *testSeeder) {
+		s.delay = delay
+	}
+}
+
+func withReqq(reqq int) func(*testSeeder) {
+	return func(s *testSeeder) {
+		s.reqq = reqq
+	}
+}
+
+func withMaxBlock(maxBlock int) func(*testSeeder) {
+	return func(s *testSeeder) {
+		s.maxBlock = maxBlock
+	}
+}
+
+func withDroppedRequest(req blockRequest) func(*testSeeder) {
+	return func(s *testSeeder) {
+		s.drop = &req
+	}
+}
+
+func withCorruptBlocks() func(*testSeeder) {
+	return func(s *testSeeder) {
+		s.corrupt = true
+	}
+}
+
+func (s *testSeeder) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testSeeder) serve(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, 68)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	copy(buf[48:], s.peerID)
+	if _, err := conn.Write(buf); err != nil {
+		return
+	}
+
+	var (
+		info      = s.torrent.info
+		numPieces = len(info.Pieces) / sha1.Size
+		bf        = make(peerBitfield, (numPieces+7)/8)
+	)
+	for i := 0; i < numPieces; i++ {
+		bf.setPiece(i)
+	}
+
+	// queued counts the requests for each block waiting in queue, and
+	// canceled how many of those were canceled. A cancel only applies to a
+	// request that is still waiting, so the block can be requested again
+	// later.
+	var (
+		mu          sync.Mutex
+		queued      = map[string]int{}
+		canceled    = map[string]int{}
+		queue       = make(chan []byte, 64)
+		outstanding int64
+	)
+	send := func(id byte, payload []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return sendPeerMessage(conn, id, payload)
+	}
+
+	// Requests are answered on their own goroutine so that cancels arriving
+	// while a response is delayed are seen right away.
+	go func() {
+		for req := range queue {
+			time.Sleep(s.delay)
+
+			mu.Lock()
+			queued[string(req)]--
+			skip := canceled[string(req)] > 0
+			if skip {
+				canceled[string(req)]--
+			}
+			outstanding--
+			mu.Unlock()
+			if skip {
+				continue
+			}
+
+			var (
+				index  = int(binary.BigEndian.Uint32(req[0:4]))
+				begin  = int(binary.BigEndian.Uint32(req[4:8]))
+				length = int(binary.BigEndian.Uint32(req[8:12]))
+				offset = index*info.PieceLength + begin
+			)
+			payload := make([]byte, 8+length)
+			copy(payload, req[:8])
+			copy(payload[8:], s.torrent.data[offset:offset+length])
+			if s.corrupt {
+				for i := 8; i < len(payload); i++ {
+					payload[i] ^= 0xff
+				}
+			}
+			if err := send(piece, payload); err != nil {
+				return
+			}
+			atomic.AddInt64(&s.served, 1)
+
+			s.mu.Lock()
+			s.servedPieces[index] = true
+			s.mu.Unlock()
+		}
+	}()
+	defer close(queue)
+
+	if s.reqq > 0 || s.maxBlock > 0 {
+		handshake := map[string]interface{}{"m": map[string]interface{}{}}
+		if s.reqq > 0 {
+			handshake["reqq"] = s.reqq
+		}
+		if s.maxBlock > 0 {
+			handshake["max_block_size"] = s.maxBlock
+		}
+		bencoded, err := bencode(handshake)
+		if err != nil {
+			s.t.Error(err)
+			return
+		}
+		if err := send(extended, append([]byte{extendedHandshakeID}, bencoded...)); err != nil {
+			return
+		}
+	}
+
+	if err := send(bitfield, bf); err != nil {
+		return
+	}
+
+	for {
+		msg, err := readPeerMessage(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.id {
+		case interested:
+			if err := send(unchoke, nil); err != nil {
+				return
+			}
+		case request:
+			if s.maxBlock > 0 && len(msg.payload) == 12 && int(binary.BigEndian.Uint32(msg.payload[8:12])) > s.maxBlock {
+				atomic.AddInt64(&s.oversized, 1)
+				return
+			}
+			if s.drop != nil && len(msg.payload) == 12 {
+				req := blockRequest{
+					index:  int(binary.BigEndian.Uint32(msg.payload[0:4])),
+					begin:  int(binary.BigEndian.Uint32(msg.payload[4:8])),
+					length: int(binary.BigEndian.Uint32(msg.payload[8:12])),
+				}
+				if req == *s.drop && atomic.CompareAndSwapInt64(&s.dropped, 0, 1) {
+					continue
+				}
+			}
+
+			mu.Lock()
+			outstanding++
+			if outstanding > atomic.LoadInt64(&s.maxOutstanding) {
+				atomic.StoreInt64(&s.maxOutstanding, outstanding)
+			}
+			queued[string(msg.payload)]++
+			mu.Unlock()
+			queue <- msg.payload
+		case cancel:
+			mu.Lock()
+			if queued[string(msg.payload)] > canceled[string(msg.payload)] {
+				canceled[string(msg.payload)]++
+			}
+			mu.Unlock()
+			atomic.AddInt64(&s.cancels, 1)
+		}
+	}
+}
+
+func Test_downloader_download(t *testing.T) {
+	torrent := newTestTorrent(t, 4*32*1024+100, 32*1024)
+	seeder := newTestSeeder(t, torrent)
+
+	got, err := newDownloader(torrent.info, []string{seeder.addr()}).download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, torrent.data) {
+		t.Error("download() content mismatch")
+	}
+}
+
+func Test_downloader_verifiesConcurrently(t *testing.T) {
+	var (
+		torrent   = newTestTorrent(t, 4*32*1024+100, 32*1024)
+		seeder    = newTestSeeder(t, torrent)
+		d         = newDownloader(torrent.info, []string{seeder.addr()})
+		numBlocks = int64(4*32*1024/blockSize + 1)
+		once      sync.Once
+	)
+	d.verifyPiece = func(pw *pieceWork, buf []byte) bool {
+		// Hold the first verification until the network side has served every
+		// block, which can only happen if reads go on while hashing is blocked.
+		once.Do(func() {
+			deadline := time.After(5 * time.Second)
+			for atomic.LoadInt64(&seeder.served) < numBlocks {
+				select {
+				case <-deadline:
+					t.Error("network reads stalled while a piece was being verified")
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+		})
+		return checkPieceHash(pw, buf)
+	}
+
+	got, err := d.download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, torrent.data) {
+		t.Error("download() content mismatch")
+	}
+}
+
+func Test_downloader_requeuesFailedPiece(t *testing.T) {
+	var (
+		torrent  = newTestTorrent(t, 4*32*1024+100, 32*1024)
+		seeder   = newTestSeeder(t, torrent)
+		d        = newDownloader(torrent.info, []string{seeder.addr()})
+		attempts = map[int]int{}
+		mu       sync.Mutex
+	)
+	d.verifyPiece = func(pw *pieceWork, buf []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts[pw.index]++
+		if pw.index == 2 && attempts[pw.index] == 1 {
+			return false
+		}
+		return checkPieceHash(pw, buf)
+	}
+
+	got, err := d.download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, torrent.data) {
+		t.Error("download() content mismatch")
+	}
+	if attempts[2] != 2 {
+		t.Errorf("piece 2 verified %d times, want 2", attempts[2])
+	}
+}
+
+func Test_downloader_cancelsPieceCompletedElsewhere(t *testing.T) {
+	var (
+		torrent = newTestTorrent(t, 2*blockSize, 2*blockSize)
+		slow    = newTestSeeder(t, torrent, withDelay(2*time.Second))
+		fast    = newTestSeeder(t, torrent, withDelay(200*time.Millisecond))
+	)
+
+	got, err := newDownloader(torrent.info, []string{slow.addr(), fast.addr()}).download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, torrent.data) {
+		t.Error("download() content mismatch")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&slow.cancels) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cancels := atomic.LoadInt64(&slow.cancels); cancels != 2 {
+		t.Errorf("slow peer got %d cancels, want 2", cancels)
+	}
+	if cancels := atomic.LoadInt64(&fast.cancels); cancels != 0 {
+		t.Errorf("fast peer got %d cancels, want 0", cancels)
+	}
+}
+
+// Test_peerConn_lateCancel has the cancel for piece 0, which another peer
+// assembled first, arrive only once the peer is downloading piece 1. Piece 1
+// must still complete, and the piece given up on must go back to pending.
+func Test_peerConn_lateCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	pc := newPeerConn("peer", client)
+	pc.choked = false
+	pc.startReading()
+
+	data := bytes.Repeat([]byte("b"), 2*blockSize)
+	go func() {
+		// The cancel takes pc.mu, which the client holds while writing a
+		// request, so it runs aside while the requests are read. Both
+		// blocks are only sent once it is in.
+		var (
+			requests []*peerMessage
+			canceled = make(chan struct{})
+		)
+		for len(requests) < 2 {
+			msg, err := readPeerMessage(server)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.id != request {
+				continue
+			}
+			if len(requests) == 0 {
+				go func() {
+					pc.cancelPiece(0)
+					close(canceled)
+				}()
+			}
+			requests = append(requests, msg)
+		}
+		<-canceled
+
+		for _, msg := range requests {
+			var (
+				index  = binary.BigEndian.Uint32(msg.payload[0:4])
+				begin  = binary.BigEndian.Uint32(msg.payload[4:8])
+				length = binary.BigEndian.Uint32(msg.payload[8:12])
+			)
+			payload := make([]byte, 8, 8+length)
+			binary.BigEndian.PutUint32(payload[0:4], index)
+			binary.BigEndian.PutUint32(payload[4:8], begin)
+			payload = append(payload, data[begin:begin+length]...)
+			if err := sendPeerMessage(server, piece, payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	got, err := pc.downloadPiece(&pieceWork{index: 1, length: len(data)})
+	if err != nil {
+		t.Fatalf("downloadPiece() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloadPiece() content mismatch")
+	}
+
+	// The cancel of piece 0 is still waiting and ends piece 0 once the
+	// peer is back on it.
+	if _, err := pc.downloadPiece(&pieceWork{index: 0, length: len(data)}); err != errPieceCanceled {
+		t.Errorf("downloadPiece() of piece 0 error = %v, want %v", err, errPieceCanceled)
+	}
+
+	s := newScheduler([]*pieceWork{{index: 0}, {index: 1}}, sequentialStrategy{})
+	other := newPeerConn("other", nil)
+	other.bitfield = peerBitfield{0xc0}
+	if pw := s.next(other); pw.index != 0 {
+		t.Fatalf("next() = piece %d, want 0", pw.index)
+	}
+	s.drop(0, other)
+	if pw := s.next(other); pw.index != 0 {
+		t.Errorf("next() after drop = piece %d, want 0 again", pw.index)
+	}
+}
+
+func Test_downloader_respectsReqq(t *testing.T) {
+	tests := []struct {
+		name string
+		reqq int
+		want int64
+	}{
+		{name: "no reqq", reqq: 0, want: defaultBacklog},
+		{name: "low reqq", reqq: 2, want: 2},
+		{name: "reqq above the piece", reqq: 50, want: 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				torrent = newTestTorrent(t, 8*blockSize, 8*blockSize)
+				seeder  = newTestSeeder(t, torrent, withDelay(5*time.Millisecond), withReqq(tt.reqq))
+			)
+
+			got, err := newDownloader(torrent.info, []string{seeder.addr()}).download()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, torrent.data) {
+				t.Error("download() content mismatch")
+			}
+			if max := atomic.LoadInt64(&seeder.maxOutstanding); max != tt.want {
+				t.Errorf("max outstanding requests = %d, want %d", max, tt.want)
+			}
+		})
+	}
+}
+
+func Test_downloader_reannouncesWhenStalled(t *testing.T) {
+	torrent := newTestTorrent(t, 4*32*1024+100, 32*1024)
+	seeder := newTestSeeder(t, torrent)
+
+	// dead refuses connections, silent accepts them but never answers the
+	// handshake, which keeps a connection alive without any progress.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	tests := []struct {
+		name  string
+		peers []string
+	}{
+		{name: "dead peers", peers: []string{dead.Addr().String()}},
+		{name: "stalled peers", peers: []string{silent.Addr().String()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var announces int32
+
+			d := newDownloader(torrent.info, tt.peers)
+			d.stallTimeout = 200 * time.Millisecond
+			d.announce = func() ([]string, error) {
+				atomic.AddInt32(&announces, 1)
+				return append(tt.peers, seeder.addr()), nil
+			}
+
+			start := time.Now()
+			got, err := d.download()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, torrent.data) {
+				t.Error("download() content mismatch")
+			}
+			if atomic.LoadInt32(&announces) == 0 {
+				t.Error("download() never re-announced")
+			}
+			if elapsed := time.Since(start); elapsed >= dialTimeout {
+				t.Errorf("download() took %v, want it to move on before the stalled peer times out", elapsed)
+			}
+		})
+	}
+}
+
+func Test_downloader_givesUpWithoutPeers(t *testing.T) {
+	torrent := newTestTorrent(t, 4*32*1024+100, 32*1024)
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	d := newDownloader(torrent.info, []string{dead.Addr().String()})
+	d.announce = func() ([]string, error) {
+		return []string{dead.Addr().String()}, nil
+	}
+
+	if _, err := d.download(); err == nil {
+		t.Error("download() error = nil, want an error when no peer is usable")
+	}
+}
+
+func Test_downloader_retriesDroppedBlock(t *testing.T) {
+	var (
+		torrent = newTestTorrent(t, 4*32*1024+100, 32*1024)
+		seeder  = newTestSeeder(t, torrent, withDroppedRequest(blockRequest{index: 1, begin: blockSize, length: blockSize}))
+		d       = newDownloader(torrent.info, []string{seeder.addr()})
+	)
+	d.blockTimeout = 100 * time.Millisecond
+
+	got, err := d.download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, torrent.data) {
+		t.Error("download() content mismatch")
+	}
+	if dropped := atomic.LoadInt64(&seeder.dropped); dropped != 1 {
+		t.Errorf("seeder dropped %d requests, want 1", dropped)
+	}
+}
+
+func Test_downloader_blocklistsCorruptPeer(t *testing.T) {
+	var (
+		torrent = newTestTorrent(t, 8*32*1024+100, 32*1024)
+		corrupt = newTestSeeder(t, torrent, withCorruptBlocks())
+		good    = newTestSeeder(t, torrent, withDelay(20*time.Millisecond))
+		d       = newDownloader(torrent.info, []string{corrupt.addr(), good.addr()})
+	)
+	d.maxBadPieces = 2
+
+	got, err := d.download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, torrent.data) {
+		t.Error("download() content mismatch")
+	}
+	if !d.isBlocked(corrupt.addr()) {
+		t.Errorf("corrupt peer was not blocklisted")
+	}
+	if d.isBlocked(good.addr()) {
+		t.Errorf("good peer was blocklisted")
+	}
+}
+
+// recordingFile records the calls made on an output file into ops.
+type recordingFile struct {
+	outputFile
+	ops *[]string
+}
+
+func (f recordingFile) Sync() error {
+	*f.ops = append(*f.ops, "sync")
+	return f.outputFile.Sync()
+}
+
+func (f recordingFile) Close() error {
+	*f.ops = append(*f.ops, "close")
+	return f.outputFile.Close()
+}
+
+func Test_writeFileAtomic(t *testing.T) {
+	defer func(create func(string) (outputFile, error), rename func(string, string) error, sync func(string) error) {
+		createFile, renameFile, syncDir = create, rename, sync
+	}(createFile, renameFile, syncDir)
+
+	tests := []struct {
+		name  string
+		fsync bool
+		want  []string
+	}{
+		{name: "default", want: []string{"create", "close", "rename"}},
+		{name: "fsync", fsync: true, want: []string{"create", "sync", "close", "rename", "sync dir"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				ops      []string
+				path     = filepath.Join(t.TempDir(), "out.bin")
+				osCreate = createFile
+			)
+			createFile = func(name string) (outputFile, error) {
+				ops = append(ops, "create")
+				if name != path+".part" {
+					t.Errorf("created %s, want %s.part", name, path)
+				}
+				f, err := osCreate(name)
+				if err != nil {
+					return nil, err
+				}
+				return recordingFile{outputFile: f, ops: &ops}, nil
+			}
+			renameFile = func(from, to string) error {
+				ops = append(ops, "rename")
+				return os.Rename(from, to)
+			}
+			syncDir = func(dir string) error {
+				ops = append(ops, "sync dir")
+				return nil
+			}
+
+			if err := writeFileAtomic(path, []byte("data"), tt.fsync); err != nil {
+				t.Fatal(err)
+			}
+			createFile = osCreate
+
+			if !reflect.DeepEqual(ops, tt.want) {
+				t.Errorf("operations = %v, want %v", ops, tt.want)
+			}
+			if got, err := os.ReadFile(path); err != nil || string(got) != "data" {
+				t.Errorf("%s holds %q, %v, want \"data\"", path, got, err)
+			}
+			if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+				t.Errorf("%s.part still exists", path)
+			}
+		})
+	}
+}
+
+func Test_writeManifest_sources(t *testing.T) {
+	var (
+		torrent = newTestTorrent(t, 6*32*1024+100, 32*1024)
+		seeders = map[string]*testSeeder{}
+		peers   []string
+	)
+	for i := 0; i < 2; i++ {
+		s := newTestSeeder(t, torrent, withDelay(time.Millisecond))
+		seeders[s.addr()] = s
+		peers = append(peers, s.addr())
+	}
+
+	d := newDownloader(torrent.info, peers)
+	buf, err := d.download()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest strings.Builder
+	if err := writeManifest(&manifest, torrent.info, buf, d.sources); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(manifest.String(), "\n"), "\n")
+	if len(lines) != 7 {
+		t.Fatalf("manifest has %d lines, want 7:\n%s", len(lines), manifest.String())
+	}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			t.Errorf("manifest line %q, want index, hash, peer and duration", line)
+			continue
+		}
+		if fields[0] != strconv.Itoa(i) {
+			t.Errorf("manifest line %d starts with %s", i, fields[0])
+		}
+		if _, err := time.ParseDuration(fields[3]); err != nil {
+			t.Errorf("manifest line %q: bad duration: %v", line, err)
+		}
+
+		seeder, ok := seeders[fields[2]]
+		if !ok {
+			t.Errorf("manifest line %q names an unknown peer", line)
+			continue
+		}
+		seeder.mu.Lock()
+		served := seeder.servedPieces[i]
+		seeder.mu.Unlock()
+		if !served {
+			t.Errorf("manifest credits %s with piece %d, which it never served", fields[2], i)
+		}
+	}
+}
+
+func Test_downloader_respectsPeerMaxBlock(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxBlock  int
+		blockSize int
+		want      int64
+	}{
+		{name: "peer limit below ours", maxBlock: 4096, blockSize: blockSize, want: 2*32*1024/4096 + 1},
+		{name: "peer limit above ours", maxBlock: 64 * 1024, blockSize: blockSize, want: 2*32*1024/blockSize + 1},
+		{name: "larger blocks allowed", maxBlock: 64 * 1024, blockSize: 32 * 1024, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				torrent = newTestTorrent(t, 2*32*1024+100, 32*1024)
+				seeder  = newTestSeeder(t, torrent, withMaxBlock(tt.maxBlock))
+				d       = newDownloader(torrent.info, []string{seeder.addr()})
+			)
+			d.blockSize = tt.blockSize
+
+			got, err := d.download()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, torrent.data) {
+				t.Error("download() content mismatch")
+			}
+			if oversized := atomic.LoadInt64(&seeder.oversized); oversized != 0 {
+				t.Errorf("sent %d requests above the peer's limit", oversized)
+			}
+			if served := atomic.LoadInt64(&seeder.served); served != tt.want {
+				t.Errorf("seeder served %d blocks, want %d", served, tt.want)
+			}
+		})
+	}
+}
+
+// mismatchHash is a SHA-1 that gets the sum wrong for data equal to target
+// while *remaining is positive, decrementing it each time.
+type mismatchHash struct {
+	hash.Hash
+	written   []byte
+	target    []byte
+	mu        *sync.Mutex
+	remaining *int
+}
+
+func (h *mismatchHash) Write(p []byte) (int, error) {
+	h.written = append(h.written, p...)
+	return h.Hash.Write(p)
+}
+
+func (h *mismatchHash) Sum(b []byte) []byte {
+	sum := h.Hash.Sum(b)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if *h.remaining > 0 && bytes.Equal(h.written, h.target) {
+		*h.remaining--
+		sum[len(sum)-1] ^= 0xff
+	}
+
+	return sum
+}
+
+func Test_downloader_injectedHasherMismatch(t *testing.T) {
+	var (
+		torrent   = newTestTorrent(t, 4*32*1024+100, 32*1024)
+		seeder    = newTestSeeder(t, torrent)
+		d         = newDownloader(torrent.info, []string{seeder.addr()})
+		target    = torrent.data[2*32*1024 : 3*32*1024]
+		mu        sync.Mutex
+		remaining = 1
+	)
+	d.newHash = func() hash.Hash {
+		return &mismatchHash{Hash: sha1.New(), target: target, mu: &mu, remaining: &remaining}
+	}
+
+	got, err := d.download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, torrent.data) {
+		t.Error("download() content mismatch")
+	}
+	if remaining != 0 {
+		t.Error("the injected hasher was never used for piece 2")
+	}
+	// Piece 2 has 2 blocks and was downloaded twice; every other piece once.
+	if served, want := atomic.LoadInt64(&seeder.served), int64(4*2+1+2); served != want {
+		t.Errorf("seeder served %d blocks, want %d after piece 2 was retried", served, want)
+	}
+}
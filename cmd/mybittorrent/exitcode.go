@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+)
+
+// Exit codes main reports for a command's result.
+const (
+	exitOK = 0
+	// exitUsage covers bad arguments and anything not categorised below,
+	// such as a torrent file that cannot be read.
+	exitUsage = 1
+	// exitNetwork is for unreachable peers or trackers and unusable answers
+	// from them.
+	exitNetwork = 2
+	// exitVerification is for data or identities that did not match what
+	// was expected, such as a piece hash or a peer id.
+	exitVerification = 3
+)
+
+// exitError assigns an exit code to err.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode marks err, if any, as belonging to the category of code.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCode returns the exit code for the result of a command. Errors that
+// were not marked with withExitCode are categorised by their type.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+
+	// net.Error would be simpler to match but file system errors satisfy
+	// it as well.
+	var (
+		opErr  *net.OpError
+		urlErr *url.Error
+	)
+	if errors.As(err, &opErr) || errors.As(err, &urlErr) || errors.Is(err, errPeerClosed) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return exitNetwork
+	}
+
+	return exitUsage
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func Test_exitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "success", err: nil, want: exitOK},
+		{name: "plain error", err: errors.New("usage: info <torrent>"), want: exitUsage},
+		{name: "marked", err: withExitCode(exitVerification, errors.New("invalid piece hash")), want: exitVerification},
+		{name: "marked and wrapped", err: fmt.Errorf("piece 3: %w", withExitCode(exitNetwork, errors.New("timed out"))), want: exitNetwork},
+		{name: "net error", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: exitNetwork},
+		{name: "EOF", err: io.EOF, want: exitNetwork},
+		{name: "peer closed", err: errPeerClosed, want: exitNetwork},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// extendedHandshakeID is the extended message id of the extension handshake
+// itself; other ids are negotiated in its "m" dictionary.
+const extendedHandshakeID = 0
+
+// extensionHandshake holds the parts of a peer's extension handshake we use.
+type extensionHandshake struct {
+	// reqq is the number of outstanding requests the peer accepts, or 0 if
+	// it did not say.
+	reqq int
+	// maxBlock is the largest block the peer serves, or 0 if it did not
+	// say. It is read from the "max_block_size" key, which is not part of
+	// BEP 10 but costs nothing to honour.
+	maxBlock int
+}
+
+// Example:
+// - "\x00d1:md11:ut_metadatai1ee4:reqqi250ee" -> {reqq: 250}
+// - "\x00d1:mde14:max_block_sizei8192ee" -> {maxBlock: 8192}
+func parseExtensionHandshake(payload []byte) (*extensionHandshake, error) {
+	if len(payload) < 1 || payload[0] != extendedHandshakeID {
+		return nil, errors.New("not an extension handshake")
+	}
+
+	decoded, _, err := decodeBencode(payload[1:])
+	if err != nil {
+		return nil, err
+	}
+	dict, err := LookupDict(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("extension handshake: %w", err)
+	}
+
+	ret := &extensionHandshake{}
+	if reqq, err := LookupInt(dict, "reqq"); err == nil && reqq > 0 && reqq <= math.MaxInt32 {
+		ret.reqq = int(reqq)
+	}
+	if maxBlock, err := LookupInt(dict, "max_block_size"); err == nil && maxBlock > 0 && maxBlock <= math.MaxInt32 {
+		ret.maxBlock = int(maxBlock)
+	}
+
+	return ret, nil
+}
+
+// supportedExtensions maps the extended messages we support to the ids we
+// give them in our extension handshake.
+var supportedExtensions = map[string]int{}
+
+// peerSourceExtensions are the extended messages that find peers other than
+// through the trackers, which a private torrent must not use (BEP 27).
+var peerSourceExtensions = map[string]bool{"ut_pex": true}
+
+// extensionMessages returns the "m" dictionary of our extension handshake:
+// supportedExtensions, less peerSourceExtensions for a private torrent.
+func extensionMessages(info *Info) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for name, id := range supportedExtensions {
+		if info.Private && peerSourceExtensions[name] {
+			continue
+		}
+		ret[name] = id
+	}
+
+	return ret
+}
+
+func sendExtensionHandshake(conn net.Conn, info *Info) error {
+	bencoded, err := bencode(map[string]interface{}{"m": extensionMessages(info)})
+	if err != nil {
+		return err
+	}
+
+	return sendPeerMessage(conn, extended, append([]byte{extendedHandshakeID}, bencoded...))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseExtensionHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    *extensionHandshake
+		wantErr bool
+	}{
+		{name: "with reqq", payload: "\x00d1:md11:ut_metadatai1ee4:reqqi250ee", want: &extensionHandshake{reqq: 250}},
+		{name: "without reqq", payload: "\x00d1:mdee", want: &extensionHandshake{}},
+		{name: "with max block size", payload: "\x00d1:mde14:max_block_sizei8192ee", want: &extensionHandshake{maxBlock: 8192}},
+		{name: "zero max block size", payload: "\x00d1:mde14:max_block_sizei0ee", want: &extensionHandshake{}},
+		{name: "not a handshake", payload: "\x01d1:mdee", wantErr: true},
+		{name: "not a dictionary", payload: "\x00i1e", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExtensionHandshake([]byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseExtensionHandshake() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && *got != *tt.want {
+				t.Errorf("parseExtensionHandshake() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_extensionMessages_private(t *testing.T) {
+	defer func(saved map[string]int) { supportedExtensions = saved }(supportedExtensions)
+	supportedExtensions = map[string]int{"ut_metadata": 1, "ut_pex": 2}
+
+	if got, want := extensionMessages(&Info{}), map[string]interface{}{"ut_metadata": 1, "ut_pex": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("extensionMessages(public) = %v, want %v", got, want)
+	}
+	if got, want := extensionMessages(&Info{Private: true}), map[string]interface{}{"ut_metadata": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("extensionMessages(private) = %v, want %v", got, want)
+	}
+}
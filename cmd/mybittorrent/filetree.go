@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// fileTreeOptions control how writeFileTree lists the files of a torrent.
+type fileTreeOptions struct {
+	// human writes sizes in KiB, MiB and so on instead of bytes.
+	human bool
+	// limit is the most files to list before summing up the rest in a
+	// single line; 0 lists them all.
+	limit       int
+	showPadding bool
+}
+
+// writeFileTree writes the files of a multi-file torrent as a tree under the
+// torrent name, each directory on a line of its own with its contents
+// indented below it, followed by the total size of the files. The files are
+// listed in the order of the torrent, so a directory whose files are not
+// next to each other shows up more than once.
+//
+// Example:
+// - multi/docs/readme.txt -> "multi/", "  docs/", "    readme.txt (3000 bytes)", "Total: 3000 bytes in 1 files"
+func writeFileTree(w io.Writer, info *Info, opts fileTreeOptions) {
+	size := func(n int64) string {
+		if opts.human {
+			return humanSize(n)
+		}
+		return fmt.Sprintf("%d bytes", n)
+	}
+
+	fmt.Fprintf(w, "%s/\n", info.Name)
+
+	var (
+		dir          []string
+		listed, more int
+		count        int
+		total        int64
+	)
+	for _, f := range info.Files {
+		if !f.IsPadding() {
+			count++
+			total += f.Length
+		} else if !opts.showPadding {
+			continue
+		}
+		if opts.limit > 0 && listed == opts.limit {
+			more++
+			continue
+		}
+		listed++
+
+		fileDir := f.Path[:len(f.Path)-1]
+		common := 0
+		for common < len(dir) && common < len(fileDir) && dir[common] == fileDir[common] {
+			common++
+		}
+		for i := common; i < len(fileDir); i++ {
+			fmt.Fprintf(w, "%s%s/\n", strings.Repeat("  ", i+1), fileDir[i])
+		}
+		dir = fileDir
+
+		line := fmt.Sprintf("%s%s (%s", strings.Repeat("  ", len(fileDir)+1), f.Path[len(f.Path)-1], size(f.Length))
+		if f.IsPadding() {
+			line += ", padding"
+		}
+		fmt.Fprintln(w, line+")")
+	}
+
+	if more > 0 {
+		fmt.Fprintf(w, "  ... and %d more files\n", more)
+	}
+	fmt.Fprintf(w, "Total: %s in %d files\n", size(total), count)
+}
+
+// humanSize formats n bytes in the largest binary unit that keeps the number
+// at least 1, with one decimal.
+//
+// Example:
+// - 1000 -> 1000 B
+// - 70000 -> 68.4 KiB
+func humanSize(n int64) string {
+	const units = "KMGTPE"
+
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	size := float64(n) / 1024
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", size, units[i])
+}
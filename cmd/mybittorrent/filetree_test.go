@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_runInfo_fileTree(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		golden string
+	}{
+		{name: "default", args: []string{"testdata/multi.torrent"}, golden: "testdata/multi.info.golden"},
+		{name: "human", args: []string{"testdata/multi.torrent", "--human"}, golden: "testdata/multi.human.golden"},
+		{name: "limit", args: []string{"testdata/multi.torrent", "--limit", "2"}, golden: "testdata/multi.limit.golden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := runInfo(tt.args, &buf); err != nil {
+				t.Fatal(err)
+			}
+
+			if *update {
+				if err := os.WriteFile(tt.golden, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(tt.golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != string(want) {
+				t.Errorf("runInfo() got:\n%s\nwant:\n%s", buf.String(), want)
+			}
+		})
+	}
+
+	if err := runInfo([]string{"testdata/multi.torrent", "--limit", "-1"}, &bytes.Buffer{}); err == nil {
+		t.Error("runInfo() with a negative --limit error = nil")
+	}
+}
+
+func Test_writeFileTree_limit(t *testing.T) {
+	info := &Info{Name: "many"}
+	for i := 0; i < 500; i++ {
+		info.Files = append(info.Files, FileEntry{Length: 1, Path: []string{fmt.Sprintf("dir%d", i/100), fmt.Sprintf("%03d.bin", i)}})
+	}
+
+	var buf bytes.Buffer
+	writeFileTree(&buf, info, fileTreeOptions{limit: 13})
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{"    012.bin (1 bytes)", "  ... and 487 more files", "Total: 500 bytes in 500 files"}
+	if got := lines[len(lines)-3:]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("writeFileTree() ends with %q, want %q", got, want)
+	}
+}
+
+func Test_humanSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{n: 0, want: "0 B"},
+		{n: 1023, want: "1023 B"},
+		{n: 1024, want: "1.0 KiB"},
+		{n: 70000, want: "68.4 KiB"},
+		{n: 5 << 20, want: "5.0 MiB"},
+		{n: 3 << 40, want: "3.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := humanSize(tt.n); got != tt.want {
+			t.Errorf("humanSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// FuzzDecodeBencode checks that decodeBencode never panics, and that whatever
+// it accepts survives being encoded and decoded again.
+//
+// Run it with: go test -fuzz=FuzzDecodeBencode -fuzztime=30s
+func FuzzDecodeBencode(f *testing.F) {
+	for _, seed := range []string{
+		"5:hello",
+		"10:hello12345",
+		"i52e",
+		"i-52e",
+		"l5:helloi52ee",
+		"d3:foo3:bar5:helloi52ee",
+		"lli1eei2ee",
+		"ld2:ipi1eed2:ipi2eee",
+		"l1:e2:eee",
+		"d0:i1ee",
+		"l1:e",
+		"d1:ee",
+		"di1ei2ee",
+		"5:abc",
+		"i12",
+		"i03e",
+		"i-0e",
+		"i9223372036854775808e",
+		"9223372036854775807:a",
+		"",
+	} {
+		f.Add([]byte(seed))
+	}
+	if content, err := os.ReadFile(sampleTorrent); err == nil {
+		f.Add(content)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, consumed, err := decodeBencode(data)
+		if err != nil {
+			return
+		}
+		if consumed <= 0 || consumed > len(data) {
+			t.Fatalf("decodeBencode(%q) consumed = %d of %d bytes", data, consumed, len(data))
+		}
+
+		reencoded, err := bencode(decoded)
+		if err != nil {
+			t.Fatalf("bencode(%v) error = %v", decoded, err)
+		}
+		again, _, err := decodeBencode(reencoded)
+		if err != nil {
+			t.Fatalf("decodeBencode(%q) of re-encoded data error = %v", reencoded, err)
+		}
+		if !reflect.DeepEqual(again, decoded) {
+			t.Fatalf("round trip of %q got = %v, want %v", data, again, decoded)
+		}
+	})
+}
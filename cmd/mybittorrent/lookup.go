@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lookup follows path through nested dictionaries of a decoded value and
+// returns what it leads to. With no path it returns v itself.
+//
+// Example:
+// - Lookup(torrent, "info", "pieces") -> the pieces string
+// - Lookup(torrent, "info", "nope") -> error: missing key "nope" under "info"
+func Lookup(v interface{}, path ...string) (interface{}, error) {
+	for i, key := range path {
+		dict, ok := asDict(v)
+		if !ok {
+			return nil, lookupErrorf(path[:i], "expected dictionary, got %s", bencodeKind(v))
+		}
+
+		v, ok = dict[key]
+		if !ok {
+			if i == 0 {
+				return nil, fmt.Errorf("missing key %q", key)
+			}
+			return nil, fmt.Errorf("missing key %q under %q", key, strings.Join(path[:i], "."))
+		}
+	}
+
+	return v, nil
+}
+
+// LookupString is Lookup for a string value.
+func LookupString(v interface{}, path ...string) (string, error) {
+	b, err := LookupBytes(v, path...)
+	return string(b), err
+}
+
+// LookupBytes is Lookup for a string value that may hold binary data.
+func LookupBytes(v interface{}, path ...string) ([]byte, error) {
+	found, err := Lookup(v, path...)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := found.([]byte)
+	if !ok {
+		return nil, lookupErrorf(path, "expected string, got %s", bencodeKind(found))
+	}
+
+	return b, nil
+}
+
+// LookupInt is Lookup for an integer value.
+func LookupInt(v interface{}, path ...string) (int64, error) {
+	found, err := Lookup(v, path...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := found.(int64)
+	if !ok {
+		return 0, lookupErrorf(path, "expected integer, got %s", bencodeKind(found))
+	}
+
+	return n, nil
+}
+
+// LookupDict is Lookup for a dictionary, which is returned as a plain map
+// even when it was decoded as an *OrderedDict.
+func LookupDict(v interface{}, path ...string) (map[string]interface{}, error) {
+	found, err := Lookup(v, path...)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := asDict(found)
+	if !ok {
+		return nil, lookupErrorf(path, "expected dictionary, got %s", bencodeKind(found))
+	}
+
+	return dict, nil
+}
+
+// LookupList is Lookup for a list value.
+func LookupList(v interface{}, path ...string) ([]interface{}, error) {
+	found, err := Lookup(v, path...)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := found.([]interface{})
+	if !ok {
+		return nil, lookupErrorf(path, "expected list, got %s", bencodeKind(found))
+	}
+
+	return list, nil
+}
+
+func asDict(v interface{}) (map[string]interface{}, bool) {
+	switch d := v.(type) {
+	case map[string]interface{}:
+		return d, true
+	case *OrderedDict:
+		return d.Values, true
+	default:
+		return nil, false
+	}
+}
+
+// lookupErrorf reports a problem with the value at path, naming the path
+// unless it is the value looked up in.
+func lookupErrorf(path []string, format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	if len(path) == 0 {
+		return fmt.Errorf("%s", msg)
+	}
+	return fmt.Errorf("%q: %s", strings.Join(path, "."), msg)
+}
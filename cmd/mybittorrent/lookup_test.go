@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_Lookup(t *testing.T) {
+	torrent := map[string]interface{}{
+		"announce": []byte("http://tracker/announce"),
+		"info": map[string]interface{}{
+			"length":       int64(92063),
+			"piece length": int64(32768),
+			"files":        []interface{}{[]byte("a")},
+		},
+	}
+
+	got, err := Lookup(torrent, "info", "length")
+	if err != nil || got != int64(92063) {
+		t.Errorf("Lookup() = %v, %v, want 92063", got, err)
+	}
+	if got, err := Lookup(torrent); err != nil || !reflect.DeepEqual(got, torrent) {
+		t.Errorf("Lookup() with no path = %v, %v, want the value itself", got, err)
+	}
+	if got, err := LookupString(torrent, "announce"); err != nil || got != "http://tracker/announce" {
+		t.Errorf("LookupString() = %q, %v", got, err)
+	}
+	if got, err := LookupInt(torrent, "info", "piece length"); err != nil || got != 32768 {
+		t.Errorf("LookupInt() = %d, %v", got, err)
+	}
+	if got, err := LookupList(torrent, "info", "files"); err != nil || len(got) != 1 {
+		t.Errorf("LookupList() = %v, %v", got, err)
+	}
+
+	od := newOrderedDict()
+	od.Set("info", torrent["info"])
+	if got, err := LookupDict(od, "info"); err != nil || got["length"] != int64(92063) {
+		t.Errorf("LookupDict() through an *OrderedDict = %v, %v", got, err)
+	}
+}
+
+func Test_Lookup_errors(t *testing.T) {
+	torrent := map[string]interface{}{
+		"announce": []byte("http://tracker/announce"),
+		"info": map[string]interface{}{
+			"length": int64(92063),
+		},
+	}
+
+	tests := []struct {
+		name    string
+		lookup  func() error
+		wantErr string
+	}{
+		{
+			name:    "missing top-level key",
+			lookup:  func() error { _, err := Lookup(torrent, "comment"); return err },
+			wantErr: `missing key "comment"`,
+		},
+		{
+			name:    "missing nested key",
+			lookup:  func() error { _, err := Lookup(torrent, "info", "pieces"); return err },
+			wantErr: `missing key "pieces" under "info"`,
+		},
+		{
+			name:    "path through a string",
+			lookup:  func() error { _, err := Lookup(torrent, "announce", "host"); return err },
+			wantErr: `"announce": expected dictionary, got string`,
+		},
+		{
+			name:    "root is not a dictionary",
+			lookup:  func() error { _, err := Lookup(int64(1), "info"); return err },
+			wantErr: `expected dictionary, got integer`,
+		},
+		{
+			name:    "string is an integer",
+			lookup:  func() error { _, err := LookupString(torrent, "info", "length"); return err },
+			wantErr: `"info.length": expected string, got integer`,
+		},
+		{
+			name:    "integer is a string",
+			lookup:  func() error { _, err := LookupInt(torrent, "announce"); return err },
+			wantErr: `"announce": expected integer, got string`,
+		},
+		{
+			name:    "dictionary is a string",
+			lookup:  func() error { _, err := LookupDict(torrent, "announce"); return err },
+			wantErr: `"announce": expected dictionary, got string`,
+		},
+		{
+			name:    "list is a dictionary",
+			lookup:  func() error { _, err := LookupList(torrent, "info"); return err },
+			wantErr: `"info": expected list, got dictionary`,
+		},
+		{
+			name:    "typed lookup of a missing key",
+			lookup:  func() error { _, err := LookupInt(torrent, "info", "piece length"); return err },
+			wantErr: `missing key "piece length" under "info"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.lookup()
+			if err == nil {
+				t.Fatal("error = nil, want an error")
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("error = %q, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// HashHex returns the info hash as the 40 hex digits trackers and most magnet
+// links use.
+func (info *Info) HashHex() string {
+	return hex.EncodeToString(info.InfoHash[:])
+}
+
+// HashBase32 returns the info hash as the 32 base32 characters of older magnet
+// links.
+func (info *Info) HashBase32() string {
+	return base32.StdEncoding.EncodeToString(info.InfoHash[:])
+}
+
+// ParseInfoHash parses an info hash given in either form, 40 hex digits or 32
+// base32 characters, in upper or lower case.
+//
+// Example:
+// - ParseInfoHash("d69f91e6b2ae4c542468d1073a71d4ea13879a7f") -> the hash
+// - ParseInfoHash("22PZDZVSVZGFIJDI2EDTU4OU5IJYPGT7") -> the same hash
+// - ParseInfoHash("d69f91") -> error: invalid info hash "d69f91": want 40 hex or 32 base32 characters
+func ParseInfoHash(s string) ([sha1.Size]byte, error) {
+	var (
+		hash [sha1.Size]byte
+		b    []byte
+		err  error
+	)
+	switch len(s) {
+	case hex.EncodedLen(sha1.Size):
+		b, err = hex.DecodeString(s)
+	case base32.StdEncoding.EncodedLen(sha1.Size):
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, fmt.Errorf("invalid info hash %q: want 40 hex or 32 base32 characters", s)
+	}
+	if err != nil {
+		return hash, fmt.Errorf("invalid info hash %q: %v", s, err)
+	}
+	copy(hash[:], b)
+
+	return hash, nil
+}
+
+// MagnetLink returns a magnet link for the torrent, naming its info hash in
+// hex, its name and every tracker of AnnounceList. A v2 torrent is named by
+// its SHA-256 info hash as a multihash, "urn:btmh:1220..." (BEP 52), after
+// the v1 one for a hybrid and instead of it for a v2-only torrent.
+func (m *Metainfo) MagnetLink() string {
+	return m.magnetLink(hex.EncodeToString(m.Info.InfoHashV1[:]))
+}
+
+// MagnetLinkBase32 is MagnetLink with the v1 info hash in the base32 form of
+// older magnet links.
+func (m *Metainfo) MagnetLinkBase32() string {
+	return m.magnetLink(base32.StdEncoding.EncodeToString(m.Info.InfoHashV1[:]))
+}
+
+// magnetLink builds a magnet link around btih, the v1 info hash as the link
+// names it. It is the v1 hash even when --protocol v2 makes InfoHash the v2
+// one, since "urn:btih:" only means the former.
+func (m *Metainfo) magnetLink(btih string) string {
+	var b strings.Builder
+	b.WriteString("magnet:?")
+	var xt []string
+	if !m.Info.IsV2Only() {
+		xt = append(xt, "urn:btih:"+btih)
+	}
+	if m.Info.MetaVersion == metaVersionV2 {
+		// 0x12 is SHA-256 and 0x20 its length in bytes.
+		xt = append(xt, "urn:btmh:1220"+hex.EncodeToString(m.Info.InfoHashV2[:]))
+	}
+	for i, urn := range xt {
+		if i > 0 {
+			b.WriteString("&")
+		}
+		b.WriteString("xt=")
+		b.WriteString(urn)
+	}
+	if m.Info.Name != "" {
+		b.WriteString("&dn=")
+		b.WriteString(url.QueryEscape(m.Info.Name))
+	}
+
+	seen := map[string]bool{}
+	for _, tier := range m.AnnounceList {
+		for _, tracker := range tier {
+			if seen[tracker] {
+				continue
+			}
+			seen[tracker] = true
+
+			b.WriteString("&tr=")
+			b.WriteString(url.QueryEscape(tracker))
+		}
+	}
+
+	return b.String()
+}
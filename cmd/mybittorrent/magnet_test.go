@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_Metainfo_MagnetLink(t *testing.T) {
+	m, err := LoadTorrent(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const tr = "&dn=sample.txt&tr=http%3A%2F%2Fbittorrent-test-tracker.codecrafters.io%2Fannounce"
+	if got, want := m.MagnetLink(), "magnet:?xt=urn:btih:d69f91e6b2ae4c542468d1073a71d4ea13879a7f"+tr; got != want {
+		t.Errorf("MagnetLink() = %q, want %q", got, want)
+	}
+	if got, want := m.MagnetLinkBase32(), "magnet:?xt=urn:btih:22PZDZVSVZGFIJDI2EDTU4OU5IJYPGT7"+tr; got != want {
+		t.Errorf("MagnetLinkBase32() = %q, want %q", got, want)
+	}
+
+	var out strings.Builder
+	if err := runMagnet([]string{sampleTorrent, "--base32"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), m.MagnetLinkBase32()+"\n"; got != want {
+		t.Errorf("runMagnet() got = %q, want %q", got, want)
+	}
+}
+
+func Test_Metainfo_MagnetLink_parsesBack(t *testing.T) {
+	info := &Info{
+		Name:       "a name & more/100%.iso",
+		InfoHash:   [20]byte{0xd6, 0x9f, 0x91},
+		InfoHashV1: [20]byte{0xd6, 0x9f, 0x91},
+	}
+	m := &Metainfo{
+		AnnounceList: [][]string{
+			{"http://t1.example/announce?passkey=a&b=c", "udp://t2.example:6969"},
+			{"http://t1.example/announce?passkey=a&b=c", "https://t3.example/announce"},
+		},
+		Info: info,
+	}
+
+	u, err := url.Parse(m.MagnetLink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "magnet" {
+		t.Errorf("scheme = %q, want magnet", u.Scheme)
+	}
+
+	q := u.Query()
+	if got, want := q.Get("xt"), "urn:btih:d69f910000000000000000000000000000000000"; got != want {
+		t.Errorf("xt = %q, want %q", got, want)
+	}
+	if got := q.Get("dn"); got != info.Name {
+		t.Errorf("dn = %q, want %q", got, info.Name)
+	}
+	wantTrackers := []string{"http://t1.example/announce?passkey=a&b=c", "udp://t2.example:6969", "https://t3.example/announce"}
+	if got := q["tr"]; !reflect.DeepEqual(got, wantTrackers) {
+		t.Errorf("tr = %q, want %q", got, wantTrackers)
+	}
+}
+
+func Test_Metainfo_MagnetLink_v2(t *testing.T) {
+	const (
+		v1Hybrid = "dde6d94b164a545622aaa62d580607c18b43b437"
+		v2Hybrid = "a43bfe502b0cead349cc7073aec095e20e83220ee31807b9e5c9829d5832e392"
+		v2Only   = "df327124052ed0d17563b6eb6734bd549d90f71bd736f0479667b5e18b03ad11"
+	)
+
+	tests := []struct {
+		path   string
+		wantXT []string
+	}{
+		{path: "testdata/v2only.torrent", wantXT: []string{"urn:btmh:1220" + v2Only}},
+		{path: "testdata/hybrid.torrent", wantXT: []string{"urn:btih:" + v1Hybrid, "urn:btmh:1220" + v2Hybrid}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			m, err := LoadTorrent(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, err := url.Parse(m.MagnetLink())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.Query()["xt"]; !reflect.DeepEqual(got, tt.wantXT) {
+				t.Errorf("MagnetLink() xt = %q, want %q", got, tt.wantXT)
+			}
+		})
+	}
+}
+
+func Test_Info_HashEncodings(t *testing.T) {
+	const (
+		hexHash    = "d69f91e6b2ae4c542468d1073a71d4ea13879a7f"
+		base32Hash = "22PZDZVSVZGFIJDI2EDTU4OU5IJYPGT7"
+	)
+
+	info, err := parseToInfo(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.HashHex(); got != hexHash {
+		t.Errorf("HashHex() = %q, want %q", got, hexHash)
+	}
+	if got := info.HashBase32(); got != base32Hash {
+		t.Errorf("HashBase32() = %q, want %q", got, base32Hash)
+	}
+
+	for _, s := range []string{hexHash, strings.ToUpper(hexHash), base32Hash, strings.ToLower(base32Hash)} {
+		got, err := ParseInfoHash(s)
+		if err != nil {
+			t.Errorf("ParseInfoHash(%q) error = %v", s, err)
+			continue
+		}
+		if got != info.InfoHash {
+			t.Errorf("ParseInfoHash(%q) = %x, want %x", s, got, info.InfoHash)
+		}
+	}
+	for _, s := range []string{"", "d69f91", hexHash[:39] + "g", base32Hash[:31] + "1"} {
+		if _, err := ParseInfoHash(s); err == nil {
+			t.Errorf("ParseInfoHash(%q) error = nil, want an error", s)
+		}
+	}
+
+	defer func(saved bool) { verbose = saved }(verbose)
+	for _, v := range []bool{false, true} {
+		verbose = v
+		var out strings.Builder
+		if err := runInfo([]string{sampleTorrent}, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "Info Hash: "+hexHash+"\n") {
+			t.Errorf("verbose=%v: runInfo() got = %q, want the hex info hash", v, out.String())
+		}
+		if got := strings.Contains(out.String(), "Info Hash (base32): "+base32Hash+"\n"); got != v {
+			t.Errorf("verbose=%v: runInfo() got = %q, base32 info hash shown = %v", v, out.String(), got)
+		}
+	}
+}
@@ -1,24 +1,65 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"unicode"
+	"time"
+	"unicode/utf8"
 	// bencode "github.com/jackpal/bencode-go" // Available if you need it!
 )
 
+// errIntegerOutOfRange is returned for well-formed integers that do not fit
+// in an int, as opposed to integers that are malformed.
+var errIntegerOutOfRange = errors.New("integer out of range")
+
+// SyntaxError describes malformed bencode. Offset is the position in the
+// input, counted in bytes from the start of the outermost value, where
+// decoding went wrong.
+type SyntaxError struct {
+	Offset int
+	Msg    string
+	// Err is the underlying cause, if any, such as errIntegerOutOfRange.
+	Err error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at byte %d: %s", e.Offset, e.Msg)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+func syntaxErrorf(offset int, format string, a ...interface{}) error {
+	return &SyntaxError{Offset: offset, Msg: fmt.Sprintf(format, a...)}
+}
+
+// decodeBencode decodes the bencoded value at the start of data and returns
+// it together with the number of bytes it took up. Strings are returned as
+// []byte slices of data, so binary values like piece hashes survive as they
+// are, and integers as int64, so lengths past 2 GiB fit on 32-bit builds
+// too. Malformed input, including integers that are not in canonical form,
+// is reported as a *SyntaxError.
+//
 // Example:
 // - 5:hello -> hello
 // - 10:hello12345 -> hello12345
@@ -27,545 +68,2864 @@ import (
 // - l5:helloi52ee -> [“hello”,52]
 // - d3:foo3:bar5:helloi52ee -> {"hello": 52, "foo": "bar"}
 // - d3:foo10:strawberry5:helloi52ee -> {"foo": "strawberry", "hello": 52}
-func decodeBencode(bencodedString string) (interface{}, int, error) {
-	if unicode.IsDigit(rune(bencodedString[0])) {
-		// string case
-		var firstColonIndex int
-
-		for i := 0; i < len(bencodedString); i++ {
-			if bencodedString[i] == ':' {
-				firstColonIndex = i
-				break
-			}
-		}
-
-		lengthStr := bencodedString[:firstColonIndex]
-
-		length, err := strconv.Atoi(lengthStr)
-		if err != nil {
-			return "", 0, err
-		}
-
-		untilIndex := firstColonIndex + 1 + length
-		return bencodedString[firstColonIndex+1 : untilIndex], untilIndex, nil
-	} else if strings.HasPrefix(bencodedString, "i") {
-		// integers case
-		var endIndex int
-
-		for i := 0; i < len(bencodedString); i++ {
-			if bencodedString[i] == 'e' {
-				endIndex = i
-				break
-			}
-		}
-
-		num, err := strconv.Atoi(bencodedString[1:endIndex])
-		if err != nil {
-			return "", 0, err
-		}
+func decodeBencode(data []byte) (interface{}, int, error) {
+	return decodeBencodeWith(data, decodeOptions{})
+}
 
-		return num, endIndex + 1, nil
-	} else if strings.HasPrefix(bencodedString, "l") {
-		// list case
-		in := strings.TrimPrefix(bencodedString, "l")
+// defaultMaxDepth is how deeply lists and dictionaries may nest by default.
+// Real torrents and tracker responses stay within a handful of levels.
+const defaultMaxDepth = 100
+
+// defaultMaxStringLength is the longest string accepted by default. The
+// pieces string of even a huge torrent is a few megabytes.
+const defaultMaxStringLength = 1 << 30
+
+// ErrMaxDepth is returned for input nested more deeply than allowed, which
+// would otherwise let crafted input exhaust the stack.
+var ErrMaxDepth = errors.New("bencode: maximum nesting depth exceeded")
+
+// decodeOptions changes what decodeBencodeWith accepts.
+type decodeOptions struct {
+	// lenientIntegers accepts integers with leading zeros and -0, which the
+	// spec forbids.
+	lenientIntegers bool
+	// maxDepth limits how deeply lists and dictionaries nest; zero means
+	// defaultMaxDepth.
+	maxDepth int
+	// maxStringLength limits the declared length of strings; zero means
+	// defaultMaxStringLength.
+	maxStringLength int
+	// rejectDuplicateKeys fails on a key that repeats within a dictionary,
+	// which otherwise overwrites the earlier value.
+	rejectDuplicateKeys bool
+	// warnf, when set, is told about keys that are not in sorted order. The
+	// spec requires it, but real torrents sometimes get it wrong.
+	warnf func(format string, a ...interface{})
+	// orderedDicts returns dictionaries as *OrderedDict rather than
+	// map[string]interface{}, keeping the order of their keys.
+	orderedDicts bool
+	// anyKeys returns dictionaries as map[interface{}]interface{} and lets
+	// their keys be integers as well as strings, which some DHT
+	// implementations send. String keys become string and integer keys
+	// int64; lists and dictionaries still cannot be keys. It takes
+	// precedence over orderedDicts.
+	anyKeys bool
+}
 
-		var (
-			ret        = []interface{}{}
-			untilIndex int
-		)
-		for {
-			if in[0] == 'e' {
-				break
-			}
+func decodeBencodeWith(data []byte, opts decodeOptions) (interface{}, int, error) {
+	return decodeValue(data, 0, opts, 0)
+}
 
-			decoded, nextIndex, err := decodeBencode(in)
-			if err != nil {
-				return "", 0, err
-			}
-			ret = append(ret, decoded)
+func (o decodeOptions) depthLimit() int {
+	if o.maxDepth == 0 {
+		return defaultMaxDepth
+	}
+	return o.maxDepth
+}
 
-			in = in[nextIndex:]
-			untilIndex += nextIndex
-		}
+func (o decodeOptions) stringLimit() int {
+	if o.maxStringLength == 0 {
+		return defaultMaxStringLength
+	}
+	return o.maxStringLength
+}
 
-		return ret, untilIndex + 1, nil
-	} else if strings.HasPrefix(bencodedString, "d") {
-		// dictionary case
-		in := strings.TrimPrefix(bencodedString, "d")
+// DecodeStrict decodes data, which must hold exactly one bencoded value;
+// anything after it is an error.
+func DecodeStrict(data []byte) (interface{}, error) {
+	return decodeStrictWith(data, decodeOptions{})
+}
 
-		var (
-			ret        = map[string]interface{}{}
-			key        string
-			untilIndex int
-		)
-		for {
-			if in[0] == 'e' {
-				break
-			}
+// DecodeFirst decodes the bencoded value at the start of data and returns
+// whatever follows it as rest, for input where more than one value, or
+// something else entirely, comes after the first.
+func DecodeFirst(data []byte) (val interface{}, rest []byte, err error) {
+	val, consumed, err := decodeBencode(data)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			decoded, nextIndex, err := decodeBencode(in)
-			if err != nil {
-				return "", 0, err
-			}
-			if key == "" {
-				key = decoded.(string)
-			} else {
-				ret[key] = decoded
-				key = ""
-			}
+	return val, data[consumed:], nil
+}
 
-			in = in[nextIndex:]
-			untilIndex += nextIndex
+// DecodeAll decodes data as a sequence of bencoded values written one after
+// another, such as "i1ei2e". Anything in data that does not decode is an
+// error, with its offset into data as a whole.
+func DecodeAll(data []byte) ([]interface{}, error) {
+	ret := []interface{}{}
+	for pos := 0; pos < len(data); {
+		val, next, err := decodeValue(data, pos, decodeOptions{}, 0)
+		if err != nil {
+			return nil, err
 		}
-
-		return ret, untilIndex + 1, nil
-	} else {
-		return "", 0, fmt.Errorf("unexpected format")
+		ret = append(ret, val)
+		pos = next
 	}
+
+	return ret, nil
 }
 
-func decodeTorrentFile(filepath string) (map[string]interface{}, error) {
-	f, err := os.Open(filepath)
+func decodeStrictWith(data []byte, opts decodeOptions) (interface{}, error) {
+	decoded, consumed, err := decodeBencodeWith(data, opts)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	if consumed != len(data) {
+		return nil, fmt.Errorf("trailing data at offset %d", consumed)
+	}
 
-	content, err := io.ReadAll(f)
+	return decoded, nil
+}
+
+// canonicalContext is how many bytes VerifyCanonical shows on either side of
+// the first difference.
+const canonicalContext = 8
+
+// VerifyCanonical checks that re-encoding data after decoding it gives the
+// same bytes, which is what keeps an info hash stable. Integers with leading
+// zeros are decoded so they can be reported like any other difference. The
+// error names the first byte where the two differ, with the bytes around it
+// in hex, and the first keys found out of order, if any.
+func VerifyCanonical(data []byte) error {
+	decoded, err := decodeStrictWith(data, decodeOptions{lenientIntegers: true, orderedDicts: true})
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	decoded, _, err := decodeBencode(string(content))
+	reencoded, err := bencode(decoded)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if bytes.Equal(data, reencoded) {
+		return nil
+	}
+
+	offset := 0
+	for offset < len(data) && offset < len(reencoded) && data[offset] == reencoded[offset] {
+		offset++
+	}
+	window := func(b []byte) string {
+		start, end := offset-canonicalContext, offset+canonicalContext
+		if start < 0 {
+			start = 0
+		}
+		if end > len(b) {
+			end = len(b)
+		}
+		return fmt.Sprintf("%x|%x", b[start:offset], b[offset:end])
+	}
+
+	report := fmt.Sprintf("not canonical: first difference at byte %d\n  input:      %s\n  re-encoded: %s", offset, window(data), window(reencoded))
+	if before, after, ok := firstUnsortedKeys(decoded); ok {
+		report += fmt.Sprintf("\n  dictionary key %q comes after %q", after, before)
 	}
 
-	return decoded.(map[string]interface{}), nil
+	return errors.New(report)
 }
 
-func bencode(i interface{}) (string, error) {
-	switch i.(type) {
-	case string:
-		str := i.(string)
-		return fmt.Sprintf("%d:%s", len(str), str), nil
-	case int:
-		num := i.(int)
-		return fmt.Sprintf("i%de", num), nil
-	case []interface{}:
-		joined := ""
-		for _, item := range i.([]interface{}) {
-			bencoded, err := bencode(item)
+// decodeValue decodes the value starting at data[pos], which is depth lists
+// or dictionaries deep, and returns the index just past it. It walks data by
+// index rather than re-slicing it, so errors carry offsets into data as a
+// whole.
+func decodeValue(data []byte, pos int, opts decodeOptions, depth int) (interface{}, int, error) {
+	if pos == len(data) {
+		return nil, 0, syntaxErrorf(pos, "unexpected end of input")
+	}
+	if (data[pos] == 'l' || data[pos] == 'd') && depth == opts.depthLimit() {
+		return nil, 0, &SyntaxError{Offset: pos, Msg: ErrMaxDepth.Error(), Err: ErrMaxDepth}
+	}
+
+	switch c := data[pos]; {
+	case isDigit(c):
+		return scanString(data, pos, opts.stringLimit())
+	case c == 'i':
+		return scanInt(data, pos, opts.lenientIntegers)
+	case c == 'l':
+		ret := []interface{}{}
+		// pos always points where an element or the terminator starts, since
+		// it only ever moves past what the recursive call consumed. An "e"
+		// that is part of an element, like the string in "l1:ee", is never
+		// looked at here.
+		for pos++; ; {
+			if pos == len(data) {
+				return nil, 0, syntaxErrorf(pos, "unterminated list")
+			}
+			if data[pos] == 'e' {
+				return ret, pos + 1, nil
+			}
+
+			decoded, next, err := decodeValue(data, pos, opts, depth+1)
 			if err != nil {
-				return "", err
+				return nil, 0, err
 			}
-			joined += bencoded
+			ret = append(ret, decoded)
+			pos = next
 		}
-		return fmt.Sprintf("l%se", joined), nil
-	case map[string]interface{}:
+	case c == 'd' && opts.anyKeys:
+		return decodeAnyKeyDict(data, pos, opts, depth)
+	case c == 'd':
 		var (
-			m    = i.(map[string]interface{})
-			keys = make([]string, 0, len(m))
+			ret     = newOrderedDict()
+			prevKey string
 		)
-		for key := range m {
-			keys = append(keys, key)
-		}
-		sort.Strings(keys)
+		// As for lists, pos only ever points at a key or the terminator
+		// here.
+		for pos++; ; {
+			if pos == len(data) {
+				return nil, 0, syntaxErrorf(pos, "unterminated dictionary")
+			}
+			if data[pos] == 'e' {
+				if opts.orderedDicts {
+					return ret, pos + 1, nil
+				}
+				return ret.Values, pos + 1, nil
+			}
 
-		joined := ""
-		for _, key := range keys {
-			bencodedKey, err := bencode(key)
+			decoded, next, err := decodeValue(data, pos, opts, depth+1)
 			if err != nil {
-				return "", err
+				return nil, 0, err
+			}
+			key, ok := decoded.([]byte)
+			if !ok {
+				return nil, 0, syntaxErrorf(pos, "dictionary key is %s, not a string", withArticle(bencodeKind(decoded)))
 			}
-			bencodedValue, err := bencode(m[key])
+			if _, dup := ret.Get(string(key)); dup {
+				if opts.rejectDuplicateKeys {
+					return nil, 0, syntaxErrorf(pos, "duplicate dictionary key %q", key)
+				}
+			} else if len(ret.Keys) > 0 && string(key) < prevKey && opts.warnf != nil {
+				opts.warnf("dictionary key %q at byte %d is out of order", key, pos)
+			}
+			prevKey = string(key)
+
+			if next == len(data) || data[next] == 'e' {
+				return nil, 0, syntaxErrorf(next, "key %q has no value", key)
+			}
+			value, next, err := decodeValue(data, next, opts, depth+1)
 			if err != nil {
-				return "", err
+				return nil, 0, err
 			}
-			joined = joined + bencodedKey + bencodedValue
+			ret.Set(prevKey, value)
+			pos = next
 		}
-		return fmt.Sprintf("d%se", joined), nil
+	default:
+		return nil, 0, syntaxErrorf(pos, "unexpected %q", c)
 	}
-
-	return "", errors.New("unexpected type")
 }
 
-type Info struct {
-	TrackerURL  string
-	Length      int
-	InfoHash    [sha1.Size]byte
-	PieceLength int
-	PieceHashes string
-}
+// decodeAnyKeyDict decodes the dictionary starting at data[pos] for the
+// anyKeys option. Key order is not checked.
+func decodeAnyKeyDict(data []byte, pos int, opts decodeOptions, depth int) (interface{}, int, error) {
+	ret := map[interface{}]interface{}{}
+	for pos++; ; {
+		if pos == len(data) {
+			return nil, 0, syntaxErrorf(pos, "unterminated dictionary")
+		}
+		if data[pos] == 'e' {
+			return ret, pos + 1, nil
+		}
 
-const eachPieceSize = 20
+		decoded, next, err := decodeValue(data, pos, opts, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var key interface{}
+		switch k := decoded.(type) {
+		case []byte:
+			key = string(k)
+		case int64:
+			key = k
+		default:
+			return nil, 0, syntaxErrorf(pos, "dictionary key is %s, not a string or integer", withArticle(bencodeKind(decoded)))
+		}
+		if _, dup := ret[key]; dup && opts.rejectDuplicateKeys {
+			return nil, 0, syntaxErrorf(pos, "duplicate dictionary key %q", fmt.Sprint(key))
+		}
 
-func parseToInfo(torrentFilepath string) (*Info, error) {
-	decoded, err := decodeTorrentFile(torrentFilepath)
-	if err != nil {
-		return nil, err
+		if next == len(data) || data[next] == 'e' {
+			return nil, 0, syntaxErrorf(next, "key %q has no value", fmt.Sprint(key))
+		}
+		value, next, err := decodeValue(data, next, opts, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		ret[key] = value
+		pos = next
 	}
+}
 
-	metaInfo := decoded["info"].(map[string]interface{})
-
-	info := &Info{
-		TrackerURL:  decoded["announce"].(string),
-		Length:      metaInfo["length"].(int),
-		PieceLength: metaInfo["piece length"].(int),
+// scanString reads the string starting at data[pos] and returns its
+// contents and the index just past it.
+//
+// Lengths above maxLength are rejected even when that much input is left, so
+// callers that copy strings cannot be made to allocate absurd amounts.
+func scanString(data []byte, pos int, maxLength int) ([]byte, int, error) {
+	colon := pos
+	for colon < len(data) && isDigit(data[colon]) {
+		colon++
+	}
+	if colon == len(data) || data[colon] != ':' {
+		return nil, 0, syntaxErrorf(colon, "expected ':'")
 	}
 
-	bencoded, err := bencode(metaInfo)
+	length, err := stringLength(data[pos:colon], pos, maxLength)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	info.InfoHash = sha1.Sum([]byte(bencoded))
-
-	pieceStr := metaInfo["pieces"].(string)
-	for i := 0; i < len(pieceStr); i += eachPieceSize {
-		info.PieceHashes += fmt.Sprintf("%x\n", pieceStr[i:i+eachPieceSize])
+	// Compare against what is left rather than computing the end index
+	// first, which could overflow for huge lengths.
+	if length > len(data)-colon-1 {
+		return nil, 0, syntaxErrorf(len(data), "string of length %d runs past the end of input", length)
 	}
-
-	return info, nil
+	end := colon + 1 + length
+	return data[colon+1 : end], end, nil
 }
 
-func requestToTracker(torrentFilepath string) (*http.Response, error) {
-	info, err := parseToInfo(torrentFilepath)
-	if err != nil {
-		return nil, err
+// stringLength parses the length digits of the string starting at pos,
+// rejecting lengths above maxLength.
+func stringLength(digits []byte, pos int, maxLength int) (int, error) {
+	length, err := strconv.Atoi(string(digits))
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, syntaxErrorf(pos, "string length %s is out of range", digits)
 	}
-
-	u, err := url.Parse(info.TrackerURL)
 	if err != nil {
-		return nil, err
+		return 0, syntaxErrorf(pos, "invalid string length %q", digits)
+	}
+	if length > maxLength {
+		return 0, syntaxErrorf(pos, "string length %d exceeds the limit of %d", length, maxLength)
 	}
 
-	q := u.Query()
-	q.Add("info_hash", string(info.InfoHash[:]))
-	q.Add("peer_id", "00112233445566778899")
-	q.Add("port", "6881")
-	q.Add("uploaded", "0")
-	q.Add("downloaded", "0")
-	q.Add("left", fmt.Sprint(info.Length))
-	q.Add("compact", "1")
+	return length, nil
+}
 
-	u.RawQuery = q.Encode()
+// scanInt reads the integer starting at data[pos] and returns it and the
+// index just past it.
+func scanInt(data []byte, pos int, lenient bool) (int64, int, error) {
+	end := bytes.IndexByte(data[pos:], 'e')
+	if end < 0 {
+		return 0, 0, syntaxErrorf(len(data), "unterminated integer")
+	}
+	end += pos
 
-	to := u.String()
+	num, err := parseBencodeInt(string(data[pos+1:end]), lenient)
+	if err != nil {
+		return 0, 0, &SyntaxError{Offset: pos + 1, Msg: err.Error(), Err: err}
+	}
 
-	return http.Get(to)
+	return num, end + 1, nil
 }
 
-func getPeers(torrentFilepath string) ([]string, error) {
-	res, err := requestToTracker(torrentFilepath)
-	if err != nil {
-		return nil, err
+// parseBencodeInt parses the digits of a bencoded integer. Unless lenient is
+// set, only the canonical form is accepted: no leading zeros and no -0, since
+// re-encoding anything else would change the bytes, and with them the info
+// hash.
+func parseBencodeInt(digits string, lenient bool) (int64, error) {
+	num, err := strconv.ParseInt(digits, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("%w: %s", errIntegerOutOfRange, digits)
+	}
+	if err != nil || strings.HasPrefix(digits, "+") {
+		return 0, fmt.Errorf("invalid integer %q", digits)
+	}
+	if lenient {
+		return num, nil
 	}
-	defer res.Body.Close()
 
-	b, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+	if digits == "-0" {
+		return 0, errors.New("invalid integer \"-0\": negative zero")
 	}
-	decoded, _, err := decodeBencode(string(b))
-	if err != nil {
-		return nil, err
+	if unsigned := strings.TrimPrefix(digits, "-"); len(unsigned) > 1 && unsigned[0] == '0' {
+		return 0, fmt.Errorf("invalid integer %q: leading zero", digits)
 	}
 
-	const eachPeerSize = 6
+	return num, nil
+}
 
-	resPeer := decoded.(map[string]interface{})["peers"].(string)
-	if resPeer == "" {
-		return nil, errors.New("unexpected peers string")
+// withArticle prefixes word with "a" or "an".
+func withArticle(word string) string {
+	if strings.ContainsRune("aeiou", rune(word[0])) {
+		return "an " + word
 	}
+	return "a " + word
+}
 
-	ret := make([]string, 0, len(resPeer)/eachPeerSize)
-	for i := 0; i < len(resPeer); i += eachPeerSize {
-		ip := net.IP(resPeer[i : i+4])
-		port := binary.BigEndian.Uint16([]byte(resPeer[i+4 : i+6]))
-		ret = append(ret, fmt.Sprintf("%s:%d", ip, port))
-	}
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
 
-	return ret, nil
+// torrentOptions controls how strictly a torrent file is checked.
+type torrentOptions struct {
+	// strict turns what is otherwise tolerated with a warning into an
+	// error: keys out of sorted order, integers with leading zeros or -0,
+	// and whitespace after the torrent.
+	strict bool
 }
 
-func handshake(conn net.Conn, torrentFilepath string) ([]byte, error) {
-	info, err := parseToInfo(torrentFilepath)
-	if err != nil {
-		return nil, err
-	}
+// strictTorrents is set by the global --strict flag.
+var strictTorrents bool
 
-	const (
-		protocolStrLengthStr = string(byte(19))
-		protocolStr          = "BitTorrent protocol"
-		reservedBytesStr     = "00000000"
-		peerID               = "00112233445566778899"
-	)
-	infoHash := string(info.InfoHash[:])
+// protocolV2 is set by the global --protocol v2 flag.
+var protocolV2 bool
 
-	handshake := protocolStrLengthStr + protocolStr + reservedBytesStr + infoHash + peerID
-	_, err = conn.Write([]byte(handshake))
+// decodeTorrent decodes torrent content, strictly if --strict was given; see
+// decodeTorrentReader.
+func decodeTorrent(content []byte) (map[string]interface{}, []string, error) {
+	return decodeTorrentReader(bytes.NewReader(content), torrentOptions{strict: strictTorrents})
+}
+
+// decodeTorrentReader decodes a torrent, which must be a single dictionary
+// with nothing but whitespace after it; appended bytes may be a sign of
+// tampering, as are repeated keys, which could show one value to hashers
+// and another to parsers. A leading UTF-8 BOM is skipped. Unless
+// opts.strict is set, the spec violations real-world torrents are known for
+// are only returned as warnings.
+//
+// Leniency never changes the info hash, which is taken over the raw bytes
+// of the info dictionary; see rawInfoDict.
+func decodeTorrentReader(r io.Reader, opts torrentOptions) (map[string]interface{}, []string, error) {
+	br := bufio.NewReader(r)
+	dec := NewDecoder(br)
+	// Errors still count the BOM, so their offsets are into the file.
+	if bom, err := br.Peek(len(utf8BOM)); err == nil && string(bom) == utf8BOM {
+		br.Discard(len(utf8BOM))
+		dec.offset = len(utf8BOM)
+	}
+	dec.DisallowDuplicateKeys = true
+	dec.DisallowUnsortedKeys = opts.strict
+	dec.LenientIntegers = !opts.strict
+	decoded, err := dec.Decode()
 	if err != nil {
-		return nil, err
+		// A truncated file is not a network error, even though it ends in
+		// io.ErrUnexpectedEOF like a dropped connection does.
+		return nil, nil, withExitCode(exitUsage, err)
 	}
 
-	buf := make([]byte, len(handshake))
-	_, err = conn.Read(buf)
+	trailing, err := io.ReadAll(dec.r)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if len(trailing) > 0 {
+		if opts.strict || len(bytes.TrimSpace(trailing)) > 0 {
+			return nil, nil, fmt.Errorf("torrent has %d bytes of trailing data", len(trailing))
+		}
+		dec.Warnings = append(dec.Warnings, fmt.Sprintf("ignoring %d bytes of whitespace after the torrent", len(trailing)))
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.New("torrent is not a dictionary")
 	}
 
-	return buf[len(handshake)-len(peerID):], nil
+	return dict, dec.Warnings, nil
 }
 
-const (
-	choke            = 0
-	unchoke          = 1
-	interested       = 2
-	notInterestedNot = 3
-	have             = 4
-	bitfield         = 5
-	request          = 6
-	piece            = 7
-	cancel           = 8
-)
+// utf8BOM is sometimes prepended by editors that re-save a torrent file.
+const utf8BOM = "\xef\xbb\xbf"
 
-const (
-	messageLengthLen = 4
-	messageIDLen     = 1
-)
+func trimBOM(content []byte) []byte {
+	return bytes.TrimPrefix(content, []byte(utf8BOM))
+}
 
-func waitPeerMessage(conn net.Conn, expid byte) ([]byte, error) {
-	for {
-		messageLengthBuf := make([]byte, messageLengthLen)
-		_, err := conn.Read(messageLengthBuf)
-		if err != nil {
-			return nil, err
-		}
+// rawInfoDict returns the bencoded "info" value exactly as it appears in the
+// torrent content, without decoding the rest of the metainfo into maps.
+func rawInfoDict(content []byte) ([]byte, error) {
+	s := NewScanner(content)
+	// The content has been decoded already, strictly if need be.
+	s.LenientIntegers = true
+	tok, err := s.Next()
+	if err != nil {
+		return nil, err
+	}
+	if tok.Kind != DictStart {
+		return nil, errors.New("torrent is not a dictionary")
+	}
 
-		messageIDBuf := make([]byte, messageIDLen)
-		_, err = conn.Read(messageIDBuf)
+	for {
+		key, err := s.Next()
 		if err != nil {
 			return nil, err
 		}
-
-		var (
-			messageID     uint8
-			messageLength = binary.BigEndian.Uint32(messageLengthBuf)
-			payloadBuf    = make([]byte, messageLength-messageIDLen)
-		)
-		err = binary.Read(bytes.NewReader(messageIDBuf), binary.BigEndian, &messageID)
-		if err != nil {
-			return nil, err
+		if key.Kind == End {
+			return nil, errors.New("torrent has no info dictionary")
 		}
 
-		_, err = conn.Read(payloadBuf)
+		value, err := s.Skip()
 		if err != nil {
 			return nil, err
 		}
-
-		if messageID == expid {
-			return payloadBuf, nil
+		if string(key.Bytes) == "info" {
+			return value, nil
 		}
 	}
 }
 
-func sendPeerMessage(conn net.Conn, id byte, payload []byte) error {
-	buf := make([]byte, messageLengthLen+messageIDLen+len(payload))
-
-	// message length
-	binary.BigEndian.PutUint32(buf[:messageLengthLen], uint32(messageIDLen+len(payload)))
-
-	// message id
-	buf[messageLengthLen] = id
+// infoHashOfFile computes the info hash of a torrent file from its raw info
+// dictionary bytes, the same one LoadTorrent puts in InfoHash.
+func infoHashOfFile(filepath string) ([sha1.Size]byte, error) {
+	content, err := readTorrent(filepath)
+	if err != nil {
+		return [sha1.Size]byte{}, err
+	}
 
-	// payload
-	copy(buf[messageLengthLen+messageIDLen:], payload)
+	decoded, _, err := decodeTorrent(content)
+	if err != nil {
+		return [sha1.Size]byte{}, err
+	}
+	metaVersion, v2Only := torrentMetaVersion(decoded)
 
-	_, err := conn.Write(buf)
+	rawInfo, err := rawInfoDict(trimBOM(content))
 	if err != nil {
-		return err
+		return [sha1.Size]byte{}, err
 	}
 
-	return nil
+	return infoHashFor(rawInfo, metaVersion, v2Only), nil
 }
 
-func main() {
-	command := os.Args[1]
+// bencode encodes strings, []byte, integers of any width, []interface{} and
+// map[string]interface{} holding those; dictionary keys are sorted. Booleans
+// and floats have no bencoding and are rejected. See Marshal for the other
+// types it accepts.
+func bencode(i interface{}) ([]byte, error) {
+	return Marshal(i)
+}
 
-	switch command {
-	case "decode":
-		bencodedValue := os.Args[2]
+// Info is the content of a torrent as its info dictionary describes it.
+// Where to announce it and what the torrent says about itself, such as its
+// comment, are in the Metainfo around it.
+type Info struct {
+	Name string
+	// Length is the length of the whole content: of the single file, or of
+	// all of Files together.
+	Length int64
+	// Files lists the files of a multi-file torrent, in the order their
+	// data follows one another in the pieces. It is nil for a single-file
+	// torrent, whose file is called Name.
+	Files    []FileEntry
+	InfoHash [sha1.Size]byte
+	// MetaVersion is 2 for torrents that follow BEP 52, whether v2-only or
+	// hybrid, and 1 otherwise. InfoHashV2 is only set for version 2; for a
+	// v2-only torrent InfoHash is its first 20 bytes, which is what stands
+	// for the torrent where 20 bytes are expected, such as in the handshake.
+	MetaVersion int
+	InfoHashV2  [sha256.Size]byte
+	// InfoHashV1 is the SHA-1 info hash of torrents with v1 metadata. It
+	// is InfoHash unless a hybrid torrent is used by its v2 hash, which
+	// the global --protocol v2 flag asks for.
+	InfoHashV1 [sha1.Size]byte
+	// PiecesRoot is the merkle root of the file of a single-file v2
+	// torrent. The files of a multi-file one each have their own.
+	PiecesRoot []byte
+	// RawInfo is the info dictionary exactly as it appears in the torrent
+	// file. InfoHash is taken over it, since re-encoding a dictionary that
+	// was not canonical to begin with would give different bytes.
+	RawInfo     []byte
+	PieceLength int
+	// PieceHashes holds the SHA-1 hash of each piece, split out of Pieces.
+	PieceHashes [][sha1.Size]byte
+	Pieces      []byte
+	// WebSeeds are HTTP mirrors of the content (BEP 19). For a single-file
+	// torrent each is the URL of the file itself; for a multi-file one it
+	// is the URL of the directory holding Name, ending in '/'.
+	WebSeeds []string
+	// HTTPSeeds are seeds of the older "httpseeds" kind (BEP 17), which are
+	// asked for pieces by query parameters rather than for byte ranges of
+	// files. A URL that is also in WebSeeds is only listed there.
+	HTTPSeeds []string
+	// Nodes are DHT nodes to bootstrap from (BEP 5), as host:port, which
+	// trackerless torrents carry instead of an announce URL.
+	Nodes []string
+	// Private is set for torrents whose peers must come from their trackers
+	// alone (BEP 27), so DHT and peer exchange stay off for them.
+	Private bool
+	// Source names the site a private torrent was made for. It is in the
+	// info dictionary, so the same content gets a distinct info hash on
+	// each site, which keeps their swarms apart when it is cross-seeded.
+	Source   string
+	Warnings []string
+}
 
-		decoded, _, err := decodeBencode(bencodedValue)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+const eachPieceSize = 20
 
-		jsonOutput, _ := json.Marshal(decoded)
-		fmt.Println(string(jsonOutput))
-	case "info":
-		torrentFilepath := os.Args[2]
+// TorrentFile is the metainfo of a torrent.
+type TorrentFile struct {
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	Encoding     string     `bencode:"encoding,omitempty"`
+	// URLList is one web seed URL or a list of them (BEP 19), left as
+	// decoded for webSeeds to make sense of.
+	URLList interface{} `bencode:"url-list,omitempty"`
+	Info    TorrentInfo `bencode:"info"`
+}
 
-		info, err := parseToInfo(torrentFilepath)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+// TorrentInfo is the info dictionary. A single-file torrent has Length and a
+// multi-file one Files, in which case Name is the directory they go in and
+// Length is zero so that it is left out.
+type TorrentInfo struct {
+	Name        string      `bencode:"name"`
+	Length      int64       `bencode:"length,omitempty"`
+	Files       []FileEntry `bencode:"files,omitempty"`
+	PieceLength int         `bencode:"piece length"`
+	Pieces      []byte      `bencode:"pieces"`
+	Private     int64       `bencode:"private,omitempty"`
+	Source      string      `bencode:"source,omitempty"`
+}
 
-		fmt.Printf("Tracker URL: %s\n", info.TrackerURL)
-		fmt.Printf("Length: %d\n", info.Length)
-		fmt.Printf("Info Hash: %x\n", info.InfoHash)
-		fmt.Printf("Piece Length: %d\n", info.PieceLength)
-		fmt.Printf("Piece Hashes: \n%s", info.PieceHashes)
-	case "peers":
-		torrentFilepath := os.Args[2]
+// FileEntry is one file of a multi-file torrent. Path holds the names of
+// its directories, if any, followed by its own name.
+type FileEntry struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+	// Attr holds the file attributes of BEP 47, such as "p" for the
+	// padding files hybrid torrents insert to align files to pieces.
+	Attr string `bencode:"attr,omitempty"`
+	// PiecesRoot is the merkle root of the file in a v2 torrent, which has
+	// it in the file tree rather than in a files list.
+	PiecesRoot []byte `bencode:"-"`
+}
 
-		peers, err := getPeers(torrentFilepath)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+// IsPadding reports whether f is a padding file, whose bytes only fill up
+// the last piece of the file before it.
+func (f FileEntry) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
+}
 
-		for _, peer := range peers {
-			fmt.Println(peer)
-		}
-	case "handshake":
-		var (
-			torrentFilepath = os.Args[2]
-			peer            = os.Args[3]
-		)
+// checkFiles checks the files list of a multi-file torrent. Paths are joined
+// onto the download directory later, so any component that could lead out of
+// it is rejected.
+func checkFiles(files []FileEntry) error {
+	if len(files) == 0 {
+		return errors.New("files list is empty")
+	}
 
-		conn, err := net.Dial("tcp", peer)
-		if err != nil {
-			fmt.Println(err)
-			return
+	for i, f := range files {
+		if err := checkFile(i, f); err != nil {
+			return err
 		}
-		defer conn.Close()
+	}
 
-		buf, err := handshake(conn, torrentFilepath)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	return nil
+}
 
-		fmt.Printf("Peer ID: %x\n", string(buf))
-	case "download_piece":
-		var (
-			outputFilepath  string
-			torrentFilepath = os.Args[4]
-			pieceIdxStr     = os.Args[5]
-		)
-		if os.Args[2] == "-o" {
-			outputFilepath = os.Args[3]
-		}
-		pieceIdx, err := strconv.Atoi(pieceIdxStr)
-		if err != nil {
-			fmt.Println(err)
-			return
+// checkFile checks the file at index i of a files list.
+func checkFile(i int, f FileEntry) error {
+	if f.Length < 0 {
+		return fmt.Errorf("file %d has negative length %d", i, f.Length)
+	}
+	if len(f.Path) == 0 {
+		return fmt.Errorf("file %d has an empty path", i)
+	}
+	for _, name := range f.Path {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+			return fmt.Errorf("file %d has invalid path component %q", i, name)
 		}
+	}
 
-		info, err := parseToInfo(torrentFilepath)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	return nil
+}
 
-		peers, err := getPeers(torrentFilepath)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+// loadMetainfo decodes a torrent into a Metainfo, checking no more than it
+// takes to build one. ParseMetainfo rejects torrents that are unusable beyond
+// that, and ValidateMetainfo reports everything wrong with them.
+func loadMetainfo(content []byte) (*Metainfo, error) {
+	decoded, warnings, err := decodeTorrent(content)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal leaves missing fields zero, so check for the ones a torrent
+	// cannot do without first to report which one is missing.
+	if _, err := LookupDict(decoded, "info"); err != nil {
+		return nil, err
+	}
+	metaVersion, v2Only := torrentMetaVersion(decoded)
+	required := []string{"name", "pieces"}
+	if v2Only {
+		required = []string{"name"}
+	}
+	for _, key := range required {
+		if _, err := LookupBytes(decoded, "info", key); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := LookupInt(decoded, "info", "piece length"); err != nil {
+		return nil, err
+	}
+	var v2Files []FileEntry
+	if metaVersion == metaVersionV2 {
+		tree, err := LookupDict(decoded, "info", "file tree")
+		if err != nil {
+			return nil, err
+		}
+		v2Files, err = parseFileTree(tree)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, lengthErr := Lookup(decoded, "info", "length")
+	_, filesErr := Lookup(decoded, "info", "files")
+	switch {
+	case v2Only:
+	case lengthErr == nil && filesErr == nil:
+		return nil, errors.New("info has both \"length\" and \"files\"")
+	case filesErr == nil:
+		if _, err := LookupList(decoded, "info", "files"); err != nil {
+			return nil, err
+		}
+	default:
+		if _, err := LookupInt(decoded, "info", "length"); err != nil {
+			return nil, err
+		}
+	}
+
+	var torrent TorrentFile
+	err = unmarshalDecoded(decoded, &torrent)
+	if err != nil {
+		return nil, err
+	}
+	length := torrent.Info.Length
+	if torrent.Info.Files != nil {
+		length = 0
+		for _, f := range torrent.Info.Files {
+			length += f.Length
+		}
+	}
+
+	// The info hash is taken over the info dictionary exactly as it is in
+	// the file, including keys TorrentInfo has no field for.
+	rawInfo, err := rawInfoDict(trimBOM(content))
+	if err != nil {
+		return nil, err
+	}
+	// Re-encoding the info dictionary only serves as a check: when it does
+	// not give back the bytes in the file, a client that hashes the
+	// re-encoded form would announce a different torrent.
+	if reencoded, err := bencode(decoded["info"]); err == nil && !bytes.Equal(reencoded, rawInfo) {
+		warnings = append(warnings, "info dictionary is not canonically encoded, hashing it as written")
+	}
+
+	info := &Info{
+		Name:        torrent.Info.Name,
+		Length:      length,
+		Files:       torrent.Info.Files,
+		InfoHash:    infoHashFor(rawInfo, metaVersion, v2Only),
+		RawInfo:     rawInfo,
+		PieceLength: torrent.Info.PieceLength,
+		Pieces:      torrent.Info.Pieces,
+		Private:     torrent.Info.Private == 1,
+		Source:      torrent.Info.Source,
+		Warnings:    warnings,
+	}
+	info.MetaVersion = 1
+	if metaVersion == metaVersionV2 {
+		info.MetaVersion = metaVersionV2
+		info.InfoHashV2 = sha256.Sum256(rawInfo)
+	}
+	switch {
+	case v2Only:
+		setV2Files(info, v2Files)
+	case metaVersion == metaVersionV2:
+		if err := attachPiecesRoots(info, v2Files); err != nil {
+			return nil, err
+		}
+		info.InfoHashV1 = sha1.Sum(rawInfo)
+	default:
+		info.InfoHashV1 = info.InfoHash
+	}
+	m := &Metainfo{
+		Announce:     torrent.Announce,
+		AnnounceList: announceTiers(torrent.AnnounceList, torrent.Announce),
+		Comment:      torrent.Comment,
+		CreatedBy:    torrent.CreatedBy,
+		Encoding:     torrent.Encoding,
+		Info:         info,
+	}
+	for _, tier := range m.AnnounceList {
+		for _, announce := range tier {
+			if _, err := classifyTracker(announce); err != nil {
+				info.Warnings = append(info.Warnings, fmt.Sprintf("%v, so it is skipped", err))
+			}
+		}
+	}
+	if urlList, ok := decoded["url-list"]; ok {
+		var webSeedWarnings []string
+		info.WebSeeds, webSeedWarnings = webSeeds(urlList, info)
+		info.Warnings = append(info.Warnings, webSeedWarnings...)
+	}
+	if seeds, ok := decoded["httpseeds"]; ok {
+		var httpSeedWarnings []string
+		info.HTTPSeeds, httpSeedWarnings = httpSeeds(seeds, info.WebSeeds)
+		info.Warnings = append(info.Warnings, httpSeedWarnings...)
+	}
+	if nodes, ok := decoded["nodes"]; ok {
+		var nodeWarnings []string
+		info.Nodes, nodeWarnings = dhtNodes(nodes)
+		info.Warnings = append(info.Warnings, nodeWarnings...)
+	}
+	if torrent.CreationDate != 0 {
+		m.CreationDate = time.Unix(torrent.CreationDate, 0).UTC()
+	}
+
+	info.Warnings = append(info.Warnings, duplicatePieceWarnings(info.Pieces)...)
+	info.PieceHashes = make([][sha1.Size]byte, len(info.Pieces)/eachPieceSize)
+	for i := range info.PieceHashes {
+		copy(info.PieceHashes[i][:], info.Pieces[i*eachPieceSize:])
+	}
+
+	return m, nil
+}
+
+// announceTiers returns the tiers of list without empty URLs and tiers, or
+// a single tier of announce when that leaves none.
+func announceTiers(list [][]string, announce string) [][]string {
+	var ret [][]string
+	for _, tier := range list {
+		var urls []string
+		for _, u := range tier {
+			if u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) > 0 {
+			ret = append(ret, urls)
+		}
+	}
+	if len(ret) == 0 && announce != "" {
+		ret = [][]string{{announce}}
+	}
+
+	return ret
+}
+
+// webSeeds returns the web seeds of a "url-list" value, which is either one
+// URL or a list of them, normalized as Info.WebSeeds describes, along with
+// warnings for entries that are not URLs.
+//
+// Example:
+// - "http://mirror/dir/" for a single-file "a.iso" -> ["http://mirror/dir/a.iso"]
+// - ["http://mirror/dir"] for a multi-file torrent -> ["http://mirror/dir/"]
+func webSeeds(urlList interface{}, info *Info) ([]string, []string) {
+	var (
+		entries  []interface{}
+		ret      []string
+		warnings []string
+	)
+	switch v := urlList.(type) {
+	case []byte:
+		entries = []interface{}{v}
+	case []interface{}:
+		entries = v
+	default:
+		return nil, []string{fmt.Sprintf("ignoring url-list that is %s", withArticle(bencodeKind(urlList)))}
+	}
+
+	for i, entry := range entries {
+		u, ok := entry.([]byte)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("ignoring url-list entry %d that is %s", i, withArticle(bencodeKind(entry))))
+			continue
+		}
+		if len(u) == 0 {
+			continue
+		}
+
+		seed := string(u)
+		switch {
+		case info.Files != nil && !strings.HasSuffix(seed, "/"):
+			seed += "/"
+		case info.Files == nil && strings.HasSuffix(seed, "/"):
+			seed += url.PathEscape(info.Name)
+		}
+		if !containsString(ret, seed) {
+			ret = append(ret, seed)
+		}
+	}
+
+	return ret, warnings
+}
+
+// httpSeeds returns the URLs of an "httpseeds" list, leaving out repeated
+// ones and those already in webSeeds, along with warnings for entries that are
+// not URLs.
+func httpSeeds(seeds interface{}, webSeeds []string) ([]string, []string) {
+	entries, ok := seeds.([]interface{})
+	if !ok {
+		return nil, []string{fmt.Sprintf("ignoring httpseeds that is %s", withArticle(bencodeKind(seeds)))}
+	}
+
+	var ret, warnings []string
+	for i, entry := range entries {
+		u, ok := entry.([]byte)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("ignoring httpseeds entry %d that is %s", i, withArticle(bencodeKind(entry))))
+			continue
+		}
+		if len(u) == 0 || containsString(webSeeds, string(u)) || containsString(ret, string(u)) {
+			continue
+		}
+		ret = append(ret, string(u))
+	}
+
+	return ret, warnings
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// dhtNodes returns the nodes of a "nodes" value, a list of [host, port]
+// pairs, as host:port addresses, along with warnings for entries that are not
+// such pairs.
+//
+// Example:
+// - [["router.example", 6881], ["::1", 6881]] -> ["router.example:6881", "[::1]:6881"]
+func dhtNodes(nodes interface{}) ([]string, []string) {
+	entries, ok := nodes.([]interface{})
+	if !ok {
+		return nil, []string{fmt.Sprintf("ignoring nodes that is %s", withArticle(bencodeKind(nodes)))}
+	}
+
+	var ret, warnings []string
+	for i, entry := range entries {
+		pair, ok := entry.([]interface{})
+		if !ok || len(pair) != 2 {
+			warnings = append(warnings, fmt.Sprintf("ignoring nodes entry %d that is not a [host, port] pair", i))
+			continue
+		}
+		host, hostOK := pair[0].([]byte)
+		port, portOK := pair[1].(int64)
+		if !hostOK || !portOK || len(host) == 0 || port <= 0 || port > 65535 {
+			warnings = append(warnings, fmt.Sprintf("ignoring nodes entry %d that is not a [host, port] pair", i))
+			continue
+		}
+		ret = append(ret, net.JoinHostPort(string(host), strconv.FormatInt(port, 10)))
+	}
+
+	return ret, warnings
+}
+
+// trackerKind is the protocol a tracker is announced to with.
+type trackerKind int
+
+const (
+	trackerHTTP trackerKind = iota + 1
+	// trackerUDP is the UDP tracker protocol (BEP 15), which is not
+	// supported yet.
+	trackerUDP
+)
+
+// errUDPTracker is returned for a udp:// tracker.
+var errUDPTracker = errors.New("tracker uses UDP protocol (not yet supported)")
+
+// classifyTracker returns the protocol of the tracker at announce, or an
+// error when it is not a URL a tracker could be reached at.
+//
+// Example:
+// - "http://tracker.example/announce" -> trackerHTTP
+// - "udp://tracker.example:6969" -> trackerUDP
+// - "wss://tracker.example" -> announce URL "wss://tracker.example" has unsupported scheme "wss"
+func classifyTracker(announce string) (trackerKind, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return 0, fmt.Errorf("invalid announce URL %q", announce)
+	}
+
+	var kind trackerKind
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		kind = trackerHTTP
+	case "udp":
+		kind = trackerUDP
+	case "":
+		return 0, fmt.Errorf("announce URL %q has no scheme", announce)
+	default:
+		return 0, fmt.Errorf("announce URL %q has unsupported scheme %q", announce, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return 0, fmt.Errorf("announce URL %q has no host", announce)
+	}
+	// There is no default port to fall back on for a UDP tracker.
+	if kind == trackerUDP && u.Port() == "" {
+		return 0, fmt.Errorf("announce URL %q has no port", announce)
+	}
+
+	return kind, nil
+}
+
+// errNoTracker is returned for an announce of a torrent that has no tracker,
+// such as a trackerless one that relies on DHT nodes.
+var errNoTracker = errors.New("no tracker in metainfo")
+
+// announceOptions controls how the tracker is asked for peers.
+type announceOptions struct {
+	// compact is the announce "compact" parameter; 1 asks for the packed
+	// 6-bytes-per-peer form and 0 for a list of dictionaries.
+	compact int
+	// params are extra query parameters some trackers require, such as a
+	// passkey.
+	params trackerParams
+	// method is the HTTP method of the announce. With POST the announce
+	// parameters go in a form body instead of the query string.
+	method string
+	// client sends the announce; nil means http.DefaultClient.
+	client *http.Client
+	// rand shuffles the trackers within each tier; nil means one seeded
+	// from the clock.
+	rand *rand.Rand
+}
+
+// networkOptions controls how connections to peers and trackers are made.
+type networkOptions struct {
+	// bind is the local address connections originate from, as an IP
+	// address or IP:port. Empty leaves the choice to the OS.
+	bind string
+}
+
+func (o *networkOptions) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.bind, "bind", o.bind, "local IP address (or IP:port) to connect from")
+}
+
+// localAddr parses o.bind, returning nil when it is empty.
+func (o *networkOptions) localAddr() (*net.TCPAddr, error) {
+	if o.bind == "" {
+		return nil, nil
+	}
+
+	host, port := o.bind, "0"
+	if h, p, err := net.SplitHostPort(o.bind); err == nil {
+		host, port = h, p
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid --bind %q: not an IP address", o.bind)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --bind %q: bad port", o.bind)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(portNum)}, nil
+}
+
+// dialer returns the dialer for peer connections.
+func (o *networkOptions) dialer() (*net.Dialer, error) {
+	localAddr, err := o.localAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &net.Dialer{Timeout: dialTimeout}
+	if localAddr != nil {
+		d.LocalAddr = localAddr
+	}
+
+	return d, nil
+}
+
+// httpClient returns the client for tracker requests.
+func (o *networkOptions) httpClient() (*http.Client, error) {
+	d, err := o.dialer()
+	if err != nil {
+		return nil, err
+	}
+	if d.LocalAddr == nil {
+		return http.DefaultClient, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = d.DialContext
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// standardAnnounceParams are the query parameters requestToTracker always
+// sends, which --tracker-param must not override.
+var standardAnnounceParams = map[string]bool{
+	"info_hash":  true,
+	"peer_id":    true,
+	"port":       true,
+	"uploaded":   true,
+	"downloaded": true,
+	"left":       true,
+	"compact":    true,
+}
+
+// trackerParams is a repeatable key=value flag.
+type trackerParams [][2]string
+
+func (p *trackerParams) String() string {
+	strs := make([]string, 0, len(*p))
+	for _, param := range *p {
+		strs = append(strs, param[0]+"="+param[1])
+	}
+	return strings.Join(strs, ",")
+}
+
+func (p *trackerParams) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i < 0 {
+		return fmt.Errorf("%q is not in key=value form", value)
+	}
+
+	key, val := value[:i], value[i+1:]
+	if key == "" {
+		return fmt.Errorf("%q has an empty key", value)
+	}
+	if standardAnnounceParams[key] {
+		return fmt.Errorf("%q cannot override the standard announce parameter %s", value, key)
+	}
+
+	*p = append(*p, [2]string{key, val})
+
+	return nil
+}
+
+func defaultAnnounceOptions() announceOptions {
+	return announceOptions{compact: 1, method: http.MethodGet}
+}
+
+// registerFlags adds the announce flags shared by every command that talks
+// to the tracker.
+func (o *announceOptions) registerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.compact, "compact", o.compact, "announce compact parameter (0 or 1)")
+	fs.Var(&o.params, "tracker-param", "extra announce query parameter as key=value (repeatable)")
+	fs.StringVar(&o.method, "announce-method", o.method, "HTTP method of the announce (GET or POST)")
+}
+
+func (o *announceOptions) validate() error {
+	if o.compact != 0 && o.compact != 1 {
+		return fmt.Errorf("invalid --compact %d: must be 0 or 1", o.compact)
+	}
+
+	o.method = strings.ToUpper(o.method)
+	if o.method != http.MethodGet && o.method != http.MethodPost {
+		return fmt.Errorf("invalid --announce-method %q: must be GET or POST", o.method)
+	}
+
+	return nil
+}
+
+// duplicatePieceWarnings reports every piece hash shared by more than one
+// piece index. Identical content legitimately produces this, but it is also a
+// sign of a torrent that was generated incorrectly.
+func duplicatePieceWarnings(pieces []byte) []string {
+	n := len(pieces) / eachPieceSize
+	var (
+		// first maps each hash to the first piece with it. Only hashes seen
+		// again get an entry in indices, which keeps allocations off the
+		// common path of a torrent without duplicates.
+		first   = make(map[[eachPieceSize]byte]int, n)
+		indices = map[[eachPieceSize]byte][]int{}
+		order   [][eachPieceSize]byte
+	)
+	for i := 0; i < n; i++ {
+		var hash [eachPieceSize]byte
+		copy(hash[:], pieces[i*eachPieceSize:])
+
+		j, seen := first[hash]
+		if !seen {
+			first[hash] = i
+			continue
+		}
+		if _, ok := indices[hash]; !ok {
+			indices[hash] = []int{j}
+			order = append(order, hash)
+		}
+		indices[hash] = append(indices[hash], i)
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return first[order[a]] < first[order[b]]
+	})
+
+	var ret []string
+	for _, hash := range order {
+		strs := make([]string, 0, len(indices[hash]))
+		for _, index := range indices[hash] {
+			strs = append(strs, strconv.Itoa(index))
+		}
+		ret = append(ret, fmt.Sprintf("pieces %s share the same hash %x", strings.Join(strs, ", "), hash))
+	}
+
+	return ret
+}
+
+// NumPieces returns the number of pieces in the torrent.
+func (info *Info) NumPieces() int {
+	return len(info.PieceHashes)
+}
+
+// PieceSize returns the length of the piece at index i. Every piece is
+// PieceLength long except the last, which holds whatever remains of Length.
+func (info *Info) PieceSize(i int) int {
+	if i == info.NumPieces()-1 {
+		return int(info.Length - int64(info.PieceLength)*int64(i))
+	}
+	return info.PieceLength
+}
+
+// TotalLength returns the number of bytes in the torrent, the sum of the
+// lengths of its files for a multi-file torrent.
+func (info *Info) TotalLength() int64 {
+	if info.Files == nil {
+		return info.Length
+	}
+
+	var total int64
+	for _, f := range info.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// FileRange is the part of a file that a piece covers.
+type FileRange struct {
+	// FileIndex is the index in Files, or 0 for a single-file torrent.
+	FileIndex int
+	// FileOffset is where the range starts within the file.
+	FileOffset int64
+	Length     int64
+}
+
+// FileRanges returns the parts of the files the piece at index i covers, in
+// order, so that their lengths add up to PieceSize(i). Empty files cover no
+// bytes and never appear. It returns nil for an index out of range.
+func (info *Info) FileRanges(i int) []FileRange {
+	if i < 0 || i >= info.NumPieces() {
+		return nil
+	}
+
+	begin := int64(info.PieceLength) * int64(i)
+	end := begin + int64(info.PieceSize(i))
+	if info.Files == nil {
+		return []FileRange{{FileIndex: 0, FileOffset: begin, Length: end - begin}}
+	}
+
+	var (
+		ranges []FileRange
+		start  int64
+	)
+	for j, f := range info.Files {
+		fileEnd := start + f.Length
+		if f.Length > 0 && fileEnd > begin && start < end {
+			from, to := begin, end
+			if start > from {
+				from = start
+			}
+			if fileEnd < to {
+				to = fileEnd
+			}
+			ranges = append(ranges, FileRange{FileIndex: j, FileOffset: from - start, Length: to - from})
+		}
+		if fileEnd >= end {
+			break
+		}
+		start = fileEnd
+	}
+
+	return ranges
+}
+
+// PieceHash returns the expected SHA-1 hash of the piece at index i.
+func (info *Info) PieceHash(i int) ([sha1.Size]byte, error) {
+	if i < 0 || i >= len(info.PieceHashes) {
+		return [sha1.Size]byte{}, fmt.Errorf("piece index %d out of range, the torrent has %d pieces", i, len(info.PieceHashes))
+	}
+	return info.PieceHashes[i], nil
+}
+
+// HashesHex returns the hex hash of every piece, one per line.
+func (info *Info) HashesHex() string {
+	return pieceHashLines(info.Pieces)
+}
+
+// pieceHashLines returns the hex hash of every piece, one per line.
+func pieceHashLines(pieces []byte) string {
+	const lineSize = 2*eachPieceSize + 1
+
+	n := len(pieces) / eachPieceSize
+	buf := make([]byte, n*lineSize)
+	for i := 0; i < n; i++ {
+		line := buf[i*lineSize:]
+		hex.Encode(line, pieces[i*eachPieceSize:(i+1)*eachPieceSize])
+		line[lineSize-1] = '\n'
+	}
+
+	return string(buf)
+}
+
+// requestToTracker announces to the trackers of the torrent tier by tier,
+// in a shuffled order within each tier as BEP 12 asks, and returns the
+// response of the first one that answers.
+func requestToTracker(m *Metainfo, opts announceOptions) (*http.Response, error) {
+	if len(m.AnnounceList) == 0 {
+		return nil, errNoTracker
+	}
+
+	r := opts.rand
+	if r == nil {
+		r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	var lastErr error
+	for _, tier := range m.AnnounceList {
+		urls := append([]string(nil), tier...)
+		r.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+
+		for _, announce := range urls {
+			kind, err := classifyTracker(announce)
+			switch {
+			case err != nil:
+			case kind == trackerUDP:
+				err = errUDPTracker
+			default:
+				var res *http.Response
+				res, err = announceTo(announce, m.Info, opts)
+				if err == nil {
+					return res, nil
+				}
+			}
+
+			warnf("skipping tracker %s: %v", announce, err)
+			lastErr = err
+		}
+	}
+
+	return nil, lastErr
+}
+
+// announceTo sends the announce for info to a single tracker.
+func announceTo(announce string, info *Info, opts announceOptions) (*http.Response, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	q.Add("info_hash", string(info.InfoHash[:]))
+	q.Add("peer_id", clientPeerID)
+	q.Add("port", "6881")
+	q.Add("uploaded", "0")
+	q.Add("downloaded", "0")
+	q.Add("left", fmt.Sprint(info.Length))
+	q.Add("compact", fmt.Sprint(opts.compact))
+	for _, param := range opts.params {
+		q.Add(param[0], param[1])
+	}
+
+	client := opts.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if opts.method == http.MethodPost {
+		// Whatever query the announce URL already has stays in the URL.
+		return client.PostForm(u.String(), q)
+	}
+
+	// Parameters already in the announce URL, such as a passkey, are kept.
+	for key, values := range u.Query() {
+		for _, value := range values {
+			q.Add(key, value)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	to := u.String()
+
+	return client.Get(to)
+}
+
+func getPeers(m *Metainfo, opts announceOptions) ([]string, error) {
+	res, err := requestToTracker(m, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	// An HTML error page or a cut-off body fails here, before anything is
+	// built from it. Some trackers end the body with a newline, which is
+	// left for DecodeFirst to return as rest.
+	if !Valid(bytes.TrimRight(b, " \t\r\n")) {
+		return nil, withExitCode(exitNetwork, errors.New("tracker response is not valid bencode"))
+	}
+	decoded, _, err := DecodeFirst(b)
+	if err != nil {
+		return nil, withExitCode(exitNetwork, err)
+	}
+
+	dict, err := LookupDict(decoded)
+	if err != nil {
+		return nil, withExitCode(exitNetwork, fmt.Errorf("tracker response: %w", err))
+	}
+	if warning, err := LookupString(dict, "warning message"); err == nil {
+		warnf("tracker: %s", warning)
+	}
+
+	resPeers, err := Lookup(dict, "peers")
+	if err != nil {
+		return nil, withExitCode(exitNetwork, fmt.Errorf("tracker response: %w", err))
+	}
+
+	// Trackers may ignore the compact parameter, so accept either form.
+	var peers []string
+	switch resPeers := resPeers.(type) {
+	case []byte:
+		peers, err = parseCompactPeers(resPeers)
+	case []interface{}:
+		peers, err = parseDictPeers(resPeers)
+	default:
+		err = fmt.Errorf("tracker response: \"peers\": expected string or list, got %s", bencodeKind(resPeers))
+	}
+
+	return peers, withExitCode(exitNetwork, err)
+}
+
+// Example:
+// - "\x7f\x00\x00\x01\x1a\xe1" -> ["127.0.0.1:6881"]
+// - "" -> []
+func parseCompactPeers(resPeer []byte) ([]string, error) {
+	const eachPeerSize = 6
+
+	if len(resPeer)%eachPeerSize != 0 {
+		return nil, errors.New("unexpected peers string")
+	}
+
+	ret := make([]string, 0, len(resPeer)/eachPeerSize)
+	for i := 0; i < len(resPeer); i += eachPeerSize {
+		ip := net.IP(resPeer[i : i+4])
+		port := binary.BigEndian.Uint16(resPeer[i+4 : i+6])
+		ret = append(ret, fmt.Sprintf("%s:%d", ip, port))
+	}
+
+	return ret, nil
+}
+
+// Example:
+// - [{"ip": "127.0.0.1", "peer id": "...", "port": 6881}] -> ["127.0.0.1:6881"]
+func parseDictPeers(resPeer []interface{}) ([]string, error) {
+	ret := make([]string, 0, len(resPeer))
+	for i, item := range resPeer {
+		ip, err := LookupString(item, "ip")
+		if err != nil {
+			return nil, fmt.Errorf("peer entry %d: %w", i, err)
+		}
+		port, err := LookupInt(item, "port")
+		if err != nil {
+			return nil, fmt.Errorf("peer entry %d: %w", i, err)
+		}
+
+		ret = append(ret, net.JoinHostPort(ip, strconv.FormatInt(port, 10)))
+	}
+
+	return ret, nil
+}
+
+const peerIDLen = 20
+
+// clientPeerID is the peer id this client announces and handshakes with.
+const clientPeerID = "00112233445566778899"
+
+// extensionBit is set in the reserved bytes of the handshake by peers that
+// speak the extension protocol (BEP 10).
+const (
+	extensionByte = 5
+	extensionBit  = 0x10
+)
+
+// handshake sends our handshake for info as peerID and returns the peer id
+// the peer answered with.
+func handshake(conn net.Conn, info *Info, peerID string) ([]byte, error) {
+	buf, err := handshakeMessage(conn, info, peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[len(buf)-peerIDLen:], nil
+}
+
+// handshakeMessage sends our handshake and returns the peer's reply as is.
+func handshakeMessage(conn net.Conn, info *Info, peerID string) ([]byte, error) {
+	const (
+		protocolStrLengthStr = string(byte(19))
+		protocolStr          = "BitTorrent protocol"
+		reservedBytesStr     = "\x00\x00\x00\x00\x00\x10\x00\x00"
+	)
+	infoHash := string(info.InfoHash[:])
+
+	handshake := protocolStrLengthStr + protocolStr + reservedBytesStr + infoHash + peerID
+	_, err := conn.Write([]byte(handshake))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, len(handshake))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// handshakeWithPeerID performs the handshake and, when expectedPeerID is not
+// empty, fails unless the peer answered with exactly that peer id.
+func handshakeWithPeerID(conn net.Conn, info *Info, expectedPeerID []byte) ([]byte, error) {
+	peerID, err := handshake(conn, info, clientPeerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(expectedPeerID) > 0 && !bytes.Equal(peerID, expectedPeerID) {
+		return nil, withExitCode(exitVerification, fmt.Errorf("unexpected peer id. exp: %x, got: %x", expectedPeerID, peerID))
+	}
+
+	return peerID, nil
+}
+
+const (
+	choke            = 0
+	unchoke          = 1
+	interested       = 2
+	notInterestedNot = 3
+	have             = 4
+	bitfield         = 5
+	request          = 6
+	piece            = 7
+	cancel           = 8
+	extended         = 20
+)
+
+const (
+	messageLengthLen = 4
+	messageIDLen     = 1
+)
+
+type peerMessage struct {
+	id      byte
+	payload []byte
+}
+
+// readPeerMessage reads a single length-prefixed message from conn. It returns
+// a nil message for keep-alives, which have no message id.
+func readPeerMessage(conn net.Conn) (*peerMessage, error) {
+	messageLengthBuf := make([]byte, messageLengthLen)
+	_, err := io.ReadFull(conn, messageLengthBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	messageLength := binary.BigEndian.Uint32(messageLengthBuf)
+	if messageLength == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, messageLength)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &peerMessage{id: buf[0], payload: buf[messageIDLen:]}, nil
+}
+
+func waitPeerMessage(conn net.Conn, expid byte) ([]byte, error) {
+	for {
+		msg, err := readPeerMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg != nil && msg.id == expid {
+			return msg.payload, nil
+		}
+	}
+}
+
+func sendPeerMessage(conn net.Conn, id byte, payload []byte) error {
+	buf := make([]byte, messageLengthLen+messageIDLen+len(payload))
+
+	// message length
+	binary.BigEndian.PutUint32(buf[:messageLengthLen], uint32(messageIDLen+len(payload)))
+
+	// message id
+	buf[messageLengthLen] = id
+
+	// payload
+	copy(buf[messageLengthLen+messageIDLen:], payload)
+
+	_, err := conn.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// stdin is read by commands given "-" as a file.
+var stdin io.Reader = os.Stdin
+
+// logOutput receives warnings and diagnostics so that stdout only carries
+// command results.
+var logOutput io.Writer = os.Stderr
+
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(logOutput, "warning: "+format+"\n", args...)
+}
+
+// errOutput is where main reports a failed command. It stays stdout unless
+// --quiet is given, which reserves stdout for results alone.
+var errOutput io.Writer = os.Stdout
+
+// verbose enables debugf output and extra detail such as piece sources in
+// the download manifest.
+var verbose bool
+
+func debugf(format string, args ...interface{}) {
+	if verbose {
+		fmt.Fprintf(logOutput, "debug: "+format+"\n", args...)
+	}
+}
+
+// globalOptions are flags accepted by every command.
+type globalOptions struct {
+	// quiet drops warnings and diagnostics, leaving only the command's
+	// result on stdout and errors on stderr.
+	quiet bool
+	// verbose adds debugging detail; quiet still wins for log output.
+	verbose bool
+	// strict rejects torrents that break the spec in ways otherwise
+	// tolerated; see torrentOptions.
+	strict bool
+	// protocol is "v1" or "v2", the info hash a hybrid torrent is announced
+	// and handshaken with. Empty means v1.
+	protocol string
+}
+
+// parseGlobalFlags removes the global flags from args, wherever they appear,
+// and returns the remaining arguments.
+func parseGlobalFlags(args []string) ([]string, globalOptions) {
+	var (
+		opts globalOptions
+		rest = make([]string, 0, len(args))
+	)
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-q" || arg == "--quiet" || arg == "-quiet":
+			opts.quiet = true
+		case arg == "-v" || arg == "--verbose" || arg == "-verbose":
+			opts.verbose = true
+		case arg == "--strict" || arg == "-strict":
+			opts.strict = true
+		case (arg == "--protocol" || arg == "-protocol") && i+1 < len(args):
+			i++
+			opts.protocol = args[i]
+		case strings.HasPrefix(arg, "--protocol=") || strings.HasPrefix(arg, "-protocol="):
+			opts.protocol = arg[strings.IndexByte(arg, '=')+1:]
+		default:
+			rest = append(rest, arg)
+		}
+	}
+
+	return rest, opts
+}
+
+// check reports global flags with values that are not allowed.
+func (o globalOptions) check() error {
+	if o.protocol != "" && o.protocol != "v1" && o.protocol != "v2" {
+		return fmt.Errorf("invalid --protocol %q: must be v1 or v2", o.protocol)
+	}
+	return nil
+}
+
+func (o globalOptions) apply() {
+	verbose = o.verbose
+	strictTorrents = o.strict
+	protocolV2 = o.protocol == "v2"
+	if o.quiet {
+		logOutput = io.Discard
+		errOutput = os.Stderr
+	}
+}
+
+// parseFlags parses args with fs while allowing flags to appear before, between
+// or after positional arguments, and returns the positional arguments in order.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// displayStrings returns decoded with every string converted with convert,
+// so that the JSON output shows them rather than base64. Dictionary keys
+// that are not UTF-8 become "$hex:" followed by their hex, whatever
+// convert does: encoding/json would replace their invalid bytes with U+FFFD,
+// which can turn two keys into one.
+func displayStrings(decoded interface{}, convert func([]byte) interface{}) interface{} {
+	switch v := decoded.(type) {
+	case []byte:
+		return convert(v)
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, e := range v {
+			ret[i] = displayStrings(e, convert)
+		}
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			ret[displayKey(k)] = displayStrings(e, convert)
+		}
+		return ret
+	case *OrderedDict:
+		ret := newOrderedDict()
+		for _, k := range v.Keys {
+			ret.Set(displayKey(k), displayStrings(v.Values[k], convert))
+		}
+		return ret
+	default:
+		return decoded
+	}
+}
+
+func displayKey(key string) string {
+	if utf8.ValidString(key) {
+		return key
+	}
+	return "$hex:" + hex.EncodeToString([]byte(key))
+}
+
+func plainString(b []byte) interface{} {
+	return string(b)
+}
+
+// tagString tells text from binary data: {"_type":"text","text":...} for
+// valid UTF-8 and {"_type":"bytes","hex":...} otherwise.
+func tagString(b []byte) interface{} {
+	if utf8.Valid(b) {
+		return map[string]interface{}{"_type": "text", "text": string(b)}
+	}
+	return map[string]interface{}{"_type": "bytes", "hex": hex.EncodeToString(b)}
+}
+
+// binaryString returns how strings that are not valid UTF-8 are shown for
+// mode: as they are with "raw", as {"$hex":...} with "hex" and as a base64
+// string with "base64". Text is always shown as it is.
+func binaryString(mode string) (func([]byte) interface{}, error) {
+	var convert func([]byte) interface{}
+	switch mode {
+	case "raw":
+		return plainString, nil
+	case "hex":
+		convert = func(b []byte) interface{} {
+			return map[string]interface{}{"$hex": hex.EncodeToString(b)}
+		}
+	case "base64":
+		convert = func(b []byte) interface{} {
+			return base64.StdEncoding.EncodeToString(b)
+		}
+	default:
+		return nil, fmt.Errorf("unknown --binary mode %q, want raw, hex or base64", mode)
+	}
+
+	return func(b []byte) interface{} {
+		if utf8.Valid(b) {
+			return string(b)
+		}
+		return convert(b)
+	}, nil
+}
+
+// Example:
+// - decode 5:hello -> "hello"
+// - decode d3:foo3:bare --typed -> {"foo":{"_type":"text","text":"bar"}}
+// - decode d6:pieces2:<ff 00>e --binary=hex -> {"pieces":{"$hex":"ff00"}}
+// - decode d2:<ff 01>1:ae -> {"$hex:ff01":"a"}
+// - decode -f sample.torrent --binary=hex
+// - decode -f sample.torrent --pretty -> indented, "pieces": <e876...(60 bytes)>
+// - cat sample.torrent | decode -f -
+// - decode d1:bi1e1:ai2ee --ordered -> {"b":1,"a":2}
+// - decode i03e --lenient -> 3
+// - printf 'i52e\n' | decode -f - -> 52
+// - decode i52exxxx -> error: trailing data at offset 4
+// - decode d1:ai1e1:ai2ee --reject-duplicate-keys -> error: duplicate dictionary key "a"
+func runDecode(args []string, w io.Writer) error {
+	var (
+		typed  bool
+		pretty bool
+		binary string
+		file   string
+		opts   decodeOptions
+	)
+
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	fs.BoolVar(&typed, "typed", false, "tag each string as text or hex-encoded bytes")
+	fs.BoolVar(&pretty, "pretty", false, "indent the output and summarize long binary strings")
+	fs.StringVar(&binary, "binary", "raw", "how to show strings that are not UTF-8: raw, hex or base64")
+	fs.StringVar(&file, "f", "", "read the bencoded value from a file, or stdin for -")
+	fs.BoolVar(&opts.orderedDicts, "ordered", false, "keep dictionary keys in the order they appear in")
+	fs.BoolVar(&opts.lenientIntegers, "lenient", false, "accept integers with leading zeros and -0")
+	fs.BoolVar(&opts.rejectDuplicateKeys, "reject-duplicate-keys", false, "fail on a key that repeats within a dictionary")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if (file == "") != (len(positional) == 1) || len(positional) > 1 {
+		return errors.New("usage: decode <bencoded value> | -f <file> [--typed | --binary=raw|hex|base64 | --pretty] [--ordered] [--lenient] [--reject-duplicate-keys]")
+	}
+	opts.warnf = warnf
+
+	var input []byte
+	switch file {
+	case "":
+		input = []byte(positional[0])
+	case "-":
+		input, err = io.ReadAll(stdin)
+	default:
+		input, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	convert, err := binaryString(binary)
+	if err != nil {
+		return err
+	}
+	if typed {
+		if binary != "raw" {
+			return errors.New("--typed and --binary cannot be combined")
+		}
+		convert = tagString
+	}
+	if pretty && (typed || binary != "raw") {
+		return errors.New("--pretty cannot be combined with --typed or --binary")
+	}
+
+	decoded, consumed, err := decodeBencodeWith(input, opts)
+	if err != nil {
+		return err
+	}
+	// A single newline after the value, as left by echo or an editor, is
+	// not taken for trailing data.
+	if consumed != len(input) && (consumed != len(input)-1 || input[consumed] != '\n') {
+		return fmt.Errorf("trailing data at offset %d", consumed)
+	}
+	if pretty {
+		return writePretty(w, decoded)
+	}
+	decoded = displayStrings(decoded, convert)
+
+	jsonOutput, err := json.Marshal(decoded)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(jsonOutput))
+
+	return nil
+}
+
+// Example:
+// - reencode sample.torrent -> canonical
+func runReencode(args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: reencode <torrent file>")
+	}
+
+	content, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	err = VerifyCanonical(content)
+	if err != nil {
+		return withExitCode(exitVerification, err)
+	}
+	fmt.Fprintln(w, "canonical")
+
+	return nil
+}
+
+// Example:
+// - difftorrent a.torrent b.torrent -> info.piece length: 262144 vs 262145
+func runDiffTorrent(args []string, w io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("usage: difftorrent <torrent a> <torrent b>")
+	}
+
+	var decoded [2]map[string]interface{}
+	for i, path := range args {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		decoded[i], _, err = decodeTorrent(content)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	diffs := Diff(decoded[0], decoded[1])
+	for _, d := range diffs {
+		fmt.Fprintln(w, d)
+	}
+	if len(diffs) > 0 {
+		return withExitCode(exitVerification, fmt.Errorf("torrents differ in %d places", len(diffs)))
+	}
+	fmt.Fprintln(w, "no differences")
+
+	return nil
+}
+
+// Example:
+// - create -o out.torrent -a http://tracker.example/announce ./data
+// - create -o out.torrent -a http://tracker.example/announce -l 262144 file.iso
+// - create -o out.torrent -a http://a.example/announce -a http://b.example/announce --tier -a udp://c.example:6969 ./data -> two tiers
+// - create -o out.torrent -a http://tracker.example/announce --webseed http://mirror.example/pub/ --private file.iso
+func runCreate(args []string, w io.Writer) error {
+	var (
+		outputFilepath string
+		opts           createOptions
+	)
+
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	fs.StringVar(&outputFilepath, "o", "", "torrent file to write")
+	fs.Var(&opts.trackers, "a", "announce URL of a tracker (repeatable)")
+	fs.Var(tierBreak{&opts.trackers}, "tier", "put the -a URLs after this in a new tier")
+	fs.Var(&opts.webSeeds, "webseed", "web seed URL to list in url-list (repeatable)")
+	fs.BoolVar(&opts.private, "private", false, "mark the torrent private, so clients only use its trackers for peers")
+	fs.StringVar(&opts.source, "source", "", "source to put in the info dictionary, giving the torrent an info hash of its own")
+	fs.IntVar(&opts.pieceLength, "l", 0, "piece length in bytes (default: picked from the total size)")
+	fs.StringVar(&opts.comment, "comment", "", "comment to include")
+	fs.StringVar(&opts.createdBy, "created-by", "", "\"created by\" value to include")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || outputFilepath == "" || len(opts.trackers) == 0 {
+		return errors.New("usage: create -o <out.torrent> -a <announce> [-a <announce>] [--tier -a <announce>] [--webseed <url>] [--private] [--source <source>] [-l <piece length>] <path>")
+	}
+	if opts.pieceLength < 0 {
+		return fmt.Errorf("invalid piece length %d", opts.pieceLength)
+	}
+
+	torrent, err := createTorrent(positional[0], opts)
+	if err != nil {
+		return err
+	}
+	bencoded, err := Marshal(torrent)
+	if err != nil {
+		return err
+	}
+	// Marshal gives the canonical encoding, so the info dictionary hashes
+	// the same once the file is read back.
+	rawInfo, err := Marshal(torrent.Info)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(outputFilepath, bencoded, 0o644)
+	if err != nil {
+		return fmt.Errorf("cannot write torrent to %s: %w", outputFilepath, err)
+	}
+	fmt.Fprintf(w, "Info Hash: %x\n", sha1.Sum(rawInfo))
+
+	return nil
+}
+
+// Example:
+// - magnet sample.torrent -> magnet:?xt=urn:btih:d69f91e6b2ae4c542468d1073a71d4ea13879a7f&dn=sample.txt&tr=...
+// - magnet sample.torrent --base32 -> magnet:?xt=urn:btih:22PZDZVSVZGFIJDI2EDTU4OU5IJYPGT7&dn=sample.txt&tr=...
+func runMagnet(args []string, w io.Writer) error {
+	var base32 bool
+
+	fs := flag.NewFlagSet("magnet", flag.ContinueOnError)
+	fs.BoolVar(&base32, "base32", false, "write the info hash in base32 instead of hex")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: magnet <torrent> [--base32]")
+	}
+
+	m, err := LoadTorrent(positional[0])
+	if err != nil {
+		return err
+	}
+
+	if base32 {
+		fmt.Fprintln(w, m.MagnetLinkBase32())
+	} else {
+		fmt.Fprintln(w, m.MagnetLink())
+	}
+
+	return nil
+}
+
+// Example:
+// - validate sample.torrent -> ok
+// - validate truncated.torrent -> error: pieces length 39 is not a multiple of 20
+func runValidate(args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: validate <torrent>")
+	}
+
+	content, err := readTorrent(args[0])
+	if err != nil {
+		return err
+	}
+	m, err := loadMetainfo(content)
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range m.Info.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+	errs := ValidateMetainfo(m)
+	numErrors := 0
+	for _, err := range errs {
+		if isValidationWarning(err) {
+			fmt.Fprintf(w, "warning: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(w, "error: %v\n", err)
+		numErrors++
+	}
+	if numErrors > 0 {
+		return withExitCode(exitVerification, errors.New("torrent failed validation"))
+	}
+	fmt.Fprintln(w, "ok")
+
+	return nil
+}
+
+// Example:
+// - info sample.torrent
+// - info sample.torrent --with-index -> piece hashes are printed as "0: <hash>"
+// - info sample.torrent --info-hash-only -> d69f91e6b2ae4c542468d1073a71d4ea13879a7f
+// - info sample.torrent --piece 2 -> Piece 2: length=26527 sha1=f00d937a0213df1982bc8d097227ad9e909acc17
+// - info sample.torrent --piece 2 --json -> {"index":2,"length":26527,"sha1":"f00d937a0213df1982bc8d097227ad9e909acc17"}
+// - info https://example.com/debian.torrent -> fetches the torrent first, as every command does for a URL
+// - info multi.torrent -> also lists the files as a tree under "multi/", with their total
+// - info multi.torrent --human --limit 10 -> sizes like "68.4 KiB", then "... and 490 more files"
+// - info padded.torrent --show-padding -> also lists the padding files, as "100 (100 bytes, padding)"
+// - --verbose info sample.torrent -> also "Info Hash (base32): 22PZDZVSVZGFIJDI2EDTU4OU5IJYPGT7"
+// - --strict info dirty.torrent -> error: syntax error at byte 17: invalid integer "016": leading zero
+func runInfo(args []string, w io.Writer) error {
+	var (
+		withIndex, infoHashOnly bool
+		tree                    fileTreeOptions
+		pieceIdx                int
+		jsonOutput              bool
+	)
+
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	fs.BoolVar(&withIndex, "with-index", false, "prefix each piece hash with its index")
+	fs.BoolVar(&infoHashOnly, "info-hash-only", false, "print only the info hash")
+	fs.IntVar(&pieceIdx, "piece", 0, "print only the length and hash of the piece at this index")
+	fs.BoolVar(&jsonOutput, "json", false, "with --piece, print the piece as a JSON object")
+	fs.BoolVar(&tree.showPadding, "show-padding", false, "also list the padding files of a multi-file torrent")
+	fs.BoolVar(&tree.human, "human", false, "write file sizes in KiB, MiB and so on")
+	fs.IntVar(&tree.limit, "limit", 0, "list at most this many files; 0 lists them all")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: info <torrent> [--with-index] [--info-hash-only] [--show-padding] [--human] [--limit n] [--piece n [--json]]")
+	}
+	if tree.limit < 0 {
+		return fmt.Errorf("invalid --limit %d: must not be negative", tree.limit)
+	}
+	onePiece := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "piece" {
+			onePiece = true
+		}
+	})
+	if jsonOutput && !onePiece {
+		return errors.New("--json is only supported with --piece")
+	}
+
+	if infoHashOnly {
+		infoHash, err := infoHashOfFile(positional[0])
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%x\n", infoHash)
+
+		return nil
+	}
+
+	m, err := LoadTorrent(positional[0])
+	if err != nil {
+		return err
+	}
+	info := m.Info
+
+	for _, warning := range info.Warnings {
+		warnf("%s", warning)
+	}
+
+	if onePiece {
+		return writePiece(w, info, pieceIdx, jsonOutput)
+	}
+
+	// A trackerless torrent has its DHT nodes listed instead.
+	if m.Announce != "" {
+		fmt.Fprintf(w, "Tracker URL: %s\n", m.Announce)
+	}
+	writeAnnounceList(w, m)
+	if len(info.WebSeeds) > 0 || len(info.HTTPSeeds) > 0 {
+		fmt.Fprintln(w, "Web Seeds:")
+		for _, seed := range info.WebSeeds {
+			fmt.Fprintf(w, "  %s (url-list)\n", seed)
+		}
+		for _, seed := range info.HTTPSeeds {
+			fmt.Fprintf(w, "  %s (httpseeds)\n", seed)
+		}
+	}
+	if len(info.Nodes) > 0 {
+		fmt.Fprintln(w, "DHT Nodes:")
+		for _, node := range info.Nodes {
+			fmt.Fprintf(w, "  %s\n", node)
+		}
+	}
+	fmt.Fprintf(w, "Length: %d\n", info.Length)
+	fmt.Fprintf(w, "Info Hash: %s\n", info.HashHex())
+	if verbose {
+		fmt.Fprintf(w, "Info Hash (base32): %s\n", info.HashBase32())
+	}
+	if info.MetaVersion == metaVersionV2 {
+		fmt.Fprintf(w, "Meta Version: %d\n", info.MetaVersion)
+		if !info.IsV2Only() {
+			fmt.Fprintf(w, "Info Hash v1: %x\n", info.InfoHashV1)
+		}
+		fmt.Fprintf(w, "Info Hash v2: %x\n", info.InfoHashV2)
+	}
+	fmt.Fprintf(w, "Piece Length: %d\n", info.PieceLength)
+	writeOptionalFields(w, m)
+	if info.Files != nil {
+		fmt.Fprintln(w, "Files:")
+		writeFileTree(w, info, tree)
+	}
+	fmt.Fprintln(w, "Piece Hashes:")
+	writePieceHashes(w, info, withIndex)
+
+	return nil
+}
+
+// writePiece writes the expected length and hash of the piece at index i, as
+// a line or as a JSON object.
+//
+// Example:
+// - 7 -> Piece 7: length=262144 sha1=<40 hex digits>
+// - 7 with asJSON -> {"index":7,"length":262144,"sha1":"<40 hex digits>"}
+func writePiece(w io.Writer, info *Info, i int, asJSON bool) error {
+	hash, err := info.PieceHash(i)
+	if err != nil {
+		return err
+	}
+
+	if !asJSON {
+		fmt.Fprintf(w, "Piece %d: length=%d sha1=%x\n", i, info.PieceSize(i), hash)
+		return nil
+	}
+
+	b, err := json.Marshal(struct {
+		Index  int    `json:"index"`
+		Length int    `json:"length"`
+		SHA1   string `json:"sha1"`
+	}{Index: i, Length: info.PieceSize(i), SHA1: hex.EncodeToString(hash[:])})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", b)
+
+	return nil
+}
+
+// writeAnnounceList writes the tracker tiers, one URL per line under each
+// tier, unless they are just the single tier of Announce.
+func writeAnnounceList(w io.Writer, m *Metainfo) {
+	if len(m.AnnounceList) == 0 ||
+		len(m.AnnounceList) == 1 && len(m.AnnounceList[0]) == 1 && m.AnnounceList[0][0] == m.Announce {
+		return
+	}
+
+	fmt.Fprintln(w, "Announce List:")
+	for i, tier := range m.AnnounceList {
+		fmt.Fprintf(w, "Tier %d:\n", i+1)
+		for _, u := range tier {
+			fmt.Fprintf(w, "  %s\n", u)
+		}
+	}
+}
+
+// writeOptionalFields writes the fields a torrent may leave out, skipping
+// those it does.
+func writeOptionalFields(w io.Writer, m *Metainfo) {
+	info := m.Info
+	if info.Name != "" {
+		fmt.Fprintf(w, "Name: %s\n", info.Name)
+	}
+	if m.Comment != "" {
+		fmt.Fprintf(w, "Comment: %s\n", m.Comment)
+	}
+	if m.CreatedBy != "" {
+		fmt.Fprintf(w, "Created By: %s\n", m.CreatedBy)
+	}
+	if !m.CreationDate.IsZero() {
+		fmt.Fprintf(w, "Creation Date: %s\n", m.CreationDate.Format(time.RFC3339))
+	}
+	if m.Encoding != "" {
+		fmt.Fprintf(w, "Encoding: %s\n", m.Encoding)
+	}
+	if info.Private {
+		fmt.Fprintln(w, "Private: yes")
+	}
+	if info.Source != "" {
+		fmt.Fprintf(w, "Source: %s\n", info.Source)
+	}
+}
+
+// writePieceHashes writes the hex hash of every piece on its own line.
+func writePieceHashes(w io.Writer, info *Info, withIndex bool) {
+	if !withIndex {
+		io.WriteString(w, info.HashesHex())
+		return
+	}
+	for i, hash := range info.PieceHashes {
+		fmt.Fprintf(w, "%d: %x\n", i, hash)
+	}
+}
+
+// Example:
+// - peers sample.torrent
+// - peers sample.torrent --compact 0
+func runPeers(args []string, w io.Writer) error {
+	var (
+		announce = defaultAnnounceOptions()
+		network  networkOptions
+	)
 
-		conn, err := net.Dial("tcp", peers[1])
+	fs := flag.NewFlagSet("peers", flag.ContinueOnError)
+	announce.registerFlags(fs)
+	network.registerFlags(fs)
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: peers <torrent> [--compact 0|1]")
+	}
+	err = announce.validate()
+	if err != nil {
+		return err
+	}
+	announce.client, err = network.httpClient()
+	if err != nil {
+		return err
+	}
+
+	m, err := LoadTorrent(positional[0])
+	if err != nil {
+		return err
+	}
+	info := m.Info
+	if err := checkV1(info); err != nil {
+		return err
+	}
+
+	peers, err := getPeers(m, announce)
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range peers {
+		fmt.Fprintln(w, peer)
+	}
+
+	return nil
+}
+
+// Example:
+// - handshake sample.torrent 127.0.0.1:6881
+// - handshake sample.torrent 127.0.0.1:6881 --expect-peer-id 2d524e302e302e302d...
+// - handshake sample.torrent --peers-file peers.txt --require-all
+func runHandshake(args []string, w io.Writer) error {
+	var (
+		expectedPeerIDHex string
+		peersFilepath     string
+		requireAll        bool
+		timeout           time.Duration
+		network           networkOptions
+	)
+
+	fs := flag.NewFlagSet("handshake", flag.ContinueOnError)
+	network.registerFlags(fs)
+	fs.StringVar(&expectedPeerIDHex, "expect-peer-id", "", "fail unless the peer id matches this hex value")
+	fs.StringVar(&peersFilepath, "peers-file", "", "handshake with every address listed in this file, one per line")
+	// Not --strict, which is the global flag for checking torrents and so
+	// never reaches this flag set.
+	fs.BoolVar(&requireAll, "require-all", false, "with --peers-file, fail if any handshake fails")
+	fs.DurationVar(&timeout, "timeout", 5*time.Second, "per-peer connect and handshake timeout")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if (peersFilepath == "" && len(positional) != 2) || (peersFilepath != "" && len(positional) != 1) {
+		return errors.New("usage: handshake <torrent> (<peer> | --peers-file path [--require-all]) [--expect-peer-id hex]")
+	}
+
+	expectedPeerID, err := hex.DecodeString(expectedPeerIDHex)
+	if err != nil {
+		return fmt.Errorf("invalid --expect-peer-id: %w", err)
+	}
+	if len(expectedPeerID) != 0 && len(expectedPeerID) != peerIDLen {
+		return fmt.Errorf("invalid --expect-peer-id: must be %d bytes, got %d", peerIDLen, len(expectedPeerID))
+	}
+
+	dialer, err := network.dialer()
+	if err != nil {
+		return err
+	}
+
+	m, err := LoadTorrent(positional[0])
+	if err != nil {
+		return err
+	}
+	info := m.Info
+
+	if peersFilepath == "" {
+		buf, err := handshakePeer(dialer, positional[1], info, expectedPeerID, timeout)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
-		defer conn.Close()
 
-		_, err = handshake(conn, torrentFilepath)
+		fmt.Fprintf(w, "Peer ID: %x\n", string(buf))
+
+		return nil
+	}
+
+	peers, err := readPeersFile(peersFilepath)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, peer := range peers {
+		buf, err := handshakePeer(dialer, peer, info, expectedPeerID, timeout)
 		if err != nil {
-			fmt.Println(err)
-			return
+			failed++
+			fmt.Fprintf(w, "%s: error: %v\n", peer, err)
+			continue
 		}
 
-		_, err = waitPeerMessage(conn, bitfield)
-		if err != nil {
-			fmt.Println(err)
-			return
+		fmt.Fprintf(w, "%s: Peer ID: %x\n", peer, string(buf))
+	}
+
+	if requireAll && failed > 0 {
+		return withExitCode(exitNetwork, fmt.Errorf("%d of %d handshakes failed", failed, len(peers)))
+	}
+
+	return nil
+}
+
+// handshakePeer connects to peer and performs the handshake, giving up once
+// timeout has elapsed.
+func handshakePeer(dialer *net.Dialer, peer string, info *Info, expectedPeerID []byte, timeout time.Duration) ([]byte, error) {
+	d := *dialer
+	d.Timeout = timeout
+
+	conn, err := d.Dial("tcp", peer)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	return handshakeWithPeerID(conn, info, expectedPeerID)
+}
+
+// readPeersFile reads one peer address per line, skipping blank lines and
+// lines starting with '#'.
+func readPeersFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers = append(peers, line)
+	}
+
+	return peers, nil
+}
+
+type downloadPieceArgs struct {
+	outputFilepath  string
+	outDir          string
+	torrentFilepath string
+	pieceIdx        int
+	announce        announceOptions
+	network         networkOptions
+}
+
+// Example:
+// - download_piece -o /tmp/test-piece-0 sample.torrent 0
+// - download_piece sample.torrent 0 -> writes sample.txt.piece0
+// - download_piece --out-dir /tmp sample.torrent 0 -> writes /tmp/sample.txt.piece0
+func parseDownloadPieceArgs(args []string) (*downloadPieceArgs, error) {
+	ret := &downloadPieceArgs{announce: defaultAnnounceOptions()}
+
+	fs := flag.NewFlagSet("download_piece", flag.ContinueOnError)
+	fs.StringVar(&ret.outputFilepath, "o", "", "output file path")
+	fs.StringVar(&ret.outDir, "out-dir", "", "without -o, the directory to write the piece to instead of the current one")
+	ret.announce.registerFlags(fs)
+	ret.network.registerFlags(fs)
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) != 2 {
+		return nil, errors.New("usage: download_piece [-o output | --out-dir dir] <torrent> <piece index>")
+	}
+
+	ret.torrentFilepath = positional[0]
+	ret.pieceIdx, err = strconv.Atoi(positional[1])
+	if err != nil {
+		return nil, err
+	}
+
+	err = ret.announce.validate()
+	if err != nil {
+		return nil, err
+	}
+	ret.announce.client, err = ret.network.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// pieceOutputPath returns outputFilepath when it is set, and otherwise a
+// "<name>.piece<index>" file in outDir, or the current directory when outDir
+// is empty.
+func pieceOutputPath(outputFilepath, outDir string, info *Info, pieceIdx int) string {
+	if outputFilepath != "" {
+		return outputFilepath
+	}
+
+	return filepath.Join(outDir, fmt.Sprintf("%s.piece%d", outputName(info), pieceIdx))
+}
+
+// outputName returns the name of the torrent to save its content under in the
+// current directory. Name comes from the torrent file, so path separators in
+// it are replaced to keep it from pointing elsewhere, and a name that would
+// still not be a file of its own falls back to the hex info hash.
+func outputName(info *Info) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, info.Name)
+	if name == "" || name == "." || name == ".." {
+		return fmt.Sprintf("%x", info.InfoHash)
+	}
+
+	return name
+}
+
+func runDownloadPiece(args []string) error {
+	parsed, err := parseDownloadPieceArgs(args)
+	if err != nil {
+		return err
+	}
+
+	pieceIdx := parsed.pieceIdx
+
+	m, err := LoadTorrent(parsed.torrentFilepath)
+	if err != nil {
+		return err
+	}
+	info := m.Info
+	if err := checkV1(info); err != nil {
+		return err
+	}
+
+	// Checking the index first keeps an out of range one from reaching the
+	// peer.
+	want, err := info.PieceHash(pieceIdx)
+	if err != nil {
+		return err
+	}
+
+	outputFilepath := pieceOutputPath(parsed.outputFilepath, parsed.outDir, info, pieceIdx)
+
+	peers, err := getPeers(m, parsed.announce)
+	if err != nil {
+		return err
+	}
+
+	dialer, err := parsed.network.dialer()
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialPieceSource(dialer, peers, info)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = sendPeerMessage(conn, interested, []byte{})
+	if err != nil {
+		return err
+	}
+
+	_, err = waitPeerMessage(conn, unchoke)
+	if err != nil {
+		return err
+	}
+
+	const blockSize = 16 * 1024
+
+	size := info.PieceSize(pieceIdx)
+	count := 0
+	for begin := 0; begin < size; begin += blockSize {
+		length := blockSize
+		if begin+length > size {
+			length = size - begin
 		}
 
-		err = sendPeerMessage(conn, interested, []byte{})
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint32(payload[0:4], uint32(pieceIdx))
+		binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+		binary.BigEndian.PutUint32(payload[8:], uint32(length))
+
+		err = sendPeerMessage(conn, request, payload)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
 
-		_, err = waitPeerMessage(conn, unchoke)
+		count++
+	}
+
+	combinedBlock := make([]byte, size)
+	for i := 0; i < count; i++ {
+		payload, err := waitPeerMessage(conn, piece)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
+		}
+
+		index := binary.BigEndian.Uint32(payload[0:4])
+		if index != uint32(pieceIdx) {
+			return fmt.Errorf("unexpected index. exp: %d, got: %d", pieceIdx, index)
 		}
+		begin := binary.BigEndian.Uint32(payload[4:8])
+		block := payload[8:]
+		if int64(begin)+int64(len(block)) > int64(size) {
+			return fmt.Errorf("block at %d of length %d overruns piece %d of size %d", begin, len(block), pieceIdx, size)
+		}
+		copy(combinedBlock[begin:], block)
+	}
 
-		const blockSize = 16 * 1024
+	if sha1.Sum(combinedBlock) != want {
+		return withExitCode(exitVerification, errors.New("invalid piece hash"))
+	}
 
-		offset, count := 0, 0
-		for {
-			offset += blockSize
+	if parsed.outDir != "" {
+		if err := os.MkdirAll(parsed.outDir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	err = os.WriteFile(outputFilepath, combinedBlock, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot write piece to %s: %w", outputFilepath, err)
+	}
 
-			payload := make([]byte, 12)
-			binary.BigEndian.PutUint32(payload[0:4], uint32(pieceIdx))
-			binary.BigEndian.PutUint32(payload[4:8], uint32(offset))
-			binary.BigEndian.PutUint32(payload[8:], blockSize)
+	return nil
+}
 
-			err = sendPeerMessage(conn, request, payload)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+// errPeerClosed is returned for a peer that hangs up right after the
+// handshake, which connection-limited seeds do instead of sending a bitfield.
+var errPeerClosed = errors.New("peer closed the connection after the handshake")
 
-			if offset >= info.PieceLength {
-				break
-			}
+// closedAfterHandshake turns the EOF of a peer hanging up before its bitfield
+// into errPeerClosed.
+func closedAfterHandshake(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errPeerClosed
+	}
+	return err
+}
 
-			count++
+// dialPieceSource returns a connection to the first of peers that completes
+// the handshake and sends its bitfield. Peers that cannot be reached, or that
+// hang up, are skipped.
+func dialPieceSource(dialer *net.Dialer, peers []string, info *Info) (net.Conn, error) {
+	lastErr := errors.New("tracker returned no peers")
+	for _, peer := range peers {
+		conn, err := openPieceSource(dialer, peer, info)
+		if err == nil {
+			return conn, nil
 		}
 
-		combinedBlock := make([]byte, info.PieceLength)
-		for i := 0; i < count; i++ {
-			payload, err := waitPeerMessage(conn, piece)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+		warnf("skipping peer %s: %v", peer, err)
+		lastErr = err
+	}
+
+	return nil, withExitCode(exitNetwork, fmt.Errorf("no usable peer: %w", lastErr))
+}
+
+func openPieceSource(dialer *net.Dialer, peer string, info *Info) (net.Conn, error) {
+	conn, err := dialer.Dial("tcp", peer)
+	if err != nil {
+		return nil, err
+	}
+
+	// A peer that neither hangs up nor sends its bitfield must not hold
+	// up the others.
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	_, err = handshake(conn, info, clientPeerID)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_, err = waitPeerMessage(conn, bitfield)
+	if err != nil {
+		conn.Close()
+		return nil, closedAfterHandshake(err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// Example:
+// - download -o /tmp/sample.txt sample.torrent
+// - download sample.torrent -> writes sample.txt
+// - download -o /tmp/sample.txt --manifest /tmp/sample.sha1 sample.torrent
+// - --verbose download --manifest /tmp/sample.sha1 sample.torrent -> lines also name the peer and time of each piece
+// - download --fsync sample.torrent -> syncs sample.txt.part, then renames it
+// - download multi.torrent -> writes multi/dir/a.bin and the other files, but no padding files
+// - download --out-dir /tmp sample.torrent -> writes /tmp/sample.txt
+func runDownload(args []string, w io.Writer) error {
+	var (
+		outputFilepath   string
+		outDir           string
+		manifestFilepath string
+		stallTimeout     time.Duration
+		announce         = defaultAnnounceOptions()
+		network          networkOptions
+		strategyName     string
+		fsync            bool
+		maxBlock         int
+	)
+
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	fs.StringVar(&outputFilepath, "o", "", "output file path, or directory of a multi-file torrent")
+	fs.StringVar(&outDir, "out-dir", "", "without -o, the directory to save the download to instead of the current one")
+	fs.StringVar(&manifestFilepath, "manifest", "", "after a successful download, write each piece index and its SHA-1 to this file")
+	fs.DurationVar(&stallTimeout, "stall-timeout", defaultStallTimeout, "re-announce when no piece completes for this long")
+	fs.StringVar(&strategyName, "strategy", defaultStrategy, "piece order: sequential, rarest or random")
+	fs.BoolVar(&fsync, "fsync", false, "flush the download to disk before moving it into place")
+	fs.IntVar(&maxBlock, "block-size", blockSize, "largest block to request from a peer, in bytes")
+	announce.registerFlags(fs)
+	network.registerFlags(fs)
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: download [-o output | --out-dir dir] <torrent>")
+	}
+	err = announce.validate()
+	if err != nil {
+		return err
+	}
+	announce.client, err = network.httpClient()
+	if err != nil {
+		return err
+	}
+	dialer, err := network.dialer()
+	if err != nil {
+		return err
+	}
+	strategy, err := parseStrategy(strategyName)
+	if err != nil {
+		return err
+	}
+	if maxBlock <= 0 || maxBlock > maxBlockSize {
+		return fmt.Errorf("invalid --block-size %d: must be between 1 and %d", maxBlock, maxBlockSize)
+	}
+	torrentFilepath := positional[0]
+
+	m, err := LoadTorrent(torrentFilepath)
+	if err != nil {
+		return err
+	}
+	info := m.Info
+	if err := checkV1(info); err != nil {
+		return err
+	}
 
-			index := binary.BigEndian.Uint32(payload[0:4])
-			if index != uint32(pieceIdx) {
-				fmt.Printf("unexpected index. exp: %d, got: %d\n", pieceIdx, index)
-				return
+	if outputFilepath == "" {
+		if outDir != "" {
+			if err := os.MkdirAll(outDir, os.ModePerm); err != nil {
+				return err
 			}
-			begin := binary.BigEndian.Uint32(payload[4:8])
-			block := payload[8:]
-			copy(combinedBlock[begin:], block)
 		}
+		outputFilepath = filepath.Join(outDir, outputName(info))
+	}
+
+	peers, err := getPeers(m, announce)
+	if err != nil {
+		return err
+	}
+
+	d := newDownloader(info, peers)
+	d.dialer = dialer
+	d.strategy = strategy
+	d.blockSize = maxBlock
+	d.stallTimeout = stallTimeout
+	d.announce = func() ([]string, error) {
+		return getPeers(m, announce)
+	}
 
-		sum := sha1.Sum(combinedBlock)
-		sumStr := string(sum[:])
-		if sumStr != info.PieceHashes {
-			// ToDo: FIX combinedBlock hash is always invalid
-			fmt.Println("invalid piece hash")
-			return
+	buf, err := d.download()
+	if err != nil {
+		return err
+	}
+
+	if info.Files != nil {
+		err = writeFiles(outputFilepath, info, buf, fsync)
+	} else {
+		err = writeFileAtomic(outputFilepath, buf, fsync)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write download to %s: %w", outputFilepath, err)
+	}
+
+	if manifestFilepath != "" {
+		var sources []pieceSource
+		if verbose {
+			sources = d.sources
 		}
 
-		err = os.WriteFile(outputFilepath, combinedBlock, os.ModePerm)
+		err = writeManifestFile(manifestFilepath, info, buf, sources)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return fmt.Errorf("cannot write manifest to %s: %w", manifestFilepath, err)
 		}
+	}
+
+	fmt.Fprintf(w, "Downloaded %s to %s.\n", torrentFilepath, outputFilepath)
+
+	return nil
+}
+
+// run executes the command in args and returns the exit code for its result,
+// which is printed to errOutput when it is an error.
+//
+// Example:
+// - run([]string{"decode", "5:hello"}, os.Stdout) -> 0
+// - run([]string{"nope"}, os.Stdout) -> 1
+func run(args []string, stdout io.Writer) int {
+	args, global := parseGlobalFlags(args)
+	if err := global.check(); err != nil {
+		fmt.Fprintln(errOutput, err)
+		return exitUsage
+	}
+	global.apply()
+
+	if len(args) == 0 {
+		fmt.Fprintln(errOutput, "usage: mybittorrent <command> [arguments]")
+		return exitUsage
+	}
+
+	var err error
+	switch command := args[0]; command {
+	case "decode":
+		err = runDecode(args[1:], stdout)
+	case "info":
+		err = runInfo(args[1:], stdout)
+	case "reencode":
+		err = runReencode(args[1:], stdout)
+	case "difftorrent":
+		err = runDiffTorrent(args[1:], stdout)
+	case "validate":
+		err = runValidate(args[1:], stdout)
+	case "create":
+		err = runCreate(args[1:], stdout)
+	case "magnet":
+		err = runMagnet(args[1:], stdout)
+	case "peers":
+		err = runPeers(args[1:], stdout)
+	case "handshake":
+		err = runHandshake(args[1:], stdout)
+	case "download_piece":
+		err = runDownloadPiece(args[1:])
+	case "download":
+		err = runDownload(args[1:], stdout)
 	default:
-		fmt.Println("Unknown command: " + command)
-		os.Exit(1)
+		err = errors.New("Unknown command: " + command)
+	}
+
+	if err != nil {
+		fmt.Fprintln(errOutput, err)
 	}
+
+	return exitCode(err)
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout))
 }
@@ -1,8 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test_decodeBencode(t *testing.T) {
@@ -12,24 +29,2998 @@ func Test_decodeBencode(t *testing.T) {
 		want           interface{}
 		wantErr        bool
 	}{
-		{bencodedString: "5:hello", want: "hello"},
-		{bencodedString: "10:hello12345", want: "hello12345"},
-		{bencodedString: "i52e", want: 52},
-		{bencodedString: "i-52e", want: -52},
-		{bencodedString: "l5:helloi52ee", want: []interface{}{"hello", 52}},
-		{bencodedString: "d3:foo3:bar5:helloi52ee", want: map[string]interface{}{"hello": 52, "foo": "bar"}},
-		{bencodedString: "d3:foo10:strawberry5:helloi52ee", want: map[string]interface{}{"foo": "strawberry", "hello": 52}},
+		{bencodedString: "5:hello", want: []byte("hello")},
+		{bencodedString: "10:hello12345", want: []byte("hello12345")},
+		{bencodedString: "i52e", want: int64(52)},
+		{bencodedString: "i-52e", want: int64(-52)},
+		{bencodedString: "l5:helloi52ee", want: []interface{}{[]byte("hello"), int64(52)}},
+		{bencodedString: "d3:foo3:bar5:helloi52ee", want: map[string]interface{}{"hello": int64(52), "foo": []byte("bar")}},
+		{bencodedString: "d3:foo10:strawberry5:helloi52ee", want: map[string]interface{}{"foo": []byte("strawberry"), "hello": int64(52)}},
+		{bencodedString: "lli1eei2ee", want: []interface{}{[]interface{}{int64(1)}, int64(2)}},
+		{bencodedString: "ld2:ipi1eed2:ipi2eee", want: []interface{}{map[string]interface{}{"ip": int64(1)}, map[string]interface{}{"ip": int64(2)}}},
+		{bencodedString: "l1:ee", want: []interface{}{[]byte("e")}},
+		{bencodedString: "l1:e2:eee", want: []interface{}{[]byte("e"), []byte("ee")}},
+		{bencodedString: "d1:e1:ee", want: map[string]interface{}{"e": []byte("e")}},
+		{bencodedString: "d0:i1ee", want: map[string]interface{}{"": int64(1)}},
+		{bencodedString: "3:abc", want: []byte("abc")},
+		{bencodedString: "le", want: []interface{}{}},
+		{bencodedString: "de", want: map[string]interface{}{}},
+		{bencodedString: "0:", want: []byte{}},
+		{bencodedString: "d0:0:e", want: map[string]interface{}{"": []byte{}}},
+		{bencodedString: "l0:e", want: []interface{}{[]byte{}}},
+		{bencodedString: "d1:adee", want: map[string]interface{}{"a": map[string]interface{}{}}},
+		{bencodedString: "l1:e", wantErr: true},
+		{bencodedString: "d1:ee", wantErr: true},
+		{bencodedString: "di1ei2ee", wantErr: true},
+		{bencodedString: "5:abc", wantErr: true},
+		{bencodedString: "i12", wantErr: true},
+		{bencodedString: "", wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, _, err := decodeBencode(tt.bencodedString)
+			got, consumed, err := decodeBencode([]byte(tt.bencodedString))
 			if (err != nil) != tt.wantErr {
 				t.Errorf("decodeBencode() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if err != nil {
+				return
+			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("decodeBencode() got = %v, want %v", got, tt.want)
 			}
+			if consumed != len(tt.bencodedString) {
+				t.Errorf("decodeBencode() consumed = %d, want %d", consumed, len(tt.bencodedString))
+			}
+		})
+	}
+}
+
+const sampleTorrent = "../../sample.torrent"
+
+func Test_parseDownloadPieceArgs(t *testing.T) {
+	info, err := parseToInfo(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		args           []string
+		wantOutputPath string
+		wantPieceIdx   int
+		wantErr        bool
+	}{
+		{name: "with -o", args: []string{"-o", "/tmp/test-piece-0", sampleTorrent, "0"}, wantOutputPath: "/tmp/test-piece-0"},
+		{name: "without -o", args: []string{sampleTorrent, "0"}, wantOutputPath: "sample.txt.piece0"},
+		{name: "without -o and other index", args: []string{sampleTorrent, "2"}, wantOutputPath: "sample.txt.piece2", wantPieceIdx: 2},
+		{name: "-o after positional", args: []string{sampleTorrent, "1", "-o", "out"}, wantOutputPath: "out", wantPieceIdx: 1},
+		{name: "--out-dir", args: []string{"--out-dir", "pieces", sampleTorrent, "0"}, wantOutputPath: filepath.Join("pieces", "sample.txt.piece0")},
+		{name: "-o wins over --out-dir", args: []string{"--out-dir", "pieces", "-o", "out", sampleTorrent, "0"}, wantOutputPath: "out"},
+		{name: "missing piece index", args: []string{sampleTorrent}, wantErr: true},
+		{name: "invalid piece index", args: []string{sampleTorrent, "x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDownloadPieceArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseDownloadPieceArgs() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if got.pieceIdx != tt.wantPieceIdx {
+				t.Errorf("parseDownloadPieceArgs() pieceIdx = %v, want %v", got.pieceIdx, tt.wantPieceIdx)
+			}
+			if path := pieceOutputPath(got.outputFilepath, got.outDir, info, got.pieceIdx); path != tt.wantOutputPath {
+				t.Errorf("pieceOutputPath() = %v, want %v", path, tt.wantOutputPath)
+			}
+		})
+	}
+}
+
+func Test_outputName(t *testing.T) {
+	info := &Info{InfoHash: [sha1.Size]byte{0xab}}
+	hashName := fmt.Sprintf("%x", info.InfoHash)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "sample.txt", want: "sample.txt"},
+		{name: "../../etc/passwd", want: ".._.._etc_passwd"},
+		{name: `..\evil.exe`, want: ".._evil.exe"},
+		{name: "/abs", want: "_abs"},
+		{name: "nul\x00byte", want: "nul_byte"},
+		{name: "..", want: hashName},
+		{name: ".", want: hashName},
+		{name: "", want: hashName},
+	}
+	for _, tt := range tests {
+		info.Name = tt.name
+		if got := outputName(info); got != tt.want {
+			t.Errorf("outputName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// answerHandshake reads the client's handshake from conn and replies with the
+// same info hash and the given peer id.
+func answerHandshake(t *testing.T, conn net.Conn, peerID []byte) {
+	t.Helper()
+
+	buf := make([]byte, 68)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Error(err)
+		return
+	}
+	copy(buf[48:], peerID)
+	if _, err := conn.Write(buf); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_handshakeWithPeerID(t *testing.T) {
+	peerID := []byte("-TR2940-abcdefghijkl")
+	info, err := parseToInfo(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		expectedPeerID []byte
+		wantErr        bool
+	}{
+		{name: "no expectation", expectedPeerID: nil},
+		{name: "matching peer id", expectedPeerID: peerID},
+		{name: "mismatching peer id", expectedPeerID: []byte("-TR2940-000000000000"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go answerHandshake(t, server, peerID)
+
+			got, err := handshakeWithPeerID(client, info, tt.expectedPeerID)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handshakeWithPeerID() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && !bytes.Equal(got, peerID) {
+				t.Errorf("handshakeWithPeerID() got = %x, want %x", got, peerID)
+			}
+		})
+	}
+}
+
+func Test_handshake_sentMessage(t *testing.T) {
+	info, err := parseToInfo(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sent := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 68)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Error(err)
+		}
+		sent <- buf
+		server.Write(buf)
+	}()
+
+	if _, err := handshake(client, info, "-XX0001-abcdefghijkl"); err != nil {
+		t.Fatal(err)
+	}
+	got := <-sent
+	if infoHash := fmt.Sprintf("%x", got[28:48]); infoHash != "d69f91e6b2ae4c542468d1073a71d4ea13879a7f" {
+		t.Errorf("handshake() sent info hash %s", infoHash)
+	}
+	if peerID := string(got[48:]); peerID != "-XX0001-abcdefghijkl" {
+		t.Errorf("handshake() sent peer id %q", peerID)
+	}
+}
+
+func Test_runInfo(t *testing.T) {
+	torrent := newTestTorrentWithData(t, []byte("abcdefghijklmnop"), 8)
+
+	header := "Tracker URL: http://127.0.0.1/announce\n" +
+		"Length: 16\n" +
+		"Info Hash: ebb46a8a1b51b1672e195ca4c3ef307d6da1d329\n" +
+		"Piece Length: 8\n" +
+		"Name: test.bin\n" +
+		"Piece Hashes:\n"
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "plain",
+			args: []string{torrent.path},
+			want: header +
+				"425af12a0743502b322e93a015bcf868e324d56a\n" +
+				"996539b7e0d1fc3bbea47e4cbbbbe243bffe0814\n",
+		},
+		{
+			name: "with index",
+			args: []string{torrent.path, "--with-index"},
+			want: header +
+				"0: 425af12a0743502b322e93a015bcf868e324d56a\n" +
+				"1: 996539b7e0d1fc3bbea47e4cbbbbe243bffe0814\n",
+		},
+		{name: "missing torrent", args: []string{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			err := runInfo(tt.args, &out)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runInfo() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("runInfo() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestTracker serves announces for a test torrent, answering in compact or
+// dictionary form depending on the compact query parameter.
+func newTestTracker(t *testing.T, peers []string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resPeers interface{}
+		if r.URL.Query().Get("compact") == "1" {
+			compact := ""
+			for _, peer := range peers {
+				addr, err := net.ResolveTCPAddr("tcp", peer)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				compact += string(addr.IP.To4()) + string([]byte{byte(addr.Port >> 8), byte(addr.Port)})
+			}
+			resPeers = compact
+		} else {
+			list := []interface{}{}
+			for _, peer := range peers {
+				host, port, _ := net.SplitHostPort(peer)
+				var portNum int
+				fmt.Sscan(port, &portNum)
+				list = append(list, map[string]interface{}{"ip": host, "peer id": "-TS0001-000000000000", "port": portNum})
+			}
+			resPeers = list
+		}
+
+		bencoded, err := bencode(map[string]interface{}{"interval": 60, "peers": resPeers})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write(bencoded)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func Test_getPeers(t *testing.T) {
+	peers := []string{"127.0.0.1:6881", "10.0.0.2:51413"}
+
+	tests := []struct {
+		name    string
+		compact int
+	}{
+		{name: "compact", compact: 1},
+		{name: "dictionary", compact: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotCompact string
+			tracker := newTestTracker(t, peers)
+			handler := tracker.Config.Handler
+			tracker.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotCompact = r.URL.Query().Get("compact")
+				handler.ServeHTTP(w, r)
+			})
+
+			_, m := writeTestMetainfo(t, map[string]interface{}{
+				"announce": tracker.URL + "/announce",
+				"info": map[string]interface{}{
+					"length":       16,
+					"name":         "test.bin",
+					"piece length": 16,
+					"pieces":       strings.Repeat("x", 20),
+				},
+			})
+
+			opts := defaultAnnounceOptions()
+			opts.compact = tt.compact
+
+			got, err := getPeers(m, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotCompact != fmt.Sprint(tt.compact) {
+				t.Errorf("getPeers() sent compact=%s, want %d", gotCompact, tt.compact)
+			}
+			if !reflect.DeepEqual(got, peers) {
+				t.Errorf("getPeers() got = %v, want %v", got, peers)
+			}
+		})
+	}
+}
+
+func Test_parsePeers(t *testing.T) {
+	peer := func(ip string, port int64) map[string]interface{} {
+		return map[string]interface{}{"ip": []byte(ip), "peer id": []byte(clientPeerID), "port": port}
+	}
+
+	tests := []struct {
+		name    string
+		peers   interface{}
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "compact",
+			peers: []byte("\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\xc8\xd5"),
+			want:  []string{"127.0.0.1:6881", "10.0.0.2:51413"},
+		},
+		{
+			name:  "dictionaries",
+			peers: []interface{}{peer("127.0.0.1", 6881), peer("2001:db8::1", 51413), peer("peer.example", 6882)},
+			want:  []string{"127.0.0.1:6881", "[2001:db8::1]:51413", "peer.example:6882"},
+		},
+		{
+			name:  "empty list",
+			peers: []interface{}{},
+			want:  []string{},
+		},
+		{
+			name:  "empty compact",
+			peers: []byte{},
+			want:  []string{},
+		},
+		{
+			name:    "truncated compact",
+			peers:   []byte("\x7f\x00\x00\x01\x1a"),
+			wantErr: "unexpected peers string",
+		},
+		{
+			name:    "entry without port",
+			peers:   []interface{}{map[string]interface{}{"ip": []byte("127.0.0.1")}},
+			wantErr: `peer entry 0: missing key "port"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got []string
+				err error
+			)
+			switch peers := tt.peers.(type) {
+			case []byte:
+				got, err = parseCompactPeers(peers)
+			case []interface{}:
+				got, err = parseDictPeers(peers)
+			}
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getPeers_trailingNewline(t *testing.T) {
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e\r\n")
+	}))
+	defer tracker.Close()
+
+	_, m := writeTestMetainfo(t, map[string]interface{}{
+		"announce": tracker.URL + "/announce",
+		"info": map[string]interface{}{
+			"length":       16,
+			"name":         "test.bin",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+
+	got, err := getPeers(m, defaultAnnounceOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:6881"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getPeers() got = %v, want %v", got, want)
+	}
+}
+
+func Test_getPeers_invalidResponse(t *testing.T) {
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<html>502 Bad Gateway</html>")
+	}))
+	defer tracker.Close()
+
+	_, m := writeTestMetainfo(t, map[string]interface{}{
+		"announce": tracker.URL + "/announce",
+		"info": map[string]interface{}{
+			"length":       16,
+			"name":         "test.bin",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+
+	_, err := getPeers(m, defaultAnnounceOptions())
+	if err == nil || err.Error() != "tracker response is not valid bencode" {
+		t.Errorf("getPeers() error = %v", err)
+	}
+	if code := exitCode(err); code != exitNetwork {
+		t.Errorf("exitCode() = %d, want %d", code, exitNetwork)
+	}
+}
+
+func Test_parseToInfo_duplicatePieces(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{name: "distinct pieces", data: "abcdefghijkl", want: nil},
+		{
+			name: "duplicated piece",
+			data: "abcdefghabcdijkl",
+			want: []string{"pieces 0, 2 share the same hash 81fe8bfe87576c3ecb22426f8e57847382917acf"},
+		},
+		{
+			name: "several duplicates",
+			data: "aaaabbbbaaaabbbbaaaa",
+			want: []string{
+				"pieces 0, 2, 4 share the same hash 70c881d4a26984ddce795f6f71817c9cf4480e79",
+				"pieces 1, 3 share the same hash 8aed1322e5450badb078e1fb60a817a1df25a2ca",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrent := newTestTorrentWithData(t, []byte(tt.data), 4)
+			if !reflect.DeepEqual(torrent.info.Warnings, tt.want) {
+				t.Errorf("parseToInfo() warnings = %q, want %q", torrent.info.Warnings, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseToInfo_dictionaryKeys(t *testing.T) {
+	const info = "d6:lengthi4e4:name1:x12:piece lengthi4e6:pieces20:" + "aaaaaaaaaaaaaaaaaaaa" + "e"
+	tests := []struct {
+		name         string
+		content      string
+		wantErr      string
+		wantWarnings []string
+	}{
+		{
+			name:    "duplicate key",
+			content: "d8:announce1:a8:announce1:b4:info" + info + "e",
+			wantErr: `syntax error at byte 14: duplicate dictionary key "announce"`,
+		},
+		{
+			name:    "missing info",
+			content: "d8:announce1:ae",
+			wantErr: `missing key "info"`,
+		},
+		{
+			name:    "missing pieces",
+			content: "d8:announce1:a4:infod6:lengthi4e4:name1:x12:piece lengthi4eee",
+			wantErr: `missing key "pieces" under "info"`,
+		},
+		{
+			name:    "string length",
+			content: "d8:announce1:a4:infod6:length1:44:name1:x12:piece lengthi4e6:pieces0:ee",
+			wantErr: `"info.length": expected integer, got string`,
+		},
+		{
+			name:         "unsorted keys",
+			content:      "d4:info" + info + "8:announce17:http://a/announcee",
+			wantWarnings: []string{`dictionary key "announce" is out of order`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrentFilepath := filepath.Join(t.TempDir(), "test.torrent")
+			if err := os.WriteFile(torrentFilepath, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := parseToInfo(torrentFilepath)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("parseToInfo() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(info.Warnings, tt.wantWarnings) {
+				t.Errorf("parseToInfo() warnings = %q, want %q", info.Warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func Test_runHandshake_peersFile(t *testing.T) {
+	peerID := []byte("-TR2940-abcdefghijkl")
+
+	reachable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reachable.Close()
+	go func() {
+		for {
+			conn, err := reachable.Accept()
+			if err != nil {
+				return
+			}
+			answerHandshake(t, conn, peerID)
+			conn.Close()
+		}
+	}()
+
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable.Close()
+
+	peersFilepath := filepath.Join(t.TempDir(), "peers.txt")
+	content := reachable.Addr().String() + "\n\n# comment\n" + unreachable.Addr().String() + "\n"
+	if err := os.WriteFile(peersFilepath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		requireAll bool
+		wantErr    bool
+	}{
+		{name: "lenient", requireAll: false, wantErr: false},
+		{name: "require all", requireAll: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{sampleTorrent, "--peers-file", peersFilepath, "--timeout", "1s"}
+			if tt.requireAll {
+				args = append(args, "--require-all")
+			}
+
+			var out strings.Builder
+			err := runHandshake(args, &out)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runHandshake() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("runHandshake() printed %d lines, want 2: %q", len(lines), out.String())
+			}
+			if want := fmt.Sprintf("%s: Peer ID: %x", reachable.Addr(), peerID); lines[0] != want {
+				t.Errorf("runHandshake() line 1 = %q, want %q", lines[0], want)
+			}
+			if want := unreachable.Addr().String() + ": error: "; !strings.HasPrefix(lines[1], want) {
+				t.Errorf("runHandshake() line 2 = %q, want prefix %q", lines[1], want)
+			}
+		})
+	}
+
+	// The global --strict is taken out of the arguments wherever it is, so
+	// it must not be mistaken for --require-all.
+	defer func(saved io.Writer) { errOutput = saved }(errOutput)
+	defer func(saved bool) { strictTorrents = saved }(strictTorrents)
+	errOutput = io.Discard
+	runTests := []struct {
+		args []string
+		want int
+	}{
+		{args: []string{"handshake", sampleTorrent, "--peers-file", peersFilepath, "--timeout", "1s"}, want: exitOK},
+		{args: []string{"handshake", sampleTorrent, "--peers-file", peersFilepath, "--timeout", "1s", "--strict"}, want: exitOK},
+		{args: []string{"handshake", sampleTorrent, "--peers-file", peersFilepath, "--timeout", "1s", "--require-all"}, want: exitNetwork},
+		{args: []string{"--strict", "handshake", sampleTorrent, "--peers-file", peersFilepath, "--timeout", "1s", "--require-all"}, want: exitNetwork},
+	}
+	for _, tt := range runTests {
+		if got := run(tt.args, io.Discard); got != tt.want {
+			t.Errorf("run(%q) = %d, want %d", tt.args, got, tt.want)
+		}
+	}
+}
+
+func Test_runInfo_infoHashOnly(t *testing.T) {
+	defer func(saved bool) { protocolV2 = saved }(protocolV2)
+
+	tests := []struct {
+		name   string
+		global []string
+		path   string
+	}{
+		{name: "sample", path: sampleTorrent},
+		{name: "generated", path: newTestTorrent(t, 100000, 32*1024).path},
+		{name: "v2-only", path: "testdata/v2only.torrent"},
+		{name: "hybrid", path: "testdata/hybrid.torrent"},
+		{name: "hybrid by v2", global: []string{"--protocol", "v2"}, path: "testdata/hybrid.torrent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var full, hashOnly strings.Builder
+			if code := run(append(append([]string(nil), tt.global...), "info", tt.path), &full); code != 0 {
+				t.Fatalf("run(info) = %d", code)
+			}
+			if code := run(append(append([]string(nil), tt.global...), "info", tt.path, "--info-hash-only"), &hashOnly); code != 0 {
+				t.Fatalf("run(info --info-hash-only) = %d", code)
+			}
+
+			var want string
+			for _, line := range strings.Split(full.String(), "\n") {
+				if strings.HasPrefix(line, "Info Hash: ") {
+					want = strings.TrimPrefix(line, "Info Hash: ") + "\n"
+				}
+			}
+			if got := hashOnly.String(); got != want {
+				t.Errorf("runInfo(--info-hash-only) got = %q, want %q", got, want)
+			}
+		})
+	}
+
+	// Under --protocol v2 both give the truncated v2 hash of the hybrid.
+	var out strings.Builder
+	run([]string{"--protocol", "v2", "info", "testdata/hybrid.torrent", "--info-hash-only"}, &out)
+	if want := "a43bfe502b0cead349cc7073aec095e20e83220e\n"; out.String() != want {
+		t.Errorf("--protocol v2 info --info-hash-only got = %q, want %q", out.String(), want)
+	}
+}
+
+func Test_decodeBencode_nestedConsumed(t *testing.T) {
+	input := "d1:a" + "d1:b" + "d1:cli1e2:xye1:d0:e" + "1:ei-3ee" + "1:f1:ge"
+	got, consumed, err := decodeBencode([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumed != len(input) {
+		t.Errorf("decodeBencode() consumed = %d, want %d", consumed, len(input))
+	}
+
+	want := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": map[string]interface{}{
+				"c": []interface{}{int64(1), []byte("xy")},
+				"d": []byte(""),
+			},
+			"e": int64(-3),
+		},
+		"f": []byte("g"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeBencode() got = %v, want %v", got, want)
+	}
+}
+
+func Test_decodeBencode_integerErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		bencodedString string
+		wantOutOfRange bool
+	}{
+		{name: "above max int64", bencodedString: "i9223372036854775808e", wantOutOfRange: true},
+		{name: "below min int64", bencodedString: "i-9223372036854775809e", wantOutOfRange: true},
+		{name: "huge", bencodedString: "i123456789012345678901234567890e", wantOutOfRange: true},
+		{name: "malformed", bencodedString: "i12x4e", wantOutOfRange: false},
+		{name: "empty", bencodedString: "ie", wantOutOfRange: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeBencode([]byte(tt.bencodedString))
+			if err == nil {
+				t.Fatal("decodeBencode() error = nil, want an error")
+			}
+			if got := errors.Is(err, errIntegerOutOfRange); got != tt.wantOutOfRange {
+				t.Errorf("decodeBencode() error = %v, out of range = %v, want %v", err, got, tt.wantOutOfRange)
+			}
 		})
 	}
 }
+
+func Test_decodeBencode_syntaxErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		bencodedString string
+		wantOffset     int
+		wantMsg        string
+	}{
+		{name: "missing colon", bencodedString: "5hello", wantOffset: 1, wantMsg: "expected ':'"},
+		{name: "unterminated integer", bencodedString: "i42", wantOffset: 3, wantMsg: "unterminated integer"},
+		{name: "truncated string", bencodedString: "10:abc", wantOffset: 6, wantMsg: "string of length 10 runs past the end of input"},
+		{name: "nested missing colon", bencodedString: "d3:fool4:spam3eggee", wantOffset: 14, wantMsg: "expected ':'"},
+		{name: "nested truncated string", bencodedString: "li1e5:ab", wantOffset: 8, wantMsg: "string of length 5 runs past the end of input"},
+		{name: "non-string key", bencodedString: "d3:fooi1ei2ei3ee", wantOffset: 9, wantMsg: "dictionary key is an integer, not a string"},
+		{name: "integer key", bencodedString: "di1e3:fooe", wantOffset: 1, wantMsg: "dictionary key is an integer, not a string"},
+		{name: "list key", bencodedString: "dl1:aei1ee", wantOffset: 1, wantMsg: "dictionary key is a list, not a string"},
+		{name: "nested dictionary key", bencodedString: "ld1:ad1:bi1eedei1ee", wantOffset: 13, wantMsg: "dictionary key is a dictionary, not a string"},
+		{name: "unterminated list", bencodedString: "ll1:a", wantOffset: 5, wantMsg: "unterminated list"},
+		{name: "unterminated dictionary", bencodedString: "d3:foo3:bar", wantOffset: 11, wantMsg: "unterminated dictionary"},
+		{name: "length overflowing int64", bencodedString: "99999999999999999999:", wantOffset: 0, wantMsg: "string length 99999999999999999999 is out of range"},
+		{name: "length over the limit", bencodedString: "99999999999999:", wantOffset: 0, wantMsg: "string length 99999999999999 exceeds the limit of 1073741824"},
+		{name: "length one past the input", bencodedString: "4:abc", wantOffset: 5, wantMsg: "string of length 4 runs past the end of input"},
+		{name: "signed length", bencodedString: "+3:abc", wantOffset: 0, wantMsg: "unexpected '+'"},
+		{name: "sign inside length", bencodedString: "3-1:ab", wantOffset: 1, wantMsg: "expected ':'"},
+		{name: "key at end of input", bencodedString: "d3:foo", wantOffset: 6, wantMsg: `key "foo" has no value`},
+		{name: "key before end", bencodedString: "d3:fooe", wantOffset: 6, wantMsg: `key "foo" has no value`},
+		{name: "nested key before end", bencodedString: "d1:ad1:bee", wantOffset: 8, wantMsg: `key "b" has no value`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeBencode([]byte(tt.bencodedString))
+			var serr *SyntaxError
+			if !errors.As(err, &serr) {
+				t.Fatalf("decodeBencode() error = %v, want a *SyntaxError", err)
+			}
+			if serr.Offset != tt.wantOffset || serr.Msg != tt.wantMsg {
+				t.Errorf("decodeBencode() error at %d: %q, want at %d: %q", serr.Offset, serr.Msg, tt.wantOffset, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func Test_decodeBencode_malformed(t *testing.T) {
+	tests := []struct {
+		name           string
+		bencodedString string
+	}{
+		{name: "empty", bencodedString: ""},
+		{name: "truncated string", bencodedString: "5:ab"},
+		{name: "length only", bencodedString: "5"},
+		{name: "negative length", bencodedString: "-1:a"},
+		{name: "huge length", bencodedString: "9223372036854775807:a"},
+		{name: "length out of range", bencodedString: "99999999999999999999:a"},
+		{name: "unterminated integer", bencodedString: "i42"},
+		{name: "bare i", bencodedString: "i"},
+		{name: "unterminated list", bencodedString: "l5:hello"},
+		{name: "bare l", bencodedString: "l"},
+		{name: "unterminated dictionary", bencodedString: "d3:foo3:bar"},
+		{name: "dict key missing value", bencodedString: "d3:fooe"},
+		{name: "dict key without anything", bencodedString: "d3:foo"},
+		{name: "unknown type", bencodedString: "x"},
+		{name: "bare terminator", bencodedString: "e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := decodeBencode([]byte(tt.bencodedString))
+			if err == nil {
+				t.Errorf("decodeBencode() got = %v, want an error", got)
+			}
+		})
+	}
+}
+
+func Test_decodeBencode_canonicalIntegers(t *testing.T) {
+	tests := []struct {
+		name           string
+		bencodedString string
+		want           int64
+		wantErr        bool
+		wantLenient    int64
+	}{
+		{name: "zero", bencodedString: "i0e", want: 0, wantLenient: 0},
+		{name: "negative", bencodedString: "i-52e", want: -52, wantLenient: -52},
+		{name: "leading zero", bencodedString: "i03e", wantErr: true, wantLenient: 3},
+		{name: "negative leading zero", bencodedString: "i-03e", wantErr: true, wantLenient: -3},
+		{name: "double zero", bencodedString: "i00e", wantErr: true, wantLenient: 0},
+		{name: "negative zero", bencodedString: "i-0e", wantErr: true, wantLenient: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := decodeBencode([]byte(tt.bencodedString))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeBencode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("decodeBencode() got = %v, want %v", got, tt.want)
+			}
+
+			got, _, err = decodeBencodeWith([]byte(tt.bencodedString), decodeOptions{lenientIntegers: true})
+			if err != nil {
+				t.Fatalf("lenient decodeBencodeWith() error = %v", err)
+			}
+			if got != tt.wantLenient {
+				t.Errorf("lenient decodeBencodeWith() got = %v, want %v", got, tt.wantLenient)
+			}
+		})
+	}
+}
+
+func Test_decodeBencode_maxDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		return []byte(strings.Repeat("l", depth) + strings.Repeat("e", depth))
+	}
+
+	if _, _, err := decodeBencode(nested(defaultMaxDepth)); err != nil {
+		t.Errorf("decodeBencode() at the limit error = %v", err)
+	}
+
+	for _, input := range [][]byte{
+		nested(defaultMaxDepth + 1),
+		nested(10000),
+		[]byte(strings.Repeat("d1:k", 10000)),
+	} {
+		_, _, err := decodeBencode(input)
+		if !errors.Is(err, ErrMaxDepth) {
+			t.Errorf("decodeBencode() error = %v, want ErrMaxDepth", err)
+		}
+	}
+
+	_, _, err := decodeBencodeWith(nested(3), decodeOptions{maxDepth: 2})
+	var serr *SyntaxError
+	if !errors.As(err, &serr) || !errors.Is(err, ErrMaxDepth) || serr.Offset != 2 {
+		t.Errorf("decodeBencodeWith(maxDepth 2) error = %v, want ErrMaxDepth at byte 2", err)
+	}
+}
+
+func Test_decodeBencode_maxStringLength(t *testing.T) {
+	opts := decodeOptions{maxStringLength: 3}
+	if _, err := decodeStrictWith([]byte("3:abc"), opts); err != nil {
+		t.Errorf("decode of a string at the limit error = %v", err)
+	}
+	_, err := decodeStrictWith([]byte("l4:abcde"), opts)
+	if err == nil || err.Error() != "syntax error at byte 1: string length 4 exceeds the limit of 3" {
+		t.Errorf("decode of a string over the limit error = %v", err)
+	}
+}
+
+func Test_DecodeFirst(t *testing.T) {
+	tests := []struct {
+		data     string
+		want     interface{}
+		wantRest string
+	}{
+		{data: "d1:ai1eed1:bi2ee", want: map[string]interface{}{"a": int64(1)}, wantRest: "d1:bi2ee"},
+		{data: "i52ejunk", want: int64(52), wantRest: "junk"},
+		{data: "le\n", want: []interface{}{}, wantRest: "\n"},
+		{data: "0:", want: []byte{}, wantRest: ""},
+	}
+	for _, tt := range tests {
+		got, rest, err := DecodeFirst([]byte(tt.data))
+		if err != nil {
+			t.Fatalf("DecodeFirst(%q) error = %v", tt.data, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) || string(rest) != tt.wantRest {
+			t.Errorf("DecodeFirst(%q) = %v, %q, want %v, %q", tt.data, got, rest, tt.want, tt.wantRest)
+		}
+	}
+
+	if _, _, err := DecodeFirst([]byte("junk")); err == nil {
+		t.Error("DecodeFirst() of junk error = nil")
+	}
+}
+
+func Test_DecodeAll(t *testing.T) {
+	got, err := DecodeAll([]byte("d1:ai1eed1:bi2ee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{map[string]interface{}{"a": int64(1)}, map[string]interface{}{"b": int64(2)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeAll() got = %v, want %v", got, want)
+	}
+
+	if got, err := DecodeAll(nil); err != nil || len(got) != 0 {
+		t.Errorf("DecodeAll(nil) = %v, %v, want no values", got, err)
+	}
+
+	_, err = DecodeAll([]byte("d1:ai1eejunk"))
+	if err == nil || err.Error() != "syntax error at byte 8: unexpected 'j'" {
+		t.Errorf("DecodeAll() with trailing junk error = %v", err)
+	}
+}
+
+func Test_decodeBencode_anyKeys(t *testing.T) {
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{input: "de", want: map[interface{}]interface{}{}},
+		{input: "d3:foo3:bare", want: map[interface{}]interface{}{"foo": []byte("bar")}},
+		{input: "di1e1:a1:bi-2ee", want: map[interface{}]interface{}{int64(1): []byte("a"), "b": int64(-2)}},
+		{input: "ld1:adi2ei3eeee", want: []interface{}{map[interface{}]interface{}{"a": map[interface{}]interface{}{int64(2): int64(3)}}}},
+	}
+	for _, tt := range tests {
+		got, err := decodeStrictWith([]byte(tt.input), decodeOptions{anyKeys: true})
+		if err != nil {
+			t.Fatalf("decode of %q error = %v", tt.input, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decode of %q got = %#v, want %#v", tt.input, got, tt.want)
+		}
+
+		encoded, err := Marshal(got)
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		if string(encoded) != tt.input {
+			t.Errorf("round trip of %q got %q", tt.input, encoded)
+		}
+	}
+
+	if _, err := decodeStrictWith([]byte("dl1:ae1:be"), decodeOptions{anyKeys: true}); err == nil || err.Error() != "syntax error at byte 1: dictionary key is a list, not a string or integer" {
+		t.Errorf("decode of a list key error = %v", err)
+	}
+	if _, err := DecodeStrict([]byte("di1e1:ae")); err == nil {
+		t.Error("decode of an integer key without anyKeys error = nil")
+	}
+}
+
+func Test_decodeBencode_duplicateKeys(t *testing.T) {
+	input := []byte("d1:ai1e1:ai2ee")
+
+	got, _, err := decodeBencode(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"a": int64(2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeBencode() got = %v, want %v", got, want)
+	}
+
+	_, _, err = decodeBencodeWith(input, decodeOptions{rejectDuplicateKeys: true})
+	if err == nil || err.Error() != `syntax error at byte 7: duplicate dictionary key "a"` {
+		t.Errorf("decodeBencodeWith() error = %v", err)
+	}
+
+	var warnings []string
+	opts := decodeOptions{warnf: func(format string, a ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, a...))
+	}}
+	if _, _, err := decodeBencodeWith([]byte("d1:bi1e1:ai2ee"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`dictionary key "a" at byte 7 is out of order`}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+}
+
+func Test_runDecode_file(t *testing.T) {
+	content, err := os.ReadFile(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := runDecode([]string{string(content)}, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(saved io.Reader) { stdin = saved }(stdin)
+	stdin = bytes.NewReader(content)
+
+	for _, args := range [][]string{
+		{"-f", sampleTorrent},
+		{"-f", "-"},
+	} {
+		var buf bytes.Buffer
+		if err := runDecode(args, &buf); err != nil {
+			t.Fatalf("runDecode(%q) error = %v", args, err)
+		}
+		if buf.String() != want.String() {
+			t.Errorf("runDecode(%q) got = %q, want %q", args, buf.String(), want.String())
+		}
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"-f", sampleTorrent, "5:hello"},
+		{"5:hello", "5:world"},
+	} {
+		if err := runDecode(args, io.Discard); err == nil || !strings.HasPrefix(err.Error(), "usage:") {
+			t.Errorf("runDecode(%q) error = %v, want usage", args, err)
+		}
+	}
+}
+
+// update rewrites golden files with the current output: go test -update
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func Test_runDecode_pretty(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		golden string
+	}{
+		{name: "nested", input: "testdata/nested.torrent", golden: "testdata/nested.pretty.golden"},
+		{name: "sample", input: sampleTorrent, golden: "testdata/sample.pretty.golden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := runDecode([]string{"-f", tt.input, "--pretty"}, &buf); err != nil {
+				t.Fatal(err)
+			}
+
+			if *update {
+				if err := os.WriteFile(tt.golden, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(tt.golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != string(want) {
+				t.Errorf("runDecode() got:\n%s\nwant:\n%s", buf.String(), want)
+			}
+		})
+	}
+
+	err := runDecode([]string{"5:hello", "--pretty", "--binary=hex"}, io.Discard)
+	if err == nil {
+		t.Error("runDecode() with --pretty and --binary error = nil, want an error")
+	}
+}
+
+func Test_runDiffTorrent(t *testing.T) {
+	var buf bytes.Buffer
+	err := runDiffTorrent([]string{"testdata/diff_a.torrent", "testdata/diff_b.torrent"}, &buf)
+	if err == nil || exitCode(err) != exitVerification {
+		t.Errorf("runDiffTorrent() error = %v, want a verification error", err)
+	}
+
+	const golden = "testdata/difftorrent.golden"
+	if *update {
+		if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != string(want) {
+		t.Errorf("runDiffTorrent() got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := runDiffTorrent([]string{sampleTorrent, sampleTorrent}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "no differences\n" {
+		t.Errorf("runDiffTorrent() of the same torrent got %q", buf.String())
+	}
+}
+
+func Test_runDecode_syntaxError(t *testing.T) {
+	err := runDecode([]string{"d3:foo3bare"}, io.Discard)
+	if err == nil || err.Error() != "syntax error at byte 7: expected ':'" {
+		t.Errorf("runDecode() error = %v", err)
+	}
+
+	err = runDecode([]string{"dl1:aei1ee"}, io.Discard)
+	if err == nil || err.Error() != "syntax error at byte 1: dictionary key is a list, not a string" {
+		t.Errorf("runDecode() error = %v", err)
+	}
+}
+
+func Test_runDownload_manifest(t *testing.T) {
+	var (
+		torrent = newTestTorrent(t, 4*32*1024+100, 32*1024)
+		seeder  = newTestSeeder(t, torrent)
+		tracker = newTestTracker(t, []string{seeder.addr()})
+		dir     = t.TempDir()
+	)
+	torrentFilepath, _ := writeTestTorrentFile(t, map[string]interface{}{
+		"announce": tracker.URL + "/announce",
+		"info": map[string]interface{}{
+			"length":       torrent.info.Length,
+			"name":         torrent.info.Name,
+			"piece length": torrent.info.PieceLength,
+			"pieces":       torrent.info.Pieces,
+		},
+	})
+
+	var (
+		outputFilepath   = filepath.Join(dir, "out.bin")
+		manifestFilepath = filepath.Join(dir, "out.sha1")
+		out              strings.Builder
+	)
+	err := runDownload([]string{"-o", outputFilepath, "--manifest", manifestFilepath, torrentFilepath}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(manifestFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes strings.Builder
+	writePieceHashes(&hashes, torrent.info, true)
+	if want := strings.ReplaceAll(hashes.String(), ": ", " "); string(got) != want {
+		t.Errorf("manifest = %q, want %q", got, want)
+	}
+}
+
+func Test_runDownload_noManifestOnFailure(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	var (
+		tracker = newTestTracker(t, []string{dead.Addr().String()})
+		dir     = t.TempDir()
+	)
+	torrentFilepath, _ := writeTestTorrentFile(t, map[string]interface{}{
+		"announce": tracker.URL + "/announce",
+		"info": map[string]interface{}{
+			"length":       16,
+			"name":         "test.bin",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+
+	manifestFilepath := filepath.Join(dir, "out.sha1")
+	err = runDownload([]string{"-o", filepath.Join(dir, "out.bin"), "--manifest", manifestFilepath, torrentFilepath}, io.Discard)
+	if err == nil {
+		t.Fatal("runDownload() error = nil, want an error")
+	}
+	if _, err := os.Stat(manifestFilepath); !os.IsNotExist(err) {
+		t.Errorf("manifest exists after a failed download: %v", err)
+	}
+}
+
+func Test_parseToInfo_multiFile(t *testing.T) {
+	info, err := parseToInfo("testdata/multi.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantFiles := []FileEntry{
+		{Length: 1024, Path: []string{"a.bin"}},
+		{Length: 3000, Path: []string{"docs", "readme.txt"}},
+		{Length: 70000, Path: []string{"media", "video", "clip.mp4"}},
+	}
+	if !reflect.DeepEqual(info.Files, wantFiles) {
+		t.Errorf("parseToInfo() files = %+v, want %+v", info.Files, wantFiles)
+	}
+	if info.Length != 74024 || info.Name != "multi" {
+		t.Errorf("parseToInfo() length = %d, name = %q, want 74024, \"multi\"", info.Length, info.Name)
+	}
+
+	var out strings.Builder
+	if err := runInfo([]string{"testdata/multi.torrent"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	wantLines := "Length: 74024\n" +
+		"Info Hash: bb84103e1c6dd5294a239b1fc6e115460683b45c\n" +
+		"Piece Length: 32768\n" +
+		"Name: multi\n" +
+		"Files:\n" +
+		"multi/\n" +
+		"  a.bin (1024 bytes)\n" +
+		"  docs/\n" +
+		"    readme.txt (3000 bytes)\n" +
+		"  media/\n" +
+		"    video/\n" +
+		"      clip.mp4 (70000 bytes)\n" +
+		"Total: 74024 bytes in 3 files\n" +
+		"Piece Hashes:\n"
+	if !strings.Contains(out.String(), wantLines) {
+		t.Errorf("runInfo() got = %q, want it to contain %q", out.String(), wantLines)
+	}
+
+	var gotLeft string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotLeft = r.URL.Query().Get("left")
+	}))
+	defer tracker.Close()
+	_, m := writeTestMetainfo(t, map[string]interface{}{
+		"announce": tracker.URL + "/announce",
+		"info": map[string]interface{}{
+			"files":        []interface{}{map[string]interface{}{"length": 10, "path": []string{"a"}}, map[string]interface{}{"length": 6, "path": []string{"b"}}},
+			"name":         "test",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+	res, err := requestToTracker(m, defaultAnnounceOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if gotLeft != "16" {
+		t.Errorf("announce left = %s, want 16", gotLeft)
+	}
+}
+
+func Test_parseToInfo_invalidFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:    "length and files",
+			info:    map[string]interface{}{"length": 1, "files": []interface{}{}},
+			wantErr: `info has both "length" and "files"`,
+		},
+		{
+			name:    "neither",
+			info:    map[string]interface{}{},
+			wantErr: `missing key "length" under "info"`,
+		},
+		{
+			name:    "empty files",
+			info:    map[string]interface{}{"files": []interface{}{}},
+			wantErr: "files list is empty",
+		},
+		{
+			name:    "empty path",
+			info:    map[string]interface{}{"files": []interface{}{map[string]interface{}{"length": 1, "path": []string{}}}},
+			wantErr: "file 0 has an empty path",
+		},
+		{
+			name:    "parent directory",
+			info:    map[string]interface{}{"files": []interface{}{map[string]interface{}{"length": 1, "path": []string{"..", "etc"}}}},
+			wantErr: `file 0 has invalid path component ".."`,
+		},
+		{
+			name:    "separator",
+			info:    map[string]interface{}{"files": []interface{}{map[string]interface{}{"length": 1, "path": []string{"a/b"}}}},
+			wantErr: `file 0 has invalid path component "a/b"`,
+		},
+		{
+			name:    "negative length",
+			info:    map[string]interface{}{"files": []interface{}{map[string]interface{}{"length": -1, "path": []string{"a"}}}},
+			wantErr: "file 0 has negative length -1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.info["name"] = "test"
+			tt.info["piece length"] = 16
+			tt.info["pieces"] = strings.Repeat("x", 20)
+			content, err := bencode(map[string]interface{}{"announce": "http://127.0.0.1/announce", "info": tt.info})
+			if err != nil {
+				t.Fatal(err)
+			}
+			torrentFilepath := filepath.Join(t.TempDir(), "test.torrent")
+			if err := os.WriteFile(torrentFilepath, content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := parseToInfo(torrentFilepath); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("parseToInfo() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_requestToTracker_trackerParams(t *testing.T) {
+	var gotQuery url.Values
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query()
+	}))
+	defer tracker.Close()
+
+	_, m := writeTestMetainfo(t, map[string]interface{}{
+		"announce": tracker.URL + "/announce?existing=1",
+		"info": map[string]interface{}{
+			"length":       16,
+			"name":         "test.bin",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts := defaultAnnounceOptions()
+	opts.registerFlags(fs)
+	err := fs.Parse([]string{"--tracker-param", "passkey=abc123", "--tracker-param", "supportcrypto=1", "--tracker-param", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := requestToTracker(m, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	for key, want := range map[string]string{"passkey": "abc123", "supportcrypto": "1", "empty": "", "existing": "1", "compact": "1"} {
+		if got, ok := gotQuery[key]; !ok || got[0] != want {
+			t.Errorf("announce query %s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func Test_trackerParams_Set(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    [2]string
+		wantErr bool
+	}{
+		{value: "passkey=abc", want: [2]string{"passkey", "abc"}},
+		{value: "key=a=b", want: [2]string{"key", "a=b"}},
+		{value: "key=", want: [2]string{"key", ""}},
+		{value: "novalue", wantErr: true},
+		{value: "=value", wantErr: true},
+		{value: "info_hash=x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var p trackerParams
+			err := p.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Set() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && p[0] != tt.want {
+				t.Errorf("Set() got = %v, want %v", p[0], tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseToInfo_BOM(t *testing.T) {
+	content, err := os.ReadFile(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := parseToInfo(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		prefix  string
+		wantErr bool
+	}{
+		{name: "BOM", prefix: utf8BOM},
+		{name: "garbage", prefix: "xx", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrentFilepath := filepath.Join(t.TempDir(), "prefixed.torrent")
+			if err := os.WriteFile(torrentFilepath, append([]byte(tt.prefix), content...), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseToInfo(torrentFilepath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseToInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("parseToInfo() got = %+v, want %+v", got, want)
+			}
+
+			infoHash, err := infoHashOfFile(torrentFilepath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if infoHash != want.InfoHash {
+				t.Errorf("infoHashOfFile() got = %x, want %x", infoHash, want.InfoHash)
+			}
+		})
+	}
+}
+
+func Test_networkOptions_bind(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	remote := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		remote <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	network := networkOptions{bind: "127.0.0.2"}
+	dialer, err := network.dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Skipf("cannot dial from 127.0.0.2: %v", err)
+	}
+	conn.Close()
+
+	if got := (<-remote).(*net.TCPAddr).IP.String(); got != "127.0.0.2" {
+		t.Errorf("peer connection came from %s, want 127.0.0.2", got)
+	}
+
+	var trackerRemote string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trackerRemote = r.RemoteAddr
+	}))
+	defer tracker.Close()
+
+	client, err := network.httpClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Get(tracker.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if host, _, _ := net.SplitHostPort(trackerRemote); host != "127.0.0.2" {
+		t.Errorf("tracker request came from %s, want 127.0.0.2", trackerRemote)
+	}
+}
+
+func Test_networkOptions_localAddr(t *testing.T) {
+	tests := []struct {
+		bind    string
+		want    string
+		wantErr bool
+	}{
+		{bind: "", want: "<nil>"},
+		{bind: "10.0.0.5", want: "10.0.0.5:0"},
+		{bind: "10.0.0.5:6881", want: "10.0.0.5:6881"},
+		{bind: "[::1]:6881", want: "[::1]:6881"},
+		{bind: "::1", want: "[::1]:0"},
+		{bind: "eth0", wantErr: true},
+		{bind: "10.0.0.5:port", wantErr: true},
+		{bind: "10.0.0.5:70000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bind, func(t *testing.T) {
+			o := networkOptions{bind: tt.bind}
+			got, err := o.localAddr()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localAddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("localAddr() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runDecode_typed(t *testing.T) {
+	// randomHash is 20 random bytes, as a piece hash or peer id would be.
+	const randomHash = "\x8b\x1e\xf3\x07\xa4\x5d\xc0\x92\x3f\xe6\x11\x8a\xd4\x70\x2c\xb9\x55\x0f\xee\x63"
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "plain",
+			args: []string{"d4:name4:test6:pieces2:\xff\x00e"},
+			want: "{\"name\":\"test\",\"pieces\":\"�\\u0000\"}\n",
+		},
+		{
+			name: "typed",
+			args: []string{"d6:lengthi3e4:name4:test6:pieces2:\xff\x00e", "--typed"},
+			want: `{"length":3,"name":{"_type":"text","text":"test"},"pieces":{"_type":"bytes","hex":"ff00"}}` + "\n",
+		},
+		{
+			name: "typed list",
+			args: []string{"--typed", "l0:1:\x80e"},
+			want: `[{"_type":"text","text":""},{"_type":"bytes","hex":"80"}]` + "\n",
+		},
+		{
+			name: "lenient",
+			args: []string{"li03ei-0ee", "--lenient"},
+			want: "[3,0]\n",
+		},
+		{
+			name: "ordered",
+			args: []string{"d1:bi1e1:ald1:zi0e1:yi0eeee", "--ordered"},
+			want: `{"b":1,"a":[{"z":0,"y":0}]}` + "\n",
+		},
+		{
+			name: "binary keys",
+			args: []string{"d2:\xfe\x001:a2:\xff\x001:be"},
+			want: `{"$hex:fe00":"a","$hex:ff00":"b"}` + "\n",
+		},
+		{
+			name: "binary hex",
+			args: []string{"d4:hash20:" + randomHash + "4:name4:teste", "--binary=hex"},
+			want: `{"hash":{"$hex":"8b1ef307a45dc0923fe6118ad4702cb9550fee63"},"name":"test"}` + "\n",
+		},
+		{
+			name: "binary base64",
+			args: []string{"--binary", "base64", "l2:\xff\x002:ok0:e"},
+			want: `["/wA=","ok",""]` + "\n",
+		},
+		{
+			name: "binary raw",
+			args: []string{"--binary=raw", "1:\xff"},
+			want: "\"\ufffd\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := runDecode(tt.args, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("runDecode() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runPeers_quiet(t *testing.T) {
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := bencode(map[string]interface{}{
+			"interval":        60,
+			"peers":           "\x7f\x00\x00\x01\x1a\xe1",
+			"warning message": "tracker is overloaded",
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write(body)
+	}))
+	defer tracker.Close()
+
+	torrentFilepath, _ := writeTestTorrentFile(t, map[string]interface{}{
+		"announce": tracker.URL + "/announce",
+		"info": map[string]interface{}{
+			"length":       16,
+			"name":         "test.bin",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+
+	defer func(savedLog, savedErr io.Writer) {
+		logOutput, errOutput = savedLog, savedErr
+	}(logOutput, errOutput)
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantLogs string
+	}{
+		{name: "default", args: []string{"peers", torrentFilepath}, wantLogs: "warning: tracker: tracker is overloaded\n"},
+		{name: "quiet", args: []string{"--quiet", "peers", torrentFilepath}},
+		{name: "quiet after the command", args: []string{"peers", torrentFilepath, "-q"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, logs bytes.Buffer
+			logOutput = &logs
+
+			args, global := parseGlobalFlags(tt.args)
+			global.apply()
+			if err := runPeers(args[1:], &stdout); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := stdout.String(), "127.0.0.1:6881\n"; got != want {
+				t.Errorf("stdout got = %q, want %q", got, want)
+			}
+			if got := logs.String(); got != tt.wantLogs {
+				t.Errorf("logs got = %q, want %q", got, tt.wantLogs)
+			}
+		})
+	}
+}
+
+func Test_getPeers_post(t *testing.T) {
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "announce must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+			t.Errorf("Content-Type = %q, want a form body", ct)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		for _, key := range []string{"info_hash", "peer_id", "left", "compact", "passkey"} {
+			if r.PostForm.Get(key) == "" {
+				t.Errorf("announce body has no %s", key)
+			}
+		}
+		if got := r.URL.Query().Get("existing"); got != "1" {
+			t.Errorf("announce URL query existing = %q, want it kept", got)
+		}
+
+		io.WriteString(w, "d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e")
+	}))
+	defer tracker.Close()
+
+	_, m := writeTestMetainfo(t, map[string]interface{}{
+		"announce": tracker.URL + "/announce?existing=1",
+		"info": map[string]interface{}{
+			"length":       16,
+			"name":         "test.bin",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts := defaultAnnounceOptions()
+	opts.registerFlags(fs)
+	if err := fs.Parse([]string{"--announce-method", "post", "--tracker-param", "passkey=abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := getPeers(m, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:6881"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getPeers() got = %v, want %v", got, want)
+	}
+
+	opts.method = "PUT"
+	if err := opts.validate(); err == nil {
+		t.Error("validate() error = nil, want an error for PUT")
+	}
+}
+
+func Test_dialPieceSource_peerClosesAfterHandshake(t *testing.T) {
+	torrent := newTestTorrent(t, 2*blockSize, blockSize)
+	seeder := newTestSeeder(t, torrent)
+
+	closer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	go func() {
+		for {
+			conn, err := closer.Accept()
+			if err != nil {
+				return
+			}
+			answerHandshake(t, conn, []byte("-CL0001-000000000000"))
+			conn.Close()
+		}
+	}()
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	start := time.Now()
+	_, err = dialPieceSource(dialer, []string{closer.Addr().String()}, torrent.info)
+	if !errors.Is(err, errPeerClosed) {
+		t.Errorf("dialPieceSource() error = %v, want %v", err, errPeerClosed)
+	}
+
+	conn, err := dialPieceSource(dialer, []string{closer.Addr().String(), seeder.addr()}, torrent.info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != seeder.addr() {
+		t.Errorf("dialPieceSource() connected to %s, want %s", got, seeder.addr())
+	}
+
+	if elapsed := time.Since(start); elapsed >= dialTimeout {
+		t.Errorf("falling back took %v, want it to move on without waiting for a timeout", elapsed)
+	}
+}
+
+func Test_parseToInfo_truncated(t *testing.T) {
+	content, err := os.ReadFile(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+		wantEOF bool
+	}{
+		{name: "inside a string", content: string(content[:100]), wantErr: "syntax error at byte 100: string of length 4 runs past the end of input", wantEOF: true},
+		{name: "after a key", content: "d8:announce1:a4:info", wantErr: `syntax error at byte 20: key "info" has no value`, wantEOF: true},
+		{name: "key without a value", content: "d8:announce1:a4:infoe", wantErr: `syntax error at byte 20: key "info" has no value`},
+		{name: "unterminated", content: "d8:announce1:a", wantErr: "syntax error at byte 14: unterminated dictionary", wantEOF: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrentFilepath := filepath.Join(t.TempDir(), "truncated.torrent")
+			if err := os.WriteFile(torrentFilepath, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := parseToInfo(torrentFilepath)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("parseToInfo() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := errors.Is(err, io.ErrUnexpectedEOF); got != tt.wantEOF {
+				t.Errorf("errors.Is(err, io.ErrUnexpectedEOF) = %v, want %v", got, tt.wantEOF)
+			}
+			if code := exitCode(err); code != exitUsage {
+				t.Errorf("exitCode() = %d, want %d", code, exitUsage)
+			}
+		})
+	}
+}
+
+func Test_parseToInfo_strict(t *testing.T) {
+	// dirty.torrent has a piece length of i016e, "announce" after "info"
+	// and a CRLF after the final 'e'.
+	const dirtyTorrent = "testdata/dirty.torrent"
+	defer func(saved bool) { strictTorrents = saved }(strictTorrents)
+
+	strictTorrents = false
+	m, err := LoadTorrent(dirtyTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := m.Info
+	wantWarnings := []string{
+		`integer "016" is not canonical`,
+		`dictionary key "announce" is out of order`,
+		"ignoring 2 bytes of whitespace after the torrent",
+		"info dictionary is not canonically encoded, hashing it as written",
+	}
+	if !reflect.DeepEqual(info.Warnings, wantWarnings) {
+		t.Errorf("parseToInfo() warnings = %q, want %q", info.Warnings, wantWarnings)
+	}
+	if info.PieceLength != 16 || m.Announce != "http://tracker.example/announce" {
+		t.Errorf("parseToInfo() got = %+v, announce %q", info, m.Announce)
+	}
+	// The hash is over the info dictionary as written, i016e included.
+	if got := fmt.Sprintf("%x", info.InfoHash); got != "857e4b28a4716e205cc3c86401396a5695ca4d0b" {
+		t.Errorf("parseToInfo() info hash = %s", got)
+	}
+
+	strictTorrents = true
+	want := `syntax error at byte 17: invalid integer "016": leading zero`
+	if _, err := parseToInfo(dirtyTorrent); err == nil || err.Error() != want {
+		t.Errorf("strict parseToInfo() error = %v, want %q", err, want)
+	}
+	if _, err := infoHashOfFile(dirtyTorrent); err == nil || err.Error() != want {
+		t.Errorf("strict infoHashOfFile() error = %v, want %q", err, want)
+	}
+	if _, err := parseToInfo(sampleTorrent); err != nil {
+		t.Errorf("strict parseToInfo() of a clean torrent error = %v", err)
+	}
+}
+
+func Test_parseToInfo_trailingData(t *testing.T) {
+	content, err := os.ReadFile(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrentFilepath := filepath.Join(t.TempDir(), "appended.torrent")
+	if err := os.WriteFile(torrentFilepath, append(content, "junk"...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "torrent has 4 bytes of trailing data"
+	if _, err := parseToInfo(torrentFilepath); err == nil || err.Error() != want {
+		t.Errorf("parseToInfo() error = %v, want %q", err, want)
+	}
+	if _, err := infoHashOfFile(torrentFilepath); err == nil || err.Error() != want {
+		t.Errorf("infoHashOfFile() error = %v, want %q", err, want)
+	}
+
+	for _, input := range []string{"5:hello\n\n", "5:hello\r\n", "i52exxxx"} {
+		err := runDecode([]string{input}, io.Discard)
+		if want := fmt.Sprintf("trailing data at offset %d", strings.IndexAny(input, "\r\nx")); err == nil || err.Error() != want {
+			t.Errorf("runDecode(%q) error = %v, want %q", input, err, want)
+		}
+	}
+}
+
+func Test_runDecode_trailingNewline(t *testing.T) {
+	defer func(saved io.Reader) { stdin = saved }(stdin)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "i52e\n", want: "52\n"},
+		{input: "5:hello\n", want: "\"hello\"\n"},
+		// The newline that ends the string is part of the value.
+		{input: "6:hello\n", want: "\"hello\\n\"\n"},
+		{input: "6:hello\n\n", want: "\"hello\\n\"\n"},
+	}
+	for _, tt := range tests {
+		stdin = strings.NewReader(tt.input)
+		var out strings.Builder
+		if err := runDecode([]string{"-f", "-"}, &out); err != nil {
+			t.Errorf("runDecode(%q) error = %v", tt.input, err)
+			continue
+		}
+		if out.String() != tt.want {
+			t.Errorf("runDecode(%q) got = %q, want %q", tt.input, out.String(), tt.want)
+		}
+	}
+}
+
+func Test_DecodeStrict(t *testing.T) {
+	got, err := DecodeStrict([]byte("l5:helloi52ee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{[]byte("hello"), int64(52)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeStrict() got = %v, want %v", got, want)
+	}
+
+	if _, err := DecodeStrict([]byte("l5:helloi52eee")); err == nil || err.Error() != "trailing data at offset 13" {
+		t.Errorf("DecodeStrict() error = %v, want trailing data at offset 13", err)
+	}
+}
+
+func Test_run_exitCodes(t *testing.T) {
+	defer func(savedLog, savedErr io.Writer) {
+		logOutput, errOutput = savedLog, savedErr
+	}(logOutput, errOutput)
+
+	// closed accepts nothing, which stands in for an unreachable tracker
+	// and peer.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	torrentFilepath, _ := writeTestTorrentFile(t, map[string]interface{}{
+		"announce": "http://" + closed.Addr().String() + "/announce",
+		"info": map[string]interface{}{
+			"length":       16,
+			"name":         "test.bin",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+
+	peer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	go func() {
+		for {
+			conn, err := peer.Accept()
+			if err != nil {
+				return
+			}
+			answerHandshake(t, conn, []byte("-XX0001-000000000000"))
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{name: "success", args: []string{"decode", "5:hello"}, want: exitOK},
+		{name: "malformed bencode", args: []string{"decode", "5:ab"}, want: exitUsage},
+		{name: "no command", args: nil, want: exitUsage},
+		{name: "unknown command", args: []string{"nope"}, want: exitUsage},
+		{name: "bad flag", args: []string{"info", "--nope", torrentFilepath}, want: exitUsage},
+		{name: "missing torrent", args: []string{"info", filepath.Join(t.TempDir(), "missing.torrent")}, want: exitUsage},
+		{name: "unreachable tracker", args: []string{"peers", torrentFilepath}, want: exitNetwork},
+		{name: "unreachable peer", args: []string{"handshake", torrentFilepath, closed.Addr().String()}, want: exitNetwork},
+		{name: "peer id mismatch", args: []string{"handshake", torrentFilepath, peer.Addr().String(), "--expect-peer-id", strings.Repeat("00", 20)}, want: exitVerification},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			errOutput = &stderr
+
+			if got := run(tt.args, &stdout); got != tt.want {
+				t.Errorf("run(%q) = %d, want %d (output %q)", tt.args, got, tt.want, stderr.String())
+			}
+			if tt.want != exitOK && stderr.Len() == 0 {
+				t.Errorf("run(%q) reported no error", tt.args)
+			}
+		})
+	}
+}
+
+func Test_parseToInfo_binaryPieces(t *testing.T) {
+	// Neither hash is valid UTF-8, so any trip through a text conversion
+	// would replace bytes.
+	pieces := append(bytes.Repeat([]byte{0xff, 0xfe, 0x80}, 7)[:20], bytes.Repeat([]byte{0xc3, 0x28}, 10)...)
+
+	torrentFilepath, _ := writeTestTorrentFile(t, map[string]interface{}{
+		"announce": "http://tracker.invalid/announce",
+		"info": map[string]interface{}{
+			"length":       32,
+			"name":         "binary.bin",
+			"piece length": 16,
+			"pieces":       pieces,
+		},
+	})
+
+	info, err := parseToInfo(torrentFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(info.Pieces, pieces) {
+		t.Errorf("Pieces = %x, want %x", info.Pieces, pieces)
+	}
+	if want := fmt.Sprintf("%x\n%x\n", pieces[:20], pieces[20:]); info.HashesHex() != want {
+		t.Errorf("HashesHex() = %q, want %q", info.HashesHex(), want)
+	}
+	if info.NumPieces() != 2 {
+		t.Errorf("NumPieces() = %d, want 2", info.NumPieces())
+	}
+	if got, err := info.PieceHash(1); err != nil || !bytes.Equal(got[:], pieces[20:]) {
+		t.Errorf("PieceHash(1) = %x, %v, want %x", got, err, pieces[20:])
+	}
+	if _, err := info.PieceHash(2); err == nil {
+		t.Error("PieceHash(2) error = nil, want out of range")
+	}
+
+	infoHash, err := infoHashOfFile(torrentFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infoHash != info.InfoHash {
+		t.Errorf("InfoHash = %x, want %x as hashed from the file", info.InfoHash, infoHash)
+	}
+}
+
+func Test_parseToInfo_largeLength(t *testing.T) {
+	const (
+		length    = int64(5) << 30
+		pieceSize = 16 << 20
+	)
+	pieces := strings.Repeat("x", int(length/pieceSize)*eachPieceSize)
+
+	infoDict := map[string]interface{}{
+		"length":       length,
+		"name":         "large.bin",
+		"piece length": pieceSize,
+		"pieces":       pieces,
+	}
+	_, info := writeTestTorrentFile(t, map[string]interface{}{
+		"announce": "http://tracker.invalid/announce",
+		"info":     infoDict,
+	})
+	if info.Length != length {
+		t.Errorf("Length = %d, want %d", info.Length, length)
+	}
+	if got := info.PieceSize(int(length/pieceSize) - 1); got != pieceSize {
+		t.Errorf("PieceSize() of the last piece = %d, want %d", got, pieceSize)
+	}
+
+	reencoded, err := Marshal(TorrentInfo{
+		Name:        info.Name,
+		Length:      info.Length,
+		PieceLength: info.PieceLength,
+		Pieces:      info.Pieces,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sha1.Sum(reencoded); got != info.InfoHash {
+		t.Errorf("re-encoded info hash = %x, want %x", got, info.InfoHash)
+	}
+}
+
+func Test_parseToInfo_nonCanonicalInfoHash(t *testing.T) {
+	// The info dictionary lists "name" before "length", so re-encoding it
+	// sorts the keys and changes the bytes a tracker would hash.
+	rawInfo := "d4:name1:x6:lengthi4e12:piece lengthi4e6:pieces20:" + strings.Repeat("a", 20) + "e"
+	torrentFilepath := filepath.Join(t.TempDir(), "test.torrent")
+	content := "d8:announce19:http://t.invalid/an4:info" + rawInfo + "e"
+	if err := os.WriteFile(torrentFilepath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := parseToInfo(torrentFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(info.RawInfo) != rawInfo {
+		t.Errorf("RawInfo = %q, want %q", info.RawInfo, rawInfo)
+	}
+	if want := sha1.Sum([]byte(rawInfo)); info.InfoHash != want {
+		t.Errorf("InfoHash = %x, want %x", info.InfoHash, want)
+	}
+
+	decoded, _, err := decodeBencode([]byte(rawInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reencoded, err := bencode(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha1.Sum(reencoded) == info.InfoHash {
+		t.Error("re-encoding gave the same hash, so the test does not exercise a non-canonical torrent")
+	}
+}
+
+func Test_VerifyCanonical(t *testing.T) {
+	content, err := os.ReadFile(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyCanonical(content); err != nil {
+		t.Errorf("VerifyCanonical(sample.torrent) error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "unsorted keys",
+			data: "d4:name1:x6:lengthi4ee",
+			want: "not canonical: first difference at byte 1\n" +
+				"  input:      64|343a6e616d65313a\n" +
+				"  re-encoded: 64|363a6c656e677468\n" +
+				"  dictionary key \"length\" comes after \"name\"",
+		},
+		{
+			name: "leading zero",
+			data: "li1ei007ee",
+			want: "not canonical: first difference at byte 5\n" +
+				"  input:      6c69316569|3030376565\n" +
+				"  re-encoded: 6c69316569|376565",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyCanonical([]byte(tt.data))
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("VerifyCanonical() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runReencode(t *testing.T) {
+	var buf bytes.Buffer
+	if err := runReencode([]string{sampleTorrent}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "canonical\n" {
+		t.Errorf("runReencode() got = %q, want %q", buf.String(), "canonical\n")
+	}
+
+	torrentFilepath := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(torrentFilepath, []byte("d1:bi1e1:ai2ee"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := runReencode([]string{torrentFilepath}, io.Discard)
+	if exitCode(err) != exitVerification {
+		t.Errorf("runReencode() error = %v, exit code %d, want %d", err, exitCode(err), exitVerification)
+	}
+}
+
+// largeTorrent returns a torrent with 50,000 pieces, like one for a 12 GB
+// file with 256 KiB pieces. Its "pieces" string is 1 MB.
+func largeTorrent(b *testing.B) []byte {
+	pieces := make([]byte, 50000*eachPieceSize)
+	rand.New(rand.NewSource(1)).Read(pieces)
+
+	content, err := bencode(map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]interface{}{
+			"length":       50000 * 256 * 1024,
+			"name":         "large.bin",
+			"piece length": 256 * 1024,
+			"pieces":       pieces,
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return content
+}
+
+func Benchmark_decodeTorrent(b *testing.B) {
+	content := largeTorrent(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := decodeTorrent(content); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_parseToInfo(b *testing.B) {
+	torrentFilepath := filepath.Join(b.TempDir(), "large.torrent")
+	if err := os.WriteFile(torrentFilepath, largeTorrent(b), 0o644); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseToInfo(torrentFilepath); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_Info_PieceSize(t *testing.T) {
+	info, err := parseToInfo("testdata/multi.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{32768, 32768, 8488}
+	if info.NumPieces() != len(want) {
+		t.Fatalf("NumPieces() = %d, want %d", info.NumPieces(), len(want))
+	}
+	total := int64(0)
+	for i, size := range want {
+		if got := info.PieceSize(i); got != size {
+			t.Errorf("PieceSize(%d) = %d, want %d", i, got, size)
+		}
+		total += int64(info.PieceSize(i))
+	}
+	if total != info.Length {
+		t.Errorf("piece sizes add up to %d, want Length %d", total, info.Length)
+	}
+}
+
+func Test_runDownloadPiece_lastPiece(t *testing.T) {
+	// 2 full pieces and a last one of a block and a half, so that both the
+	// piece and its final block are short.
+	var (
+		torrent = newTestTorrent(t, 2*32*1024+24*1024, 32*1024)
+		seeder  = newTestSeeder(t, torrent)
+		tracker = newTestTracker(t, []string{seeder.addr()})
+	)
+	torrentFilepath, _ := writeTestTorrentFile(t, map[string]interface{}{
+		"announce": tracker.URL + "/announce",
+		"info": map[string]interface{}{
+			"length":       torrent.info.Length,
+			"name":         torrent.info.Name,
+			"piece length": torrent.info.PieceLength,
+			"pieces":       torrent.info.Pieces,
+		},
+	})
+
+	for index := 0; index < torrent.info.NumPieces(); index++ {
+		outputFilepath := filepath.Join(t.TempDir(), "piece")
+		err := runDownloadPiece([]string{"-o", outputFilepath, torrentFilepath, strconv.Itoa(index)})
+		if err != nil {
+			t.Fatalf("piece %d: %v", index, err)
+		}
+
+		got, err := os.ReadFile(outputFilepath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		begin := index * torrent.info.PieceLength
+		if want := torrent.data[begin : begin+torrent.info.PieceSize(index)]; !bytes.Equal(got, want) {
+			t.Errorf("piece %d: got %d bytes, want %d bytes of the torrent data", index, len(got), len(want))
+		}
+	}
+}
+
+func Test_LoadTorrent_optionalFields(t *testing.T) {
+	info := map[string]interface{}{
+		"length":       16,
+		"name":         "test.bin",
+		"piece length": 16,
+		"pieces":       strings.Repeat("x", 20),
+	}
+
+	torrentFilepath, got := writeTestMetainfo(t, map[string]interface{}{
+		"announce":      "http://127.0.0.1/announce",
+		"comment":       "a comment",
+		"created by":    "mktorrent 1.1",
+		"creation date": 1700000000,
+		"encoding":      "UTF-8",
+		"info":          info,
+	})
+	if got.Comment != "a comment" || got.CreatedBy != "mktorrent 1.1" || got.Encoding != "UTF-8" {
+		t.Errorf("LoadTorrent() comment = %q, created by = %q, encoding = %q", got.Comment, got.CreatedBy, got.Encoding)
+	}
+	if want := time.Unix(1700000000, 0); !got.CreationDate.Equal(want) {
+		t.Errorf("LoadTorrent() CreationDate = %v, want %v", got.CreationDate, want)
+	}
+
+	var out strings.Builder
+	if err := runInfo([]string{torrentFilepath}, &out); err != nil {
+		t.Fatal(err)
+	}
+	wantLines := "Name: test.bin\n" +
+		"Comment: a comment\n" +
+		"Created By: mktorrent 1.1\n" +
+		"Creation Date: 2023-11-14T22:13:20Z\n" +
+		"Encoding: UTF-8\n"
+	if !strings.Contains(out.String(), wantLines) {
+		t.Errorf("runInfo() got = %q, want it to contain %q", out.String(), wantLines)
+	}
+
+	_, got = writeTestMetainfo(t, map[string]interface{}{
+		"announce": "http://127.0.0.1/announce",
+		"info":     info,
+	})
+	if got.Comment != "" || got.CreatedBy != "" || !got.CreationDate.IsZero() || got.Encoding != "" {
+		t.Errorf("LoadTorrent() without optional fields = %+v", got)
+	}
+}
+
+func Test_LoadTorrent_announceList(t *testing.T) {
+	m, err := LoadTorrent("testdata/tiers.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"http://tracker1.example/announce", "http://tracker2.example/announce"},
+		{"udp://backup1.example:6969/announce", "http://backup2.example/announce"},
+	}
+	if !reflect.DeepEqual(m.AnnounceList, want) {
+		t.Errorf("AnnounceList = %q, want %q", m.AnnounceList, want)
+	}
+
+	var out strings.Builder
+	if err := runInfo([]string{"testdata/tiers.torrent"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	wantLines := "Tracker URL: http://tracker1.example/announce\n" +
+		"Announce List:\n" +
+		"Tier 1:\n" +
+		"  http://tracker1.example/announce\n" +
+		"  http://tracker2.example/announce\n" +
+		"Tier 2:\n" +
+		"  udp://backup1.example:6969/announce\n" +
+		"  http://backup2.example/announce\n" +
+		"Length: 23\n"
+	if !strings.HasPrefix(out.String(), wantLines) {
+		t.Errorf("runInfo() got = %q, want it to start with %q", out.String(), wantLines)
+	}
+
+	m, err = LoadTorrent(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{m.Announce}}; !reflect.DeepEqual(m.AnnounceList, want) {
+		t.Errorf("AnnounceList without announce-list = %q, want %q", m.AnnounceList, want)
+	}
+}
+
+func Test_getPeers_announceTiers(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	deadURL := "http://" + dead.Addr().String() + "/announce"
+
+	peers := []string{"127.0.0.1:6881"}
+	var (
+		mu    sync.Mutex
+		first = map[string]bool{}
+		hits  []string
+	)
+	newTracker := func(name string) string {
+		tracker := newTestTracker(t, peers)
+		handler := tracker.Config.Handler
+		tracker.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits = append(hits, name)
+			mu.Unlock()
+			handler.ServeHTTP(w, r)
+		})
+		return tracker.URL + "/announce"
+	}
+	a, b, backup := newTracker("a"), newTracker("b"), newTracker("backup")
+
+	_, m := writeTestMetainfo(t, map[string]interface{}{
+		"announce":      deadURL,
+		"announce-list": []interface{}{[]interface{}{deadURL}, []interface{}{a, b}, []interface{}{backup}},
+		"info": map[string]interface{}{
+			"length":       16,
+			"name":         "test.bin",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+
+	// The dead first tier is skipped, the second answers and the third is
+	// never asked. Which tracker of the second tier is asked depends on the
+	// shuffle, and across seeds both should be.
+	for seed := int64(0); seed < 16; seed++ {
+		hits = nil
+
+		opts := defaultAnnounceOptions()
+		opts.rand = rand.New(rand.NewSource(seed))
+		got, err := getPeers(m, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, peers) {
+			t.Errorf("getPeers() got = %v, want %v", got, peers)
+		}
+		if len(hits) != 1 || hits[0] == "backup" {
+			t.Fatalf("seed %d: trackers asked = %v, want one of the second tier", seed, hits)
+		}
+		first[hits[0]] = true
+	}
+	if !first["a"] || !first["b"] {
+		t.Errorf("trackers asked first across seeds = %v, want both of the second tier", first)
+	}
+}
+
+func Test_parseToInfo_private(t *testing.T) {
+	infoDict := func(private interface{}) map[string]interface{} {
+		ret := map[string]interface{}{
+			"length":       16,
+			"name":         "test.bin",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		}
+		if private != nil {
+			ret["private"] = private
+		}
+		return ret
+	}
+
+	_, public := writeTestTorrentFile(t, map[string]interface{}{"announce": "http://127.0.0.1/announce", "info": infoDict(nil)})
+	torrentFilepath, private := writeTestTorrentFile(t, map[string]interface{}{"announce": "http://127.0.0.1/announce", "info": infoDict(1)})
+	_, zero := writeTestTorrentFile(t, map[string]interface{}{"announce": "http://127.0.0.1/announce", "info": infoDict(0)})
+
+	if public.Private || !private.Private || zero.Private {
+		t.Errorf("Private = %v, %v, %v, want false, true, false", public.Private, private.Private, zero.Private)
+	}
+
+	// The flag is inside the info dictionary, so it changes the info hash,
+	// which must still be taken over the dictionary as it is in the file.
+	if private.InfoHash == public.InfoHash {
+		t.Errorf("private and public torrents share info hash %x", private.InfoHash)
+	}
+	if !bytes.Contains(private.RawInfo, []byte("7:privatei1e")) || sha1.Sum(private.RawInfo) != private.InfoHash {
+		t.Errorf("InfoHash = %x is not the hash of raw info %q", private.InfoHash, private.RawInfo)
+	}
+
+	var out strings.Builder
+	if err := runInfo([]string{torrentFilepath}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Private: yes\n") {
+		t.Errorf("runInfo() got = %q, want it to contain %q", out.String(), "Private: yes\n")
+	}
+}
+
+func Test_parseToInfo_unsortedInfoKeys(t *testing.T) {
+	// unsorted_info.torrent has "name" before "length" inside info.
+	info, err := parseToInfo("testdata/unsorted_info.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fmt.Sprintf("%x", info.InfoHash); got != "6917331cdc1cfdd1c02b5a56d1a05e408cb7e703" {
+		t.Errorf("parseToInfo() info hash = %s, want the hash of the info bytes as written", got)
+	}
+	reencoded, err := bencode(map[string]interface{}{
+		"length":       info.Length,
+		"name":         info.Name,
+		"piece length": info.PieceLength,
+		"pieces":       info.Pieces,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.InfoHash == sha1.Sum(reencoded) {
+		t.Errorf("parseToInfo() info hash %x is the hash of the re-encoded info", info.InfoHash)
+	}
+
+	wantWarnings := []string{
+		`dictionary key "length" is out of order`,
+		"info dictionary is not canonically encoded, hashing it as written",
+	}
+	if !reflect.DeepEqual(info.Warnings, wantWarnings) {
+		t.Errorf("parseToInfo() warnings = %q, want %q", info.Warnings, wantWarnings)
+	}
+}
+
+func Test_parseToInfo_webSeeds(t *testing.T) {
+	tests := []struct {
+		path      string
+		want      []string
+		wantHTTP  []string
+		wantLines string
+	}{
+		{
+			path:      "testdata/webseed_string.torrent",
+			want:      []string{"http://mirror.example/files/web%20seed.txt"},
+			wantLines: "Web Seeds:\n  http://mirror.example/files/web%20seed.txt (url-list)\n",
+		},
+		{
+			path:      "testdata/webseed_list.torrent",
+			want:      []string{"http://mirror1.example/pub/", "http://mirror2.example/pub/"},
+			wantLines: "Web Seeds:\n  http://mirror1.example/pub/ (url-list)\n  http://mirror2.example/pub/ (url-list)\n",
+		},
+		{
+			path:      "testdata/httpseeds.torrent",
+			want:      []string{"http://mirror.example/pub/seeded.bin"},
+			wantHTTP:  []string{"http://seed.example/seed.php"},
+			wantLines: "Web Seeds:\n  http://mirror.example/pub/seeded.bin (url-list)\n  http://seed.example/seed.php (httpseeds)\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			info, err := parseToInfo(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(info.WebSeeds, tt.want) {
+				t.Errorf("WebSeeds = %q, want %q", info.WebSeeds, tt.want)
+			}
+			if !reflect.DeepEqual(info.HTTPSeeds, tt.wantHTTP) {
+				t.Errorf("HTTPSeeds = %q, want %q", info.HTTPSeeds, tt.wantHTTP)
+			}
+
+			var out strings.Builder
+			if err := runInfo([]string{tt.path}, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), tt.wantLines) {
+				t.Errorf("runInfo() got = %q, want it to contain %q", out.String(), tt.wantLines)
+			}
+		})
+	}
+}
+
+func Test_webSeeds_malformed(t *testing.T) {
+	info := &Info{Name: "a.iso"}
+
+	got, warnings := webSeeds([]interface{}{[]byte("http://m/"), int64(1), []byte("")}, info)
+	if want := []string{"http://m/a.iso"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("webSeeds() = %q, want %q", got, want)
+	}
+	if want := []string{"ignoring url-list entry 1 that is an integer"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("webSeeds() warnings = %q, want %q", warnings, want)
+	}
+
+	got, warnings = webSeeds(map[string]interface{}{}, info)
+	if got != nil || !reflect.DeepEqual(warnings, []string{"ignoring url-list that is a dictionary"}) {
+		t.Errorf("webSeeds() of a dictionary = %q, %q", got, warnings)
+	}
+
+	got, warnings = httpSeeds([]interface{}{[]byte("http://s/"), []interface{}{}, []byte("http://m/a.iso")}, []string{"http://m/a.iso"})
+	if want := []string{"http://s/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("httpSeeds() = %q, want %q", got, want)
+	}
+	if want := []string{"ignoring httpseeds entry 1 that is a list"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("httpSeeds() warnings = %q, want %q", warnings, want)
+	}
+}
+
+func Test_runInfo_padding(t *testing.T) {
+	const path = "testdata/padded.torrent"
+
+	info, err := parseToInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var padding []bool
+	for _, f := range info.Files {
+		padding = append(padding, f.IsPadding())
+	}
+	if want := []bool{false, true, false}; !reflect.DeepEqual(padding, want) {
+		t.Errorf("IsPadding() of the files = %v, want %v", padding, want)
+	}
+	if info.Files[1].Attr != "p" {
+		t.Errorf("Attr = %q, want %q", info.Files[1].Attr, "p")
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			args: []string{path},
+			want: "Files:\npadded/\n  a.txt (100 bytes)\n  b.txt (50 bytes)\nTotal: 150 bytes in 2 files\n",
+		},
+		{
+			args: []string{"--show-padding", path},
+			want: "Files:\npadded/\n  a.txt (100 bytes)\n  .pad/\n    16284 (16284 bytes, padding)\n  b.txt (50 bytes)\nTotal: 150 bytes in 2 files\n",
+		},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		if err := runInfo(tt.args, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("runInfo(%q) got = %q, want it to contain %q", tt.args, out.String(), tt.want)
+		}
+	}
+}
+
+func Test_runDownload_padding(t *testing.T) {
+	const pieceLength = 16384
+	a := bytes.Repeat([]byte("a"), 100)
+	b := bytes.Repeat([]byte("b"), 50)
+	data := append(append(append([]byte(nil), a...), make([]byte, pieceLength-len(a))...), b...)
+
+	pieces := ""
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[begin:end])
+		pieces += string(sum[:])
+	}
+	metainfo := func(announce string) map[string]interface{} {
+		return map[string]interface{}{
+			"announce": announce,
+			"info": map[string]interface{}{
+				"files": []interface{}{
+					map[string]interface{}{"length": len(a), "path": []interface{}{"a.txt"}},
+					map[string]interface{}{"attr": "p", "length": pieceLength - len(a), "path": []interface{}{".pad", "16284"}},
+					map[string]interface{}{"length": len(b), "path": []interface{}{"b.txt"}},
+				},
+				"name":         "padded",
+				"piece length": pieceLength,
+				"pieces":       pieces,
+			},
+		}
+	}
+
+	_, info := writeTestTorrentFile(t, metainfo("http://127.0.0.1/announce"))
+	var (
+		seeder  = newTestSeeder(t, &testTorrent{info: info, data: data})
+		tracker = newTestTracker(t, []string{seeder.addr()})
+	)
+	torrentFilepath, _ := writeTestTorrentFile(t, metainfo(tracker.URL+"/announce"))
+
+	dir := filepath.Join(t.TempDir(), "padded")
+	var out strings.Builder
+	if err := runDownload([]string{"-o", dir, torrentFilepath}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string][]byte{"a.txt": a, "b.txt": b} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".pad")); !os.IsNotExist(err) {
+		t.Errorf("padding directory was created: %v", err)
+	}
+}
+
+func Test_Info_FileRanges(t *testing.T) {
+	info, err := parseToInfo("testdata/multi.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.TotalLength(); got != 74024 {
+		t.Errorf("TotalLength() = %d, want 74024", got)
+	}
+
+	// a.bin and readme.txt fit in the first piece with room for the start
+	// of clip.mp4, which fills the rest.
+	want := [][]FileRange{
+		{{FileIndex: 0, FileOffset: 0, Length: 1024}, {FileIndex: 1, FileOffset: 0, Length: 3000}, {FileIndex: 2, FileOffset: 0, Length: 28744}},
+		{{FileIndex: 2, FileOffset: 28744, Length: 32768}},
+		{{FileIndex: 2, FileOffset: 61512, Length: 8488}},
+	}
+	for i, w := range want {
+		if got := info.FileRanges(i); !reflect.DeepEqual(got, w) {
+			t.Errorf("FileRanges(%d) = %+v, want %+v", i, got, w)
+		}
+	}
+	if got := info.FileRanges(3); got != nil {
+		t.Errorf("FileRanges(3) = %+v, want nil", got)
+	}
+}
+
+// Test_Info_FileRanges_cover checks on random layouts, with many small and
+// empty files, that the ranges of all pieces together cover every byte of
+// every file exactly once and in order.
+func Test_Info_FileRanges_cover(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		info := &Info{PieceLength: 1 + r.Intn(64)}
+		for j := r.Intn(20); j >= 0; j-- {
+			length := int64(r.Intn(100))
+			if r.Intn(4) == 0 {
+				length = 0
+			}
+			info.Files = append(info.Files, FileEntry{Length: length, Path: []string{strconv.Itoa(j)}})
+		}
+		info.Length = info.TotalLength()
+		pieces := (info.Length + int64(info.PieceLength) - 1) / int64(info.PieceLength)
+		info.PieceHashes = make([][20]byte, pieces)
+
+		covered := make([]int64, len(info.Files))
+		for i := 0; i < info.NumPieces(); i++ {
+			var sum int64
+			for _, fr := range info.FileRanges(i) {
+				if fr.Length <= 0 || fr.FileOffset != covered[fr.FileIndex] {
+					t.Fatalf("layout %d: piece %d range %+v after %d bytes of the file", n, i, fr, covered[fr.FileIndex])
+				}
+				covered[fr.FileIndex] += fr.Length
+				sum += fr.Length
+			}
+			if sum != int64(info.PieceSize(i)) {
+				t.Fatalf("layout %d: ranges of piece %d add up to %d, want %d", n, i, sum, info.PieceSize(i))
+			}
+		}
+		for j, f := range info.Files {
+			if covered[j] != f.Length {
+				t.Fatalf("layout %d: file %d covered %d of %d bytes", n, j, covered[j], f.Length)
+			}
+		}
+	}
+}
+
+// Test_Info_FileRanges_emptyFiles checks that the empty files next to others
+// in testdata/empties.torrent take up no bytes of any piece, while the ranges
+// still tile the pieces exactly, and that writeFiles creates them empty.
+func Test_Info_FileRanges_emptyFiles(t *testing.T) {
+	const path = "testdata/empties.torrent"
+
+	m, err := LoadTorrent(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := ValidateMetainfo(m); len(errs) != 0 {
+		t.Errorf("ValidateMetainfo() = %v, want no problems", errs)
+	}
+	info := m.Info
+
+	want := [][]FileRange{
+		{{FileIndex: 0, FileOffset: 0, Length: 100}, {FileIndex: 2, FileOffset: 0, Length: 16284}},
+		{{FileIndex: 2, FileOffset: 16284, Length: 100}, {FileIndex: 4, FileOffset: 0, Length: 50}},
+	}
+	var tiled int64
+	for i, w := range want {
+		got := info.FileRanges(i)
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("FileRanges(%d) = %+v, want %+v", i, got, w)
+		}
+		for _, fr := range got {
+			tiled += fr.Length
+		}
+	}
+	if tiled != info.TotalLength() {
+		t.Errorf("ranges add up to %d bytes, want %d", tiled, info.TotalLength())
+	}
+
+	var out strings.Builder
+	if err := runInfo([]string{path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	wantTree := "empties/\n  a.txt (100 bytes)\n  empty (0 bytes)\n  b.txt (16384 bytes)\n  keep/\n    .gitkeep (0 bytes)\n  c.txt (50 bytes)\nTotal: 16534 bytes in 5 files\n"
+	if !strings.Contains(out.String(), wantTree) {
+		t.Errorf("runInfo() got = %q, want it to contain %q", out.String(), wantTree)
+	}
+
+	data := append(append(bytes.Repeat([]byte("a"), 100), bytes.Repeat([]byte("b"), 16384)...), bytes.Repeat([]byte("c"), 50)...)
+	dir := t.TempDir()
+	if err := writeFiles(dir, info, data, false); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int64{"a.txt": 100, "empty": 0, "b.txt": 16384, "keep/.gitkeep": 0, "c.txt": 50} {
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != size {
+			t.Errorf("%s is %d bytes, want %d", name, fi.Size(), size)
+		}
+	}
+}
+
+func Test_parseToInfo_trackerless(t *testing.T) {
+	const path = "testdata/trackerless.torrent"
+
+	m, err := LoadTorrent(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Announce != "" || m.AnnounceList != nil {
+		t.Errorf("Announce = %q, AnnounceList = %q, want none", m.Announce, m.AnnounceList)
+	}
+	if want := []string{"router.example:6881", "[2001:db8::1]:6881"}; !reflect.DeepEqual(m.Info.Nodes, want) {
+		t.Errorf("Nodes = %q, want %q", m.Info.Nodes, want)
+	}
+
+	var out strings.Builder
+	if err := runInfo([]string{path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "DHT Nodes:\n  router.example:6881\n  [2001:db8::1]:6881\nLength: 1200\n"
+	if !strings.HasPrefix(out.String(), want) {
+		t.Errorf("runInfo() got = %q, want it to start with %q", out.String(), want)
+	}
+
+	out.Reset()
+	if err := runValidate([]string{path}, &out); err != nil || out.String() != "ok\n" {
+		t.Errorf("runValidate() = %q, %v", out.String(), err)
+	}
+
+	if _, err := getPeers(m, defaultAnnounceOptions()); !errors.Is(err, errNoTracker) {
+		t.Errorf("getPeers() error = %v, want %v", err, errNoTracker)
+	}
+}
+
+func Test_dhtNodes_malformed(t *testing.T) {
+	got, warnings := dhtNodes([]interface{}{
+		[]interface{}{[]byte("a.example"), int64(1)},
+		[]interface{}{[]byte("b.example")},
+		[]interface{}{[]byte("c.example"), int64(70000)},
+		[]byte("d.example:1"),
+	})
+	if want := []string{"a.example:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dhtNodes() = %q, want %q", got, want)
+	}
+	wantWarnings := []string{
+		"ignoring nodes entry 1 that is not a [host, port] pair",
+		"ignoring nodes entry 2 that is not a [host, port] pair",
+		"ignoring nodes entry 3 that is not a [host, port] pair",
+	}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("dhtNodes() warnings = %q, want %q", warnings, wantWarnings)
+	}
+
+	if got, warnings := dhtNodes(int64(1)); got != nil || !reflect.DeepEqual(warnings, []string{"ignoring nodes that is an integer"}) {
+		t.Errorf("dhtNodes() of an integer = %q, %q", got, warnings)
+	}
+}
+
+func Test_run_malformedTorrents(t *testing.T) {
+	defer func(savedErr io.Writer) { errOutput = savedErr }(errOutput)
+
+	tests := []struct {
+		name     string
+		args     []string
+		want     string
+		wantCode int
+	}{
+		// Trackerless torrents are fine to read, so a missing announce only
+		// fails validation.
+		{
+			name:     "missing announce",
+			args:     []string{"validate", "testdata/missing_announce.torrent"},
+			want:     "torrent failed validation\n",
+			wantCode: exitVerification,
+		},
+		{
+			name:     "missing info",
+			args:     []string{"info", "testdata/missing_info.torrent"},
+			want:     "missing key \"info\"\n",
+			wantCode: exitUsage,
+		},
+		{
+			name:     "string length",
+			args:     []string{"info", "testdata/string_length.torrent"},
+			want:     "\"info.length\": expected integer, got string\n",
+			wantCode: exitUsage,
+		},
+		{
+			name:     "integer pieces",
+			args:     []string{"info", "testdata/integer_pieces.torrent"},
+			want:     "\"info.pieces\": expected string, got integer\n",
+			wantCode: exitUsage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			errOutput = &stderr
+
+			if got := run(tt.args, io.Discard); got != tt.wantCode {
+				t.Errorf("run(%q) = %d, want %d", tt.args, got, tt.wantCode)
+			}
+			if stderr.String() != tt.want {
+				t.Errorf("run(%q) reported %q, want %q", tt.args, stderr.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_runInfo_piece(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "first piece",
+			args: []string{sampleTorrent, "--piece", "0"},
+			want: "Piece 0: length=32768 sha1=e876f67a2a8886e8f36b136726c30fa29703022d\n",
+		},
+		{
+			name: "short last piece",
+			args: []string{sampleTorrent, "--piece", "2"},
+			want: "Piece 2: length=26527 sha1=f00d937a0213df1982bc8d097227ad9e909acc17\n",
+		},
+		{
+			name: "json",
+			args: []string{sampleTorrent, "--piece", "2", "--json"},
+			want: `{"index":2,"length":26527,"sha1":"f00d937a0213df1982bc8d097227ad9e909acc17"}` + "\n",
+		},
+		{
+			name:    "out of range",
+			args:    []string{sampleTorrent, "--piece", "3"},
+			wantErr: "piece index 3 out of range, the torrent has 3 pieces",
+		},
+		{
+			name:    "negative",
+			args:    []string{sampleTorrent, "--piece", "-1"},
+			wantErr: "piece index -1 out of range, the torrent has 3 pieces",
+		},
+		{
+			name:    "json without a piece",
+			args:    []string{sampleTorrent, "--json"},
+			wantErr: "--json is only supported with --piece",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			err := runInfo(tt.args, &out)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("runInfo() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("runInfo() got = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_runDownload_hostileName(t *testing.T) {
+	data := []byte("not really /etc/passwd")
+	pieces := sha1.Sum(data)
+	metainfo := func(announce string) map[string]interface{} {
+		return map[string]interface{}{
+			"announce": announce,
+			"info": map[string]interface{}{
+				"length":       len(data),
+				"name":         "../../etc/passwd",
+				"piece length": 16384,
+				"pieces":       string(pieces[:]),
+			},
+		}
+	}
+	_, info := writeTestTorrentFile(t, metainfo("http://127.0.0.1/announce"))
+	var (
+		seeder  = newTestSeeder(t, &testTorrent{info: info, data: data})
+		tracker = newTestTracker(t, []string{seeder.addr()})
+	)
+	torrentFilepath, _ := writeTestTorrentFile(t, metainfo(tracker.URL+"/announce"))
+
+	outDir := filepath.Join(t.TempDir(), "a", "b")
+	if err := runDownload([]string{"--out-dir", outDir, torrentFilepath}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := runDownloadPiece([]string{"--out-dir", outDir, torrentFilepath, "0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both land inside outDir, under the sanitized name, and nothing is
+	// written where the name points.
+	for _, name := range []string{".._.._etc_passwd", ".._.._etc_passwd.piece0"} {
+		got, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s = %q, want %q", name, got, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "..", "..", "etc")); !os.IsNotExist(err) {
+		t.Errorf("download wrote outside --out-dir: %v", err)
+	}
+}
+
+func Test_getPeers_trackerSchemes(t *testing.T) {
+	defer func(saved io.Writer) { logOutput = saved }(logOutput)
+	logOutput = io.Discard
+
+	infoDict := map[string]interface{}{
+		"length":       16,
+		"name":         "test.bin",
+		"piece length": 16,
+		"pieces":       strings.Repeat("x", 20),
+	}
+
+	_, udpOnly := writeTestMetainfo(t, map[string]interface{}{
+		"announce": "udp://tracker.example:6969/announce",
+		"info":     infoDict,
+	})
+	if len(udpOnly.Info.Warnings) != 0 {
+		t.Errorf("warnings = %q, want none for a udp tracker", udpOnly.Info.Warnings)
+	}
+	_, err := getPeers(udpOnly, defaultAnnounceOptions())
+	if !errors.Is(err, errUDPTracker) || err.Error() != "tracker uses UDP protocol (not yet supported)" {
+		t.Errorf("getPeers() error = %v, want %v", err, errUDPTracker)
+	}
+
+	// The junk and UDP trackers of the first tier are skipped for the
+	// HTTP one of the second.
+	peers := []string{"127.0.0.1:6881"}
+	tracker := newTestTracker(t, peers)
+	_, mixed := writeTestMetainfo(t, map[string]interface{}{
+		"announce": "ftp://junk.example/announce",
+		"announce-list": []interface{}{
+			[]interface{}{"ftp://junk.example/announce", "udp://tracker.example:6969"},
+			[]interface{}{tracker.URL + "/announce"},
+		},
+		"info": infoDict,
+	})
+	wantWarnings := []string{`announce URL "ftp://junk.example/announce" has unsupported scheme "ftp", so it is skipped`}
+	if !reflect.DeepEqual(mixed.Info.Warnings, wantWarnings) {
+		t.Errorf("warnings = %q, want %q", mixed.Info.Warnings, wantWarnings)
+	}
+	got, err := getPeers(mixed, defaultAnnounceOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, peers) {
+		t.Errorf("getPeers() = %v, want %v", got, peers)
+	}
+}
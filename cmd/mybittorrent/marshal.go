@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Marshal returns the bencoding of v.
+//
+// Strings and []byte become strings, integer kinds integers, slices and
+// arrays lists, and maps with string keys and structs dictionaries, with keys
+// sorted as the spec requires. A map[interface{}]interface{}, as decoded
+// with the anyKeys option, may also have integer keys, which sort before
+// the strings. Struct fields are named like in Unmarshal; a
+// field tagged with ",omitempty" is left out when it holds its zero value or
+// is an empty slice or map. Nil pointers and interfaces have no bencoding and
+// are left out of dictionaries.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf encodeState
+	err := marshalValue(&buf, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Encoder writes bencoded values to a stream.
+type Encoder struct {
+	w   io.Writer
+	buf encodeState
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, buf: encodeState{w: w}}
+}
+
+// Encode writes the bencoding of v, as Marshal produces it. Nothing is
+// written when v cannot be encoded, unless it holds a LazyString: what comes
+// before one is written out before copying from its reader.
+func (e *Encoder) Encode(v interface{}) error {
+	e.buf.Reset()
+	err := marshalValue(&e.buf, reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(e.buf.Bytes())
+	return err
+}
+
+// LazyString is a string whose contents are read from R when it is encoded,
+// so a long one, such as the pieces of a large torrent being created, need
+// not be held in memory. R must yield exactly Length bytes.
+//
+// An Encoder copies R straight to its writer; Marshal reads it into the
+// bytes it returns.
+type LazyString struct {
+	Length int64
+	R      io.Reader
+}
+
+// encodeState collects the bencoding of a value. When w is set, a
+// LazyString is streamed to w rather than collected, after what was
+// collected before it.
+type encodeState struct {
+	bytes.Buffer
+	w io.Writer
+}
+
+func (buf *encodeState) writeLazyString(s LazyString) error {
+	if s.Length < 0 {
+		return fmt.Errorf("bencode: LazyString has negative length %d", s.Length)
+	}
+	fmt.Fprintf(buf, "%d:", s.Length)
+
+	dst := io.Writer(&buf.Buffer)
+	if buf.w != nil {
+		if _, err := buf.w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		buf.Reset()
+		dst = buf.w
+	}
+
+	n, err := io.CopyN(dst, s.R, s.Length)
+	if err == io.EOF {
+		return fmt.Errorf("bencode: LazyString of length %d ended after %d bytes", s.Length, n)
+	}
+	return err
+}
+
+func marshalValue(buf *encodeState, v reflect.Value) error {
+	if !v.IsValid() {
+		return errors.New("bencode: cannot marshal nil")
+	}
+	if v.Type() == reflect.TypeOf(LazyString{}) {
+		return buf.writeLazyString(v.Interface().(LazyString))
+	}
+	if v.Type() == reflect.TypeOf(OrderedDict{}) {
+		// Encoding is canonical, so the order the keys were decoded in is
+		// not kept.
+		return marshalValue(buf, v.FieldByName("Values"))
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return errors.New("bencode: cannot marshal nil")
+		}
+		return marshalValue(buf, v.Elem())
+	case reflect.String:
+		writeBencodedString(buf, []byte(v.String()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprintf(buf, "i%de", v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		fmt.Fprintf(buf, "i%de", v.Uint())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			writeBencodedString(buf, b)
+			return nil
+		}
+
+		buf.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			err := marshalValue(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.Interface {
+			return marshalAnyKeyDict(buf, v)
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("bencode: cannot marshal %s: keys must be strings", v.Type())
+		}
+
+		entries := make([]dictEntry, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			entries = append(entries, dictEntry{key: iter.Key().String(), value: iter.Value()})
+		}
+		return marshalDict(buf, entries)
+	case reflect.Struct:
+		var entries []dictEntry
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			key, opts := fieldKey(field)
+			if key == "-" {
+				continue
+			}
+
+			value := v.Field(i)
+			if hasOption(opts, "omitempty") && isEmptyValue(value) {
+				continue
+			}
+			entries = append(entries, dictEntry{key: key, value: value})
+		}
+		return marshalDict(buf, entries)
+	case reflect.Bool:
+		return fmt.Errorf("bencode: cannot marshal %s: bencode has no booleans", v.Type())
+	case reflect.Float32, reflect.Float64:
+		return fmt.Errorf("bencode: cannot marshal %s: bencode only has integers", v.Type())
+	default:
+		return fmt.Errorf("bencode: cannot marshal %s", v.Type())
+	}
+
+	return nil
+}
+
+type dictEntry struct {
+	key   string
+	value reflect.Value
+}
+
+func marshalDict(buf *encodeState, entries []dictEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	buf.WriteByte('d')
+	for i, entry := range entries {
+		if i > 0 && entries[i-1].key == entry.key {
+			return fmt.Errorf("bencode: duplicate dictionary key %q", entry.key)
+		}
+
+		value := entry.value
+		for value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				break
+			}
+			value = value.Elem()
+		}
+		if (value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr) && value.IsNil() {
+			continue
+		}
+
+		writeBencodedString(buf, []byte(entry.key))
+		err := marshalValue(buf, value)
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+
+	return nil
+}
+
+// marshalAnyKeyDict encodes a map with interface{} keys, each of which must
+// hold a string or an integer.
+func marshalAnyKeyDict(buf *encodeState, v reflect.Value) error {
+	var (
+		strs []dictEntry
+		ints = map[int64]reflect.Value{}
+		keys []int64
+	)
+	iter := v.MapRange()
+	for iter.Next() {
+		switch key := iter.Key().Interface().(type) {
+		case string:
+			strs = append(strs, dictEntry{key: key, value: iter.Value()})
+		case int64:
+			ints[key] = iter.Value()
+			keys = append(keys, key)
+		default:
+			return fmt.Errorf("bencode: cannot marshal %s: key %v is %T, not a string or int64", v.Type(), key, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	// Write the integer keys into the dictionary marshalDict writes for the
+	// string ones, right after its 'd'.
+	var dict encodeState
+	if err := marshalDict(&dict, strs); err != nil {
+		return err
+	}
+	buf.WriteByte('d')
+	for _, key := range keys {
+		fmt.Fprintf(buf, "i%de", key)
+		if err := marshalValue(buf, ints[key]); err != nil {
+			return err
+		}
+	}
+	buf.Write(dict.Bytes()[1:])
+
+	return nil
+}
+
+func writeBencodedString(buf *encodeState, b []byte) {
+	buf.WriteString(strconv.Itoa(len(b)))
+	buf.WriteByte(':')
+	buf.Write(b)
+}
+
+func hasOption(opts []string, name string) bool {
+	for _, opt := range opts {
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
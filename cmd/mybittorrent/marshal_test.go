@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func Test_Marshal(t *testing.T) {
+	type peer struct {
+		Port uint16 `bencode:"port"`
+		IP   string `bencode:"ip"`
+	}
+	type message struct {
+		Peers    []peer            `bencode:"peers"`
+		Interval int               `bencode:"interval"`
+		Blob     []byte            `bencode:"blob"`
+		Comment  *string           `bencode:"comment"`
+		Extra    map[string]int    `bencode:"extra,omitempty"`
+		Private  int               `bencode:"private,omitempty"`
+		Ignored  string            `bencode:"-"`
+		Raw      interface{}       `bencode:"raw"`
+		Nested   map[string][]byte `bencode:"nested"`
+		hidden   string
+	}
+
+	got, err := Marshal(message{
+		Peers:    []peer{{IP: "127.0.0.1", Port: 6881}},
+		Interval: 60,
+		Blob:     []byte{0xff, 0x00},
+		Ignored:  "x",
+		Raw:      []interface{}{1, "a"},
+		Nested:   map[string][]byte{"k": []byte("v")},
+		hidden:   "x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "d" +
+		"4:blob2:\xff\x00" +
+		"8:intervali60e" +
+		"6:nestedd1:k1:ve" +
+		"5:peersld2:ip9:127.0.0.14:porti6881eee" +
+		"3:rawli1e1:ae" +
+		"e"
+	if string(got) != want {
+		t.Errorf("Marshal() got = %q, want %q", got, want)
+	}
+}
+
+func Test_Marshal_integers(t *testing.T) {
+	got, err := Marshal([]interface{}{int(-1), int64(5) << 30, uint32(1) << 31, uint64(1) << 63})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "li-1ei5368709120ei2147483648ei9223372036854775808ee"; string(got) != want {
+		t.Errorf("Marshal() got = %q, want %q", got, want)
+	}
+}
+
+func Test_Marshal_roundTrip(t *testing.T) {
+	in := TorrentFile{
+		Announce: "http://t/announce",
+		Info: TorrentInfo{
+			Name:        "sample.txt",
+			Length:      92063,
+			PieceLength: 32768,
+			Pieces:      []byte(strings.Repeat("\x80", 20)),
+		},
+	}
+
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out TorrentFile
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip got = %+v, want %+v", out, in)
+	}
+}
+
+func Test_Marshal_emptyValuesRoundTrip(t *testing.T) {
+	for _, in := range []string{"le", "de", "0:", "d0:0:e", "l0:e", "d1:adee", "llelee"} {
+		decoded, _, err := decodeBencode([]byte(in))
+		if err != nil {
+			t.Fatalf("decodeBencode(%q) error = %v", in, err)
+		}
+		got, err := Marshal(decoded)
+		if err != nil {
+			t.Fatalf("Marshal(%q) error = %v", in, err)
+		}
+		if string(got) != in {
+			t.Errorf("round trip of %q got %q", in, got)
+		}
+	}
+}
+
+func Test_bencode_types(t *testing.T) {
+	type hash [4]byte
+	tests := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{name: "bytes", v: []byte{0x00, 0xff}, want: "2:\x00\xff"},
+		{name: "byte array", v: hash{1, 2, 3, 4}, want: "4:\x01\x02\x03\x04"},
+		{name: "int8", v: int8(-128), want: "i-128e"},
+		{name: "int16", v: int16(-300), want: "i-300e"},
+		{name: "int32", v: int32(1 << 30), want: "i1073741824e"},
+		{name: "int64", v: int64(-1) << 40, want: "i-1099511627776e"},
+		{name: "uint8", v: uint8(255), want: "i255e"},
+		{name: "uint16", v: uint16(6881), want: "i6881e"},
+		{name: "uint32", v: uint32(1<<32 - 1), want: "i4294967295e"},
+		{name: "uint64", v: uint64(1<<64 - 1), want: "i18446744073709551615e"},
+		{name: "in a dictionary", v: map[string]interface{}{"id": []byte("ab"), "len": uint32(16384)}, want: "d2:id2:ab3:leni16384ee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bencode(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("bencode() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_bencode_unsupportedTypes(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{v: true, want: "bencode: cannot marshal bool: bencode has no booleans"},
+		{v: 1.5, want: "bencode: cannot marshal float64: bencode only has integers"},
+		{v: []interface{}{float32(1)}, want: "bencode: cannot marshal float32: bencode only has integers"},
+		{v: map[string]interface{}{"ok": false}, want: "bencode: cannot marshal bool: bencode has no booleans"},
+	}
+	for _, tt := range tests {
+		if _, err := bencode(tt.v); err == nil || err.Error() != tt.want {
+			t.Errorf("bencode(%v) error = %v, want %q", tt.v, err, tt.want)
+		}
+	}
+}
+
+func Test_Marshal_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"nil", nil},
+		{"float", 1.5},
+		{"int keys", map[int]string{1: "a"}},
+		{"nil in list", []interface{}{nil}},
+		{"duplicate keys", struct {
+			A string `bencode:"k"`
+			B string `bencode:"k"`
+		}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Marshal(tt.v); err == nil {
+				t.Errorf("Marshal(%v) expected an error", tt.v)
+			}
+		})
+	}
+}
+
+func Test_Encoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode(map[string]interface{}{"b": 1, "a": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode([]interface{}{1.5}); err == nil {
+		t.Error("Encode(float) expected an error")
+	}
+	if err := enc.Encode("end"); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "d1:a1:x1:bi1ee" + "3:end"; buf.String() != want {
+		t.Errorf("Encode() wrote %q, want %q", buf.String(), want)
+	}
+}
+
+// Benchmark_bencode_infoDict encodes the info dictionary of a torrent with
+// 10,000 pieces, whose "pieces" string alone is 200 KB.
+func Benchmark_bencode_infoDict(b *testing.B) {
+	info := map[string]interface{}{
+		"length":       10000 * 256 * 1024,
+		"name":         "large.bin",
+		"piece length": 256 * 1024,
+		"pieces":       bytes.Repeat([]byte{0xab}, 10000*eachPieceSize),
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := bencode(info); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_Marshal_binaryKeysRoundTrip(t *testing.T) {
+	key := make([]byte, 256)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	// A second key makes Marshal sort them, which has to compare them as
+	// raw bytes.
+	data := []byte("d256:" + string(key) + "1:v1:\xff2:\x00\xffe")
+
+	decoders := map[string]func([]byte) (interface{}, error){
+		"decodeBencode": func(data []byte) (interface{}, error) {
+			v, _, err := decodeBencode(data)
+			return v, err
+		},
+		"ordered": func(data []byte) (interface{}, error) {
+			return decodeStrictWith(data, decodeOptions{orderedDicts: true})
+		},
+		"anyKeys": func(data []byte) (interface{}, error) {
+			return decodeStrictWith(data, decodeOptions{anyKeys: true})
+		},
+		"Decoder": func(data []byte) (interface{}, error) {
+			return NewDecoder(bytes.NewReader(data)).Decode()
+		},
+		"Unmarshal": func(data []byte) (interface{}, error) {
+			var m map[string][]byte
+			err := Unmarshal(data, &m)
+			return m, err
+		},
+	}
+	for name, decode := range decoders {
+		t.Run(name, func(t *testing.T) {
+			decoded, err := decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Marshal(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("round trip got %q, want %q", got, data)
+			}
+		})
+	}
+
+	if err := VerifyCanonical(data); err != nil {
+		t.Errorf("VerifyCanonical() error = %v", err)
+	}
+}
+
+func Test_Encoder_LazyString(t *testing.T) {
+	pieces := bytes.Repeat([]byte{0xab}, 3*eachPieceSize)
+	info := map[string]interface{}{
+		"name":   "large.bin",
+		"pieces": LazyString{Length: int64(len(pieces)), R: bytes.NewReader(pieces)},
+	}
+	want, err := Marshal(map[string]interface{}{"name": "large.bin", "pieces": pieces})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(info); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Encode() wrote %q, want %q", buf.Bytes(), want)
+	}
+
+	info["pieces"] = LazyString{Length: int64(len(pieces)), R: bytes.NewReader(pieces)}
+	got, err := Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Marshal() got %q, want %q", got, want)
+	}
+
+	short := LazyString{Length: 10, R: strings.NewReader("abc")}
+	err = NewEncoder(io.Discard).Encode(short)
+	if err == nil || err.Error() != "bencode: LazyString of length 10 ended after 3 bytes" {
+		t.Errorf("Encode() of a short reader error = %v", err)
+	}
+}
+
+// countingWriter counts what is written to it and keeps none of it.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// zeroReader yields zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func Test_Encoder_LazyStringMemory(t *testing.T) {
+	const length = 100 << 20
+
+	var (
+		w      countingWriter
+		before runtime.MemStats
+		after  runtime.MemStats
+	)
+	runtime.ReadMemStats(&before)
+	err := NewEncoder(&w).Encode(map[string]interface{}{
+		"pieces": LazyString{Length: length, R: zeroReader{}},
+	})
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := int64(len("d6:pieces104857600:e") + length); w.n != want {
+		t.Errorf("Encode() wrote %d bytes, want %d", w.n, want)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("Encode() allocated %d bytes, want at most 1 MiB", allocated)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxTorrentSize is the most readTorrent downloads of a torrent given by URL.
+// Even torrents of huge content have metainfo well below it.
+const maxTorrentSize = 10 << 20
+
+// torrentClient fetches torrents given by URL.
+var torrentClient = &http.Client{Timeout: 30 * time.Second}
+
+// Metainfo is a torrent: the info dictionary describing its content, in
+// Info, and what the torrent says about it around that, such as where to
+// announce it.
+type Metainfo struct {
+	Announce string
+	// AnnounceList holds the tiers of trackers to announce to, in order
+	// (BEP 12). It is a single tier of Announce when the torrent has no
+	// "announce-list".
+	AnnounceList [][]string
+	Info         *Info
+
+	// The optional fields below are empty when the torrent leaves them out.
+	CreationDate time.Time
+	Comment      string
+	CreatedBy    string
+	Encoding     string
+}
+
+// LoadTorrent reads the torrent at path, which is a file or an http:// or
+// https:// URL, and parses it with ParseMetainfo.
+func LoadTorrent(path string) (*Metainfo, error) {
+	content, err := readTorrent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMetainfo(content)
+}
+
+// readTorrent returns the bytes of the torrent at path, downloading it when
+// path is an http:// or https:// URL.
+//
+// Example:
+// - readTorrent("sample.torrent") -> the content of the file
+// - readTorrent("https://example.com/debian.torrent") -> the response body
+func readTorrent(path string) ([]byte, error) {
+	lower := strings.ToLower(path)
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		return os.ReadFile(path)
+	}
+
+	res, err := torrentClient.Get(path)
+	if err != nil {
+		return nil, withExitCode(exitNetwork, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, withExitCode(exitNetwork, fmt.Errorf("cannot fetch %s: %s", path, res.Status))
+	}
+	// Servers label torrents as anything from application/x-bittorrent to
+	// application/octet-stream, so only a web page is taken as a sign of
+	// having been sent something else, such as a login form.
+	if mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err == nil && mediaType == "text/html" {
+		return nil, fmt.Errorf("%s is not a torrent: got a %s page", path, mediaType)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(res.Body, maxTorrentSize+1))
+	if err != nil {
+		return nil, withExitCode(exitNetwork, err)
+	}
+	if len(content) > maxTorrentSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes, too large for a torrent", path, maxTorrentSize)
+	}
+
+	return content, nil
+}
+
+// checkPieceCount checks that info has a piece hash for every piece of its
+// length, so that no piece is cut short or runs past PieceLength.
+//
+// Example:
+// - 32868 bytes in pieces of 16384 with 2 hashes -> error: torrent has 2 piece hashes, but 32868 bytes in pieces of 16384 need 3
+func checkPieceCount(info *Info) error {
+	pl := int64(info.PieceLength)
+	if want := (info.Length + pl - 1) / pl; int64(info.NumPieces()) != want {
+		return fmt.Errorf("torrent has %d piece hashes, but %d bytes in pieces of %d need %d", info.NumPieces(), info.Length, pl, want)
+	}
+
+	return nil
+}
+
+// ParseMetainfo parses a torrent from its bencoded bytes, wherever they come
+// from, rejecting one that could not be downloaded as described. Unlike
+// ValidateMetainfo it stops at the first such problem.
+func ParseMetainfo(data []byte) (*Metainfo, error) {
+	m, err := loadMetainfo(data)
+	if err != nil {
+		return nil, err
+	}
+	info := m.Info
+	if info.PieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length %d", info.PieceLength)
+	}
+	if len(info.Pieces)%eachPieceSize != 0 {
+		return nil, fmt.Errorf("pieces length %d is not a multiple of %d", len(info.Pieces), eachPieceSize)
+	}
+	if info.Files != nil {
+		if err := checkFiles(info.Files); err != nil {
+			return nil, err
+		}
+	}
+	// A v2-only torrent has no v1 pieces to count.
+	if !info.IsV2Only() {
+		if err := checkPieceCount(info); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// parseToInfo loads the torrent file at torrentFilepath and returns its Info.
+//
+// Deprecated: use LoadTorrent, whose Metainfo holds the Info along with the
+// announce URLs.
+func parseToInfo(torrentFilepath string) (*Info, error) {
+	m, err := LoadTorrent(torrentFilepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Info, nil
+}
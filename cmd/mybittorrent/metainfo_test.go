@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ParseMetainfo(t *testing.T) {
+	content, err := os.ReadFile("testdata/tiers.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ParseMetainfo(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTorrent("testdata/tiers.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, loaded) {
+		t.Errorf("ParseMetainfo() = %+v, LoadTorrent() = %+v", m, loaded)
+	}
+
+	if m.Announce == "" || len(m.AnnounceList) < 2 || m.AnnounceList[0][0] != m.Announce {
+		t.Errorf("Metainfo announce = %q, announce list = %q", m.Announce, m.AnnounceList)
+	}
+
+	info, err := parseToInfo("testdata/tiers.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, m.Info) {
+		t.Errorf("parseToInfo() = %+v, want the Info of LoadTorrent %+v", info, m.Info)
+	}
+}
+
+func Test_ParseMetainfo_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "zero piece length",
+			content: "d4:infod6:lengthi1e4:name1:a12:piece lengthi0e6:pieces20:aaaaaaaaaaaaaaaaaaaaee",
+			want:    "invalid piece length 0",
+		},
+		{
+			name:    "short pieces",
+			content: "d4:infod6:lengthi1e4:name1:a12:piece lengthi16e6:pieces3:aaaee",
+			want:    "pieces length 3 is not a multiple of 20",
+		},
+		{
+			name:    "file outside the torrent",
+			content: "d4:infod5:filesld6:lengthi1e4:pathl2:..1:aeee4:name1:a12:piece lengthi16e6:pieces20:aaaaaaaaaaaaaaaaaaaaee",
+			want:    `file 0 has invalid path component ".."`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseMetainfo([]byte(tt.content))
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("ParseMetainfo() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Test_LoadTorrent_pieceCount checks that torrents with more or fewer piece
+// hashes than their length needs are rejected, rather than giving pieces of
+// negative length or longer than the piece length.
+func Test_LoadTorrent_pieceCount(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "testdata/too_many_pieces.torrent", want: "torrent has 3 piece hashes, but 100 bytes in pieces of 16384 need 1"},
+		{path: "testdata/too_few_pieces.torrent", want: "torrent has 1 piece hashes, but 16484 bytes in pieces of 16384 need 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if _, err := LoadTorrent(tt.path); err == nil || err.Error() != tt.want {
+				t.Errorf("LoadTorrent() error = %v, want %q", err, tt.want)
+			}
+			if err := runInfo([]string{tt.path, "--piece", "0"}, io.Discard); err == nil || err.Error() != tt.want {
+				t.Errorf("runInfo(--piece 0) error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_LoadTorrent_url(t *testing.T) {
+	sample, err := os.ReadFile(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sample.torrent":
+			w.Header().Set("Content-Type", "application/x-bittorrent")
+			w.Write(sample)
+		case "/login":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html>please log in</html>"))
+		case "/huge.torrent":
+			w.Write(bytes.Repeat([]byte("x"), maxTorrentSize+1))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	m, err := LoadTorrent(server.URL + "/sample.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := LoadTorrent(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("LoadTorrent() of the URL = %+v, want %+v", m, want)
+	}
+
+	var out strings.Builder
+	if err := runInfo([]string{server.URL + "/sample.torrent", "--info-hash-only"}, &out); err != nil || out.String() != "d69f91e6b2ae4c542468d1073a71d4ea13879a7f\n" {
+		t.Errorf("runInfo() of the URL = %q, %v", out.String(), err)
+	}
+
+	tests := []struct {
+		path     string
+		want     string
+		wantCode int
+	}{
+		{path: "/login", want: server.URL + "/login is not a torrent: got a text/html page", wantCode: exitUsage},
+		{path: "/huge.torrent", want: server.URL + "/huge.torrent is larger than 10485760 bytes, too large for a torrent", wantCode: exitUsage},
+		{path: "/missing.torrent", want: "cannot fetch " + server.URL + "/missing.torrent: 404 Not Found", wantCode: exitNetwork},
+	}
+	for _, tt := range tests {
+		_, err := LoadTorrent(server.URL + tt.path)
+		if err == nil || err.Error() != tt.want || exitCode(err) != tt.wantCode {
+			t.Errorf("LoadTorrent(%q) error = %v (exit code %d), want %q (exit code %d)", tt.path, err, exitCode(err), tt.want, tt.wantCode)
+		}
+	}
+}
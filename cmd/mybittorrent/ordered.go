@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// OrderedDict is a decoded dictionary that remembers the order its keys
+// appeared in, which a map[string]interface{} loses. decodeBencodeWith
+// returns dictionaries as *OrderedDict when decodeOptions.orderedDicts is
+// set.
+type OrderedDict struct {
+	// Keys holds every key once, in the order it first appeared.
+	Keys   []string
+	Values map[string]interface{}
+}
+
+func newOrderedDict() *OrderedDict {
+	return &OrderedDict{Values: map[string]interface{}{}}
+}
+
+// Set stores value under key, appending key unless it is already there.
+func (d *OrderedDict) Set(key string, value interface{}) {
+	if _, ok := d.Values[key]; !ok {
+		d.Keys = append(d.Keys, key)
+	}
+	d.Values[key] = value
+}
+
+func (d *OrderedDict) Get(key string) (interface{}, bool) {
+	value, ok := d.Values[key]
+	return value, ok
+}
+
+// Map returns d as a plain map, converting nested ordered dictionaries too,
+// for code that expects what decodeBencode returns by default.
+func (d *OrderedDict) Map() map[string]interface{} {
+	return plainDicts(d).(map[string]interface{})
+}
+
+func plainDicts(decoded interface{}) interface{} {
+	switch v := decoded.(type) {
+	case *OrderedDict:
+		ret := make(map[string]interface{}, len(v.Keys))
+		for _, key := range v.Keys {
+			ret[key] = plainDicts(v.Values[key])
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, e := range v {
+			ret[i] = plainDicts(e)
+		}
+		return ret
+	default:
+		return decoded
+	}
+}
+
+// MarshalJSON writes d as a JSON object with its keys in order.
+func (d *OrderedDict) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range d.Keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(d.Values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// firstUnsortedKeys returns the first pair of neighbouring keys, searching
+// depth first, that are not in the sorted order the spec requires.
+func firstUnsortedKeys(decoded interface{}) (before, after string, ok bool) {
+	switch v := decoded.(type) {
+	case *OrderedDict:
+		for i, key := range v.Keys {
+			if i > 0 && key < v.Keys[i-1] {
+				return v.Keys[i-1], key, true
+			}
+			if before, after, ok := firstUnsortedKeys(v.Values[key]); ok {
+				return before, after, true
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if before, after, ok := firstUnsortedKeys(e); ok {
+				return before, after, true
+			}
+		}
+	}
+
+	return "", "", false
+}
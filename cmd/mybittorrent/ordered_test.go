@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_decodeBencodeWith_orderedDicts(t *testing.T) {
+	data := []byte("d1:bi1e1:ald1:zi0e1:yi0eee1:ci3ee")
+
+	got, _, err := decodeBencodeWith(data, decodeOptions{orderedDicts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	od, ok := got.(*OrderedDict)
+	if !ok {
+		t.Fatalf("decodeBencodeWith() got %T, want *OrderedDict", got)
+	}
+	if want := []string{"b", "a", "c"}; !reflect.DeepEqual(od.Keys, want) {
+		t.Errorf("Keys = %q, want %q", od.Keys, want)
+	}
+
+	plain, _, err := decodeBencode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(od.Map(), plain) {
+		t.Errorf("Map() = %v, want %v", od.Map(), plain)
+	}
+
+	reencoded, err := bencode(od)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "d1:ald1:yi0e1:zi0eee1:bi1e1:ci3ee"; string(reencoded) != want {
+		t.Errorf("bencode() got = %q, want the canonical %q", reencoded, want)
+	}
+
+	var v struct {
+		A []map[string]int `bencode:"a"`
+		C int              `bencode:"c"`
+	}
+	if err := unmarshalDecoded(od, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.C != 3 || len(v.A) != 1 || v.A[0]["z"] != 0 {
+		t.Errorf("unmarshalDecoded() got = %+v", v)
+	}
+}
+
+func Test_OrderedDict_duplicateKeys(t *testing.T) {
+	got, _, err := decodeBencodeWith([]byte("d1:bi1e1:ai2e1:bi3ee"), decodeOptions{orderedDicts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	od := got.(*OrderedDict)
+	if want := []string{"b", "a"}; !reflect.DeepEqual(od.Keys, want) {
+		t.Errorf("Keys = %q, want %q", od.Keys, want)
+	}
+	if v, _ := od.Get("b"); v != int64(3) {
+		t.Errorf("Get(b) = %v, want the last value 3", v)
+	}
+}
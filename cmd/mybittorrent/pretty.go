@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// prettyBinaryBytes is how many bytes of a binary string writePretty shows
+// before summarizing the rest.
+const prettyBinaryBytes = 16
+
+// writePretty writes a decoded value indented, one list item or dictionary
+// key per line. Text is quoted and binary strings are shown as hex, cut
+// short after prettyBinaryBytes bytes with the full length, so a pieces
+// blob takes up a single line:
+//
+//	{
+//	  "info": {
+//	    "length": 92063,
+//	    "pieces": <e876f67a2a8886e8f36b136726c30fa2...(60 bytes)>
+//	  }
+//	}
+//
+// Dictionaries decoded as *OrderedDict keep their key order; others are
+// sorted.
+func writePretty(w io.Writer, decoded interface{}) error {
+	bw := bufio.NewWriter(w)
+	writePrettyValue(bw, decoded, 0)
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+func writePrettyValue(w *bufio.Writer, decoded interface{}, depth int) {
+	switch v := decoded.(type) {
+	case []byte:
+		w.WriteString(prettyString(v))
+	case int64:
+		w.WriteString(strconv.FormatInt(v, 10))
+	case []interface{}:
+		if len(v) == 0 {
+			w.WriteString("[]")
+			return
+		}
+		w.WriteString("[\n")
+		for i, item := range v {
+			writeIndent(w, depth+1)
+			writePrettyValue(w, item, depth+1)
+			if i < len(v)-1 {
+				w.WriteByte(',')
+			}
+			w.WriteByte('\n')
+		}
+		writeIndent(w, depth)
+		w.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writePrettyDict(w, keys, v, depth)
+	case *OrderedDict:
+		writePrettyDict(w, v.Keys, v.Values, depth)
+	default:
+		fmt.Fprintf(w, "%v", v)
+	}
+}
+
+func writePrettyDict(w *bufio.Writer, keys []string, values map[string]interface{}, depth int) {
+	if len(keys) == 0 {
+		w.WriteString("{}")
+		return
+	}
+	w.WriteString("{\n")
+	for i, k := range keys {
+		writeIndent(w, depth+1)
+		w.WriteString(prettyString([]byte(k)))
+		w.WriteString(": ")
+		writePrettyValue(w, values[k], depth+1)
+		if i < len(keys)-1 {
+			w.WriteByte(',')
+		}
+		w.WriteByte('\n')
+	}
+	writeIndent(w, depth)
+	w.WriteByte('}')
+}
+
+func writeIndent(w *bufio.Writer, depth int) {
+	w.WriteString(strings.Repeat("  ", depth))
+}
+
+// prettyString quotes text and shows anything else as hex between angle
+// brackets, e.g. <ff00>.
+func prettyString(b []byte) string {
+	if utf8.Valid(b) {
+		return strconv.Quote(string(b))
+	}
+	if len(b) <= prettyBinaryBytes {
+		return "<" + hex.EncodeToString(b) + ">"
+	}
+	return fmt.Sprintf("<%s...(%d bytes)>", hex.EncodeToString(b[:prettyBinaryBytes]), len(b))
+}
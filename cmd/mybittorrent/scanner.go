@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// TokenKind tells what a Token is.
+type TokenKind int
+
+const (
+	StringToken TokenKind = iota + 1
+	IntToken
+	ListStart
+	DictStart
+	// End terminates the innermost list or dictionary.
+	End
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case StringToken:
+		return "string"
+	case IntToken:
+		return "integer"
+	case ListStart:
+		return "list start"
+	case DictStart:
+		return "dictionary start"
+	case End:
+		return "end"
+	default:
+		return fmt.Sprintf("TokenKind(%d)", int(k))
+	}
+}
+
+// Token is one step through bencoded data. Start and End delimit the bytes
+// it was read from: all of "4:spam" for a string, and the single "l", "d"
+// or "e" for the others.
+type Token struct {
+	Kind       TokenKind
+	Start, End int
+	// Bytes holds the contents of a StringToken, as a slice of the data.
+	Bytes []byte
+	// Int holds the value of an IntToken.
+	Int int64
+}
+
+// Scanner walks bencoded data one token at a time, similar to
+// json.Decoder.Token, so parts of it can be inspected or sliced out without
+// decoding the rest into maps and lists.
+type Scanner struct {
+	// LenientIntegers accepts integers with leading zeros or written as -0.
+	LenientIntegers bool
+
+	data []byte
+	pos  int
+	// open holds the kind of each list or dictionary entered and not yet
+	// ended, innermost last; inKey is set when a dictionary is due a key.
+	open  []TokenKind
+	inKey bool
+}
+
+func NewScanner(data []byte) *Scanner {
+	return &Scanner{data: data}
+}
+
+// Pos returns the index of the next byte the scanner will read.
+func (s *Scanner) Pos() int {
+	return s.pos
+}
+
+// Next returns the next token. It returns io.EOF at the end of the data when
+// no list or dictionary is left open, and a *SyntaxError for malformed data.
+func (s *Scanner) Next() (Token, error) {
+	if s.pos == len(s.data) {
+		if len(s.open) == 0 {
+			return Token{}, io.EOF
+		}
+		if s.open[len(s.open)-1] == DictStart {
+			return Token{}, syntaxErrorf(s.pos, "unterminated dictionary")
+		}
+		return Token{}, syntaxErrorf(s.pos, "unterminated list")
+	}
+
+	start := s.pos
+	c := s.data[start]
+	if s.inKey {
+		switch c {
+		case 'i':
+			return Token{}, syntaxErrorf(start, "dictionary key is an integer, not a string")
+		case 'l':
+			return Token{}, syntaxErrorf(start, "dictionary key is a list, not a string")
+		case 'd':
+			return Token{}, syntaxErrorf(start, "dictionary key is a dictionary, not a string")
+		}
+	}
+
+	var tok Token
+	switch {
+	case isDigit(c):
+		str, end, err := scanString(s.data, start, defaultMaxStringLength)
+		if err != nil {
+			return Token{}, err
+		}
+		tok = Token{Kind: StringToken, Bytes: str, Start: start, End: end}
+	case c == 'i':
+		num, end, err := scanInt(s.data, start, s.LenientIntegers)
+		if err != nil {
+			return Token{}, err
+		}
+		tok = Token{Kind: IntToken, Int: num, Start: start, End: end}
+	case c == 'l' || c == 'd':
+		if len(s.open) == defaultMaxDepth {
+			return Token{}, &SyntaxError{Offset: start, Msg: ErrMaxDepth.Error(), Err: ErrMaxDepth}
+		}
+
+		kind := ListStart
+		if c == 'd' {
+			kind = DictStart
+		}
+		s.open = append(s.open, kind)
+		s.pos = start + 1
+		s.inKey = kind == DictStart
+		return Token{Kind: kind, Start: start, End: start + 1}, nil
+	case c == 'e' && len(s.open) > 0:
+		if s.open[len(s.open)-1] == DictStart && !s.inKey {
+			return Token{}, syntaxErrorf(start, "dictionary key without a value")
+		}
+		s.open = s.open[:len(s.open)-1]
+		tok = Token{Kind: End, Start: start, End: start + 1}
+	default:
+		return Token{}, syntaxErrorf(start, "unexpected %q", c)
+	}
+
+	s.pos = tok.End
+	s.afterValue(tok.Kind == StringToken && s.inKey)
+	return tok, nil
+}
+
+// afterValue tracks whether the enclosing dictionary, if any, is due a key
+// or a value next; wasKey is set when the token just read was a key.
+func (s *Scanner) afterValue(wasKey bool) {
+	if len(s.open) == 0 || s.open[len(s.open)-1] != DictStart {
+		s.inKey = false
+		return
+	}
+	s.inKey = !wasKey
+}
+
+// Skip moves past the next value, however deeply nested, and returns the
+// bytes it spans.
+func (s *Scanner) Skip() ([]byte, error) {
+	tok, err := s.Next()
+	if err != nil {
+		return nil, err
+	}
+	if tok.Kind == End {
+		return nil, syntaxErrorf(tok.Start, "expected a value")
+	}
+
+	depth := 0
+	if tok.Kind == ListStart || tok.Kind == DictStart {
+		depth = 1
+	}
+	for depth > 0 {
+		// Next only returns io.EOF once nothing is left open, so running out
+		// of data here is reported as a *SyntaxError.
+		next, err := s.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch next.Kind {
+		case ListStart, DictStart:
+			depth++
+		case End:
+			depth--
+		}
+	}
+
+	return s.data[tok.Start:s.pos], nil
+}
+
+// Valid reports whether data is exactly one well-formed bencoded value, like
+// json.Valid. It only walks the tokens, without building the maps and lists
+// decodeBencode would, so it is a cheap check on untrusted input before
+// decoding it.
+func Valid(data []byte) bool {
+	s := NewScanner(data)
+	if _, err := s.Skip(); err != nil {
+		return false
+	}
+	return s.Pos() == len(data)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_Scanner_tokens(t *testing.T) {
+	data := []byte("d3:fooli-5e2:abe3:zipdee")
+
+	var got []Token
+	s := NewScanner(data)
+	for {
+		tok, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, tok)
+	}
+
+	want := []Token{
+		{Kind: DictStart, Start: 0, End: 1},
+		{Kind: StringToken, Start: 1, End: 6, Bytes: []byte("foo")},
+		{Kind: ListStart, Start: 6, End: 7},
+		{Kind: IntToken, Start: 7, End: 11, Int: -5},
+		{Kind: StringToken, Start: 11, End: 15, Bytes: []byte("ab")},
+		{Kind: End, Start: 15, End: 16},
+		{Kind: StringToken, Start: 16, End: 21, Bytes: []byte("zip")},
+		{Kind: DictStart, Start: 21, End: 22},
+		{Kind: End, Start: 22, End: 23},
+		{Kind: End, Start: 23, End: 24},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Next() tokens = %+v, want %+v", got, want)
+	}
+}
+
+// Test_Scanner_pieces finds the "pieces" of a real torrent by walking tokens
+// only, without decoding anything into maps.
+func Test_Scanner_pieces(t *testing.T) {
+	content, err := os.ReadFile(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// findKey moves s to the value of key in the dictionary s is in.
+	findKey := func(s *Scanner, key string) {
+		t.Helper()
+		for {
+			tok, err := s.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.Kind == End {
+				t.Fatalf("no %q key", key)
+			}
+			if string(tok.Bytes) == key {
+				return
+			}
+			if _, err := s.Skip(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s := NewScanner(content)
+	if tok, err := s.Next(); err != nil || tok.Kind != DictStart {
+		t.Fatalf("Next() = %+v, %v, want a dictionary start", tok, err)
+	}
+	findKey(s, "info")
+	infoStart := s.Pos()
+	if tok, err := s.Next(); err != nil || tok.Kind != DictStart {
+		t.Fatalf("Next() = %+v, %v, want a dictionary start", tok, err)
+	}
+	findKey(s, "pieces")
+	pieces, err := s.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := parseToInfo(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pieces.Bytes, info.Pieces) {
+		t.Errorf("pieces = %x, want %x", pieces.Bytes, info.Pieces)
+	}
+	if !bytes.HasPrefix(content[infoStart:], info.RawInfo) {
+		t.Errorf("info dictionary does not start at byte %d", infoStart)
+	}
+}
+
+func Test_Scanner_Skip(t *testing.T) {
+	s := NewScanner([]byte("ld1:al1:bee1:ce"))
+	if _, err := s.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"d1:al1:bee", "1:c"} {
+		got, err := s.Skip()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("Skip() = %q, want %q", got, want)
+		}
+	}
+}
+
+func Test_Scanner_errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		wantOffset int
+	}{
+		{name: "unterminated list", input: "l1:a", wantOffset: 4},
+		{name: "integer key", input: "di1e1:ae", wantOffset: 1},
+		{name: "key without value", input: "d1:ae", wantOffset: 4},
+		{name: "stray end", input: "e", wantOffset: 0},
+		{name: "truncated string", input: "l5:ab", wantOffset: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScanner([]byte(tt.input))
+			var err error
+			for err == nil {
+				_, err = s.Next()
+			}
+
+			var serr *SyntaxError
+			if !errors.As(err, &serr) {
+				t.Fatalf("Next() error = %v, want a *SyntaxError", err)
+			}
+			if serr.Offset != tt.wantOffset {
+				t.Errorf("Next() error at %d, want at %d", serr.Offset, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func Test_Valid(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{data: "d3:fooli-5e2:abe3:zipdee", want: true},
+		{data: "le", want: true},
+		{data: "0:", want: true},
+		{data: "i52e", want: true},
+		{data: "", want: false},
+		{data: "i52exx", want: false},
+		{data: "i03e", want: false},
+		{data: "d3:foo", want: false},
+		{data: "d3:fooe", want: false},
+		{data: "di1ei2ee", want: false},
+		{data: "l5:abc", want: false},
+		{data: "<html>", want: false},
+	}
+	for _, tt := range tests {
+		if got := Valid([]byte(tt.data)); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+
+	content, err := os.ReadFile(sampleTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Valid(content) {
+		t.Error("Valid() of sample.torrent = false")
+	}
+}
+
+// largeInfoDict is the bencoded info dictionary of a torrent with 10,000
+// pieces, whose "pieces" string alone is 200 KB.
+func largeInfoDict(b *testing.B) []byte {
+	data, err := bencode(map[string]interface{}{
+		"length":       10000 * 256 * 1024,
+		"name":         "large.bin",
+		"piece length": 256 * 1024,
+		"pieces":       bytes.Repeat([]byte{0xab}, 10000*eachPieceSize),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+func Benchmark_Valid(b *testing.B) {
+	data := largeInfoDict(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !Valid(data) {
+			b.Fatal("Valid() = false")
+		}
+	}
+}
+
+func Benchmark_decodeBencode_infoDict(b *testing.B) {
+	data := largeInfoDict(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := decodeBencode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import "sync"
+
+type pieceState int
+
+const (
+	piecePending pieceState = iota
+	pieceInProgress
+	pieceAssembled
+	pieceDone
+)
+
+// scheduler decides which piece each peer downloads next.
+//
+// Pending pieces are handed out in the order chosen by strategy. Every piece
+// is handed to a single peer until no pending piece is left. From then on
+// (endgame) idle peers also take pieces that are still in progress, and the
+// first peer to assemble one gets the others to cancel it.
+type scheduler struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pieces   []*pieceWork
+	states   []pieceState
+	owners   []map[*peerConn]bool
+	strategy pieceStrategy
+	// peers are the connections that asked for work and have not been
+	// released, whose bitfields make up piece availability.
+	peers  map[*peerConn]bool
+	closed bool
+}
+
+func newScheduler(pieces []*pieceWork, strategy pieceStrategy) *scheduler {
+	s := &scheduler{
+		pieces:   pieces,
+		states:   make([]pieceState, len(pieces)),
+		owners:   make([]map[*peerConn]bool, len(pieces)),
+		strategy: strategy,
+		peers:    map[*peerConn]bool{},
+	}
+	for i := range s.owners {
+		s.owners[i] = map[*peerConn]bool{}
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// next blocks until there is a piece for pc to download and assigns it to pc.
+// It returns nil once the scheduler is closed, or when none of the remaining
+// pieces can come from pc.
+func (s *scheduler) next(pc *peerConn) *pieceWork {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peers[pc] = true
+
+	for {
+		if s.closed {
+			return nil
+		}
+
+		var (
+			pending    bool
+			unsettled  bool
+			candidates []int
+			endgame    *pieceWork
+		)
+		for i, pw := range s.pieces {
+			switch s.states[i] {
+			case piecePending:
+				pending = true
+				if pc.hasPiece(i) {
+					candidates = append(candidates, i)
+				}
+			case pieceInProgress:
+				unsettled = true
+				if endgame == nil && pc.hasPiece(i) && !s.owners[i][pc] {
+					endgame = pw
+				}
+			case pieceAssembled:
+				unsettled = true
+			}
+		}
+
+		if len(candidates) > 0 {
+			pw := s.pieces[s.strategy.pick(candidates, s.availability())]
+			s.assign(pw, pc)
+			return pw
+		}
+		if !pending && endgame != nil {
+			s.assign(endgame, pc)
+			return endgame
+		}
+
+		// Only a piece that is still in flight can change what is available.
+		if !unsettled {
+			return nil
+		}
+		s.cond.Wait()
+	}
+}
+
+// availability counts, for every piece, the peers that have it.
+func (s *scheduler) availability() []int {
+	ret := make([]int, len(s.pieces))
+	for pc := range s.peers {
+		for i := range ret {
+			if pc.hasPiece(i) {
+				ret[i]++
+			}
+		}
+	}
+
+	return ret
+}
+
+func (s *scheduler) assign(pw *pieceWork, pc *peerConn) {
+	s.states[pw.index] = pieceInProgress
+	s.owners[pw.index][pc] = true
+}
+
+// assembled records that pc has every block of piece index and returns the
+// other peers that were downloading it, so their requests can be canceled.
+// ok is false if another peer assembled the piece first.
+func (s *scheduler) assembled(index int, pc *peerConn) (losers []*peerConn, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	if s.states[index] != pieceInProgress || !s.owners[index][pc] {
+		return nil, false
+	}
+
+	for owner := range s.owners[index] {
+		if owner != pc {
+			losers = append(losers, owner)
+		}
+	}
+	s.states[index] = pieceAssembled
+	s.owners[index] = map[*peerConn]bool{}
+
+	return losers, true
+}
+
+// requeue puts a piece that failed verification back up for download.
+func (s *scheduler) requeue(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	s.states[index] = piecePending
+}
+
+func (s *scheduler) complete(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	s.states[index] = pieceDone
+}
+
+// release drops every piece assigned to pc, which is going away. Pieces that
+// nobody else is downloading become pending again.
+func (s *scheduler) release(pc *peerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	delete(s.peers, pc)
+	for i := range s.owners {
+		s.dropLocked(i, pc)
+	}
+}
+
+// drop takes piece index away from pc, which gave up on it after it was
+// canceled. It becomes pending again if nobody else is downloading it.
+func (s *scheduler) drop(index int, pc *peerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	s.dropLocked(index, pc)
+}
+
+func (s *scheduler) dropLocked(index int, pc *peerConn) {
+	owners := s.owners[index]
+	if !owners[pc] {
+		return
+	}
+
+	delete(owners, pc)
+	if len(owners) == 0 && s.states[index] == pieceInProgress {
+		s.states[index] = piecePending
+	}
+}
+
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	s.closed = true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const defaultStrategy = "rarest"
+
+// pieceStrategy decides which of the pending pieces a peer downloads next.
+type pieceStrategy interface {
+	// pick returns one of candidates, the pending pieces the peer has in
+	// index order. availability[i] is how many connected peers have piece i.
+	pick(candidates []int, availability []int) int
+}
+
+// sequentialStrategy downloads pieces in order, which suits streaming.
+type sequentialStrategy struct{}
+
+func (sequentialStrategy) pick(candidates []int, availability []int) int {
+	return candidates[0]
+}
+
+// rarestStrategy downloads the piece the fewest peers have first, so that it
+// is not lost to the swarm if they leave. Ties go to the lowest index, which
+// makes it sequential until availability is known.
+type rarestStrategy struct{}
+
+func (rarestStrategy) pick(candidates []int, availability []int) int {
+	ret := candidates[0]
+	for _, i := range candidates[1:] {
+		if availability[i] < availability[ret] {
+			ret = i
+		}
+	}
+
+	return ret
+}
+
+// randomStrategy downloads pieces in random order.
+type randomStrategy struct {
+	rand *rand.Rand
+}
+
+func (s randomStrategy) pick(candidates []int, availability []int) int {
+	return candidates[s.rand.Intn(len(candidates))]
+}
+
+// Example:
+// - sequential -> sequentialStrategy
+// - rarest -> rarestStrategy
+// - random -> randomStrategy
+func parseStrategy(name string) (pieceStrategy, error) {
+	switch name {
+	case "sequential":
+		return sequentialStrategy{}, nil
+	case "rarest":
+		return rarestStrategy{}, nil
+	case "random":
+		return randomStrategy{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %q: want sequential, rarest or random", name)
+	}
+}
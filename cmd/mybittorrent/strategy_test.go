@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// pickOrder lets strategy pick from pieces until none is left and returns the
+// order they were picked in.
+func pickOrder(strategy pieceStrategy, numPieces int, availability []int) []int {
+	var candidates, ret []int
+	for i := 0; i < numPieces; i++ {
+		candidates = append(candidates, i)
+	}
+
+	for len(candidates) > 0 {
+		picked := strategy.pick(candidates, availability)
+		ret = append(ret, picked)
+
+		for i, c := range candidates {
+			if c == picked {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return ret
+}
+
+func Test_pieceStrategy_pick(t *testing.T) {
+	availability := []int{3, 1, 2, 1, 5, 2}
+
+	tests := []struct {
+		name     string
+		strategy pieceStrategy
+		want     []int
+	}{
+		{name: "sequential", strategy: sequentialStrategy{}, want: []int{0, 1, 2, 3, 4, 5}},
+		{name: "rarest", strategy: rarestStrategy{}, want: []int{1, 3, 2, 5, 0, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickOrder(tt.strategy, len(availability), availability); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pick order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("random", func(t *testing.T) {
+		got := pickOrder(randomStrategy{rand: rand.New(rand.NewSource(1))}, len(availability), availability)
+		again := pickOrder(randomStrategy{rand: rand.New(rand.NewSource(1))}, len(availability), availability)
+		if !reflect.DeepEqual(got, again) {
+			t.Errorf("pick order with the same seed = %v and %v, want them equal", got, again)
+		}
+
+		sorted := append([]int(nil), got...)
+		sort.Ints(sorted)
+		if !reflect.DeepEqual(sorted, []int{0, 1, 2, 3, 4, 5}) {
+			t.Errorf("pick order = %v, want every piece once", got)
+		}
+	})
+}
+
+func Test_parseStrategy(t *testing.T) {
+	for _, name := range []string{"sequential", "rarest", "random"} {
+		if _, err := parseStrategy(name); err != nil {
+			t.Errorf("parseStrategy(%q) error = %v", name, err)
+		}
+	}
+	if _, err := parseStrategy("fastest"); err == nil {
+		t.Error("parseStrategy(\"fastest\") error = nil, want an error")
+	}
+}
+
+func Test_scheduler_next_rarest(t *testing.T) {
+	pieces := make([]*pieceWork, 4)
+	for i := range pieces {
+		pieces[i] = &pieceWork{index: i}
+	}
+	s := newScheduler(pieces, rarestStrategy{})
+
+	seed := newPeerConn("seed", nil)
+	seed.bitfield = peerBitfield{0xf0}
+	partial := newPeerConn("partial", nil)
+	partial.bitfield = peerBitfield{0xc0}
+
+	if pw := s.next(partial); pw.index != 0 {
+		t.Errorf("next(partial) = piece %d, want 0", pw.index)
+	}
+	// Pieces 2 and 3 are only on the seed, so it should take one of them
+	// rather than piece 1, which partial can also serve.
+	if pw := s.next(seed); pw.index != 2 {
+		t.Errorf("next(seed) = piece %d, want 2", pw.index)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Unmarshal decodes the single bencoded value in data into v, which must be a
+// non-nil pointer.
+//
+// Dictionaries decode into structs, using the `bencode:"key"` tag of each
+// field (or its name when untagged; "-" skips the field), and into
+// map[string]T. Lists decode into slices, strings into string or []byte and
+// integers into any integer kind. An interface{} receives the value as
+// decodeBencode returns it. Keys with no matching field are ignored and
+// fields with no matching key keep their zero value.
+func Unmarshal(data []byte, v interface{}) error {
+	decoded, consumed, err := decodeBencode(data)
+	if err != nil {
+		return err
+	}
+	if consumed < len(data) {
+		return fmt.Errorf("bencode: %d bytes of trailing data", len(data)-consumed)
+	}
+
+	return unmarshalDecoded(decoded, v)
+}
+
+// unmarshalDecoded is Unmarshal for a value decodeBencode already returned.
+func unmarshalDecoded(decoded interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("bencode: Unmarshal needs a non-nil pointer")
+	}
+
+	return unmarshalValue(decoded, rv.Elem(), "")
+}
+
+// unmarshalValue stores decoded in dst. path names dst in error messages.
+func unmarshalValue(decoded interface{}, dst reflect.Value, path string) error {
+	if dst.Kind() == reflect.Ptr {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return unmarshalValue(decoded, dst.Elem(), path)
+	}
+	if dst.Kind() == reflect.Interface && dst.NumMethod() == 0 {
+		dst.Set(reflect.ValueOf(decoded))
+		return nil
+	}
+
+	if od, ok := decoded.(*OrderedDict); ok {
+		decoded = od.Values
+	}
+
+	switch v := decoded.(type) {
+	case []byte:
+		switch {
+		case dst.Kind() == reflect.String:
+			dst.SetString(string(v))
+			return nil
+		case dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Uint8:
+			dst.SetBytes(append([]byte(nil), v...))
+			return nil
+		}
+	case int64:
+		switch dst.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if dst.OverflowInt(v) {
+				return fmt.Errorf("bencode: %d overflows %s%s", v, dst.Type(), fieldSuffix(path))
+			}
+			dst.SetInt(v)
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if v < 0 || dst.OverflowUint(uint64(v)) {
+				return fmt.Errorf("bencode: %d overflows %s%s", v, dst.Type(), fieldSuffix(path))
+			}
+			dst.SetUint(uint64(v))
+			return nil
+		}
+	case []interface{}:
+		if dst.Kind() == reflect.Slice {
+			slice := reflect.MakeSlice(dst.Type(), len(v), len(v))
+			for i, item := range v {
+				err := unmarshalValue(item, slice.Index(i), fmt.Sprintf("%s[%d]", path, i))
+				if err != nil {
+					return err
+				}
+			}
+			dst.Set(slice)
+			return nil
+		}
+	case map[string]interface{}:
+		switch {
+		case dst.Kind() == reflect.Struct:
+			return unmarshalStruct(v, dst, path)
+		case dst.Kind() == reflect.Map && dst.Type().Key().Kind() == reflect.String:
+			m := reflect.MakeMapWithSize(dst.Type(), len(v))
+			for key, item := range v {
+				elem := reflect.New(dst.Type().Elem()).Elem()
+				err := unmarshalValue(item, elem, joinPath(path, key))
+				if err != nil {
+					return err
+				}
+				m.SetMapIndex(reflect.ValueOf(key).Convert(dst.Type().Key()), elem)
+			}
+			dst.Set(m)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("bencode: cannot unmarshal %s into %s%s", bencodeKind(decoded), dst.Type(), fieldSuffix(path))
+}
+
+func unmarshalStruct(dict map[string]interface{}, dst reflect.Value, path string) error {
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		key, _ := fieldKey(field)
+		if key == "-" {
+			continue
+		}
+
+		item, ok := dict[key]
+		if !ok {
+			continue
+		}
+
+		err := unmarshalValue(item, dst.Field(i), joinPath(path, key))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fieldKey returns the dictionary key of a struct field and the options that
+// follow it in the tag, such as "omitempty".
+func fieldKey(field reflect.StructField) (string, []string) {
+	tag, ok := field.Tag.Lookup("bencode")
+	if !ok {
+		return field.Name, nil
+	}
+
+	parts := strings.Split(tag, ",")
+	if parts[0] == "" {
+		return field.Name, parts[1:]
+	}
+
+	return parts[0], parts[1:]
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func fieldSuffix(path string) string {
+	if path == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (field %q)", path)
+}
+
+func bencodeKind(decoded interface{}) string {
+	switch decoded.(type) {
+	case []byte:
+		return "string"
+	case int64:
+		return "integer"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}, map[interface{}]interface{}, *OrderedDict:
+		return "dictionary"
+	default:
+		return fmt.Sprintf("%T", decoded)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_Unmarshal(t *testing.T) {
+	type peer struct {
+		IP   string `bencode:"ip"`
+		Port uint16 `bencode:"port"`
+	}
+	type response struct {
+		Interval int               `bencode:"interval"`
+		Peers    []peer            `bencode:"peers"`
+		Comment  *string           `bencode:"comment"`
+		Extra    map[string]int    `bencode:"extra"`
+		Raw      interface{}       `bencode:"raw"`
+		Blob     []byte            `bencode:"blob"`
+		Ignored  string            `bencode:"-"`
+		Missing  string            `bencode:"missing"`
+		Nested   map[string][]byte `bencode:"nested"`
+	}
+
+	data := "d" +
+		"4:blob2:\xff\x00" +
+		"7:comment2:hi" +
+		"5:extrad1:ai1ee" +
+		"8:intervali60e" +
+		"6:nestedd1:k1:ve" +
+		"5:peersld2:ip9:127.0.0.14:porti6881eed2:ip3:::14:porti1eee" +
+		"3:rawli1ee" +
+		"7:unknown1:x" +
+		"e"
+
+	var got response
+	got.Ignored = "kept"
+	if err := Unmarshal([]byte(data), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	comment := "hi"
+	want := response{
+		Interval: 60,
+		Peers:    []peer{{IP: "127.0.0.1", Port: 6881}, {IP: "::1", Port: 1}},
+		Comment:  &comment,
+		Extra:    map[string]int{"a": 1},
+		Raw:      []interface{}{int64(1)},
+		Blob:     []byte{0xff, 0x00},
+		Ignored:  "kept",
+		Nested:   map[string][]byte{"k": []byte("v")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal() got = %+v, want %+v", got, want)
+	}
+}
+
+func Test_Unmarshal_torrentFile(t *testing.T) {
+	data := "d8:announce13:http://t/anno4:infod6:lengthi92063e4:name10:sample.txt12:piece lengthi32768e6:pieces20:" + strings.Repeat("\x80", 20) + "ee"
+
+	var got TorrentFile
+	if err := Unmarshal([]byte(data), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := TorrentFile{
+		Announce: "http://t/anno",
+		Info: TorrentInfo{
+			Name:        "sample.txt",
+			Length:      92063,
+			PieceLength: 32768,
+			Pieces:      []byte(strings.Repeat("\x80", 20)),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal() got = %+v, want %+v", got, want)
+	}
+}
+
+func Test_Unmarshal_errors(t *testing.T) {
+	type target struct {
+		Length int    `bencode:"length"`
+		Name   string `bencode:"name"`
+		Small  int8   `bencode:"small"`
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "string into int", data: "d6:length3:abce", wantErr: `bencode: cannot unmarshal string into int (field "length")`},
+		{name: "int into string", data: "d4:namei1ee", wantErr: `bencode: cannot unmarshal integer into string (field "name")`},
+		{name: "overflow", data: "d5:smalli300ee", wantErr: `bencode: 300 overflows int8 (field "small")`},
+		{name: "list into struct", data: "le", wantErr: "bencode: cannot unmarshal list into main.target"},
+		{name: "trailing data", data: "dexx", wantErr: "bencode: 2 bytes of trailing data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got target
+			err := Unmarshal([]byte(tt.data), &got)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Unmarshal() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	var notPointer target
+	if err := Unmarshal([]byte("de"), notPointer); err == nil {
+		t.Error("Unmarshal() into a non-pointer error = nil, want an error")
+	}
+}
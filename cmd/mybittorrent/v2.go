@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// metaVersionV2 is the "meta version" of torrents that follow BEP 52, either
+// v2-only or hybrid ones that also carry the v1 "pieces".
+const metaVersionV2 = 2
+
+// parseFileTree flattens a v2 "file tree" into the files it describes, in
+// the order of their paths. Each file is a dictionary under the empty key at
+// the end of its path.
+//
+// Example:
+// - {"a.txt": {"": {"length": 3, "pieces root": ...}}} -> [{Length: 3, Path: ["a.txt"]}]
+func parseFileTree(tree map[string]interface{}) ([]FileEntry, error) {
+	return appendFileTree(nil, tree, nil)
+}
+
+func appendFileTree(files []FileEntry, node map[string]interface{}, dir []string) ([]FileEntry, error) {
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := append(append([]string(nil), dir...), name)
+		child, ok := asDict(node[name])
+		if !ok {
+			return nil, fmt.Errorf("file tree %q: expected dictionary, got %s", path.Join(p...), bencodeKind(node[name]))
+		}
+
+		leaf, ok := child[""]
+		if !ok {
+			var err error
+			files, err = appendFileTree(files, child, p)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(child) != 1 {
+			return nil, fmt.Errorf("file tree %q is both a file and a directory", path.Join(p...))
+		}
+
+		length, err := LookupInt(leaf, "length")
+		if err != nil {
+			return nil, fmt.Errorf("file tree %q: %w", path.Join(p...), err)
+		}
+		// Empty files have no pieces root.
+		root, _ := LookupBytes(leaf, "pieces root")
+		files = append(files, FileEntry{Length: length, Path: p, PiecesRoot: root})
+	}
+
+	return files, nil
+}
+
+// setV2Files fills in the files of a v2-only torrent from its file tree. A
+// tree of a single file named like the torrent is a single-file torrent.
+func setV2Files(info *Info, files []FileEntry) {
+	if len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == info.Name {
+		info.Length = files[0].Length
+		info.PiecesRoot = files[0].PiecesRoot
+		return
+	}
+
+	info.Files = files
+	info.Length = 0
+	for _, f := range files {
+		info.Length += f.Length
+	}
+}
+
+// attachPiecesRoots copies the pieces roots from the file tree of a hybrid
+// torrent onto its v1 files, which must be the same files apart from the
+// padding v1 needs to start each of them on a piece boundary.
+func attachPiecesRoots(info *Info, v2Files []FileEntry) error {
+	if info.Files == nil {
+		if len(v2Files) != 1 || !sameFile(FileEntry{Length: info.Length, Path: []string{info.Name}}, v2Files[0]) {
+			return errors.New("hybrid torrent: the file tree does not match the single v1 file")
+		}
+		info.PiecesRoot = v2Files[0].PiecesRoot
+		return nil
+	}
+
+	j := 0
+	for i := range info.Files {
+		f := &info.Files[i]
+		if f.IsPadding() {
+			continue
+		}
+		if j == len(v2Files) || !sameFile(*f, v2Files[j]) {
+			return fmt.Errorf("hybrid torrent: v1 file %d %q does not match the file tree", i, path.Join(f.Path...))
+		}
+		f.PiecesRoot = v2Files[j].PiecesRoot
+		j++
+	}
+	if j != len(v2Files) {
+		return fmt.Errorf("hybrid torrent: the file tree has %d files the v1 files lack", len(v2Files)-j)
+	}
+
+	return nil
+}
+
+func sameFile(a, b FileEntry) bool {
+	if a.Length != b.Length || len(a.Path) != len(b.Path) {
+		return false
+	}
+	for i := range a.Path {
+		if a.Path[i] != b.Path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// torrentMetaVersion returns the "meta version" of a decoded torrent and
+// whether it is v2-only, describing its content in "file tree" alone with no
+// "pieces", "length" or "files".
+func torrentMetaVersion(decoded map[string]interface{}) (int64, bool) {
+	metaVersion, _ := LookupInt(decoded, "info", "meta version")
+	_, piecesErr := Lookup(decoded, "info", "pieces")
+	return metaVersion, metaVersion == metaVersionV2 && piecesErr != nil
+}
+
+// infoHashFor returns what InfoHash holds for the info dictionary rawInfo:
+// its SHA-1, or the first 20 bytes of its SHA-256 for a v2-only torrent and,
+// under the global --protocol v2 flag, for a hybrid one.
+func infoHashFor(rawInfo []byte, metaVersion int64, v2Only bool) [sha1.Size]byte {
+	if !v2Only && (metaVersion != metaVersionV2 || !protocolV2) {
+		return sha1.Sum(rawInfo)
+	}
+
+	var hash [sha1.Size]byte
+	v2 := sha256.Sum256(rawInfo)
+	copy(hash[:], v2[:])
+	return hash
+}
+
+// IsV2Only reports whether the torrent has only v2 metadata, with no v1
+// pieces to download it by.
+func (info *Info) IsV2Only() bool {
+	return info.MetaVersion == metaVersionV2 && info.Pieces == nil
+}
+
+// errV2Only is what the commands that talk to peers return for a v2-only
+// torrent, which they have no v1 pieces or info hash to use with.
+var errV2Only = errors.New("this torrent is BitTorrent v2-only; downloading v2 is not supported yet (info parsed OK, use `info` to inspect)")
+
+// checkV1 returns errV2Only for a v2-only torrent.
+func checkV1(info *Info) error {
+	if info.IsV2Only() {
+		return errV2Only
+	}
+	return nil
+}
+
+// v2Problems returns what is wrong with the v2 metadata of info.
+func v2Problems(info *Info) []error {
+	var errs []error
+
+	checkRoot := func(what string, length int64, root []byte) {
+		if length > 0 && len(root) != sha256.Size {
+			errs = append(errs, validationErrorf("%s has a pieces root of %d bytes, want %d", what, len(root), sha256.Size))
+		}
+	}
+	if info.Files == nil {
+		checkRoot("the file", info.Length, info.PiecesRoot)
+	}
+	for i, f := range info.Files {
+		if !f.IsPadding() {
+			checkRoot(fmt.Sprintf("file %d", i), f.Length, f.PiecesRoot)
+		}
+	}
+
+	// The v1 pieces of a hybrid torrent must line up with the v2 ones,
+	// which start afresh with each file.
+	if !info.IsV2Only() && info.PieceLength > 0 {
+		var offset int64
+		for i, f := range info.Files {
+			if !f.IsPadding() && f.Length > 0 && offset%int64(info.PieceLength) != 0 {
+				errs = append(errs, validationErrorf("file %d of a hybrid torrent does not start on a piece boundary", i))
+			}
+			offset += f.Length
+		}
+	}
+
+	// v2 pieces are hashed in 16 KiB blocks, so they must be a power of
+	// two that is a whole number of blocks.
+	if pl := info.PieceLength; pl > 0 && (pl&(pl-1) != 0 || pl < minUsualPieceLength) {
+		errs = append(errs, validationErrorf("piece length %d of a v2 torrent is not a power of two of at least 16 KiB", pl))
+	}
+
+	return errs
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const v2OnlyTorrent = "testdata/v2only.torrent"
+
+func Test_parseToInfo_v2Only(t *testing.T) {
+	info, err := parseToInfo(v2OnlyTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const hashV2 = "df327124052ed0d17563b6eb6734bd549d90f71bd736f0479667b5e18b03ad11"
+	if info.MetaVersion != 2 || !info.IsV2Only() {
+		t.Errorf("MetaVersion = %d, IsV2Only() = %v, want 2, true", info.MetaVersion, info.IsV2Only())
+	}
+	if got := fmt.Sprintf("%x", info.InfoHashV2); got != hashV2 {
+		t.Errorf("InfoHashV2 = %s, want %s", got, hashV2)
+	}
+	if got := fmt.Sprintf("%x", info.InfoHash); got != hashV2[:40] {
+		t.Errorf("InfoHash = %s, want the truncated v2 hash %s", got, hashV2[:40])
+	}
+
+	var (
+		paths      [][]string
+		rootLength []int
+	)
+	for _, f := range info.Files {
+		paths = append(paths, f.Path)
+		rootLength = append(rootLength, len(f.PiecesRoot))
+	}
+	if want := [][]string{{"a.txt"}, {"empty.txt"}, {"sub", "b.bin"}}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Files paths = %q, want %q", paths, want)
+	}
+	if want := []int{32, 0, 32}; !reflect.DeepEqual(rootLength, want) {
+		t.Errorf("PiecesRoot lengths = %v, want %v", rootLength, want)
+	}
+	if info.Length != 20011 {
+		t.Errorf("Length = %d, want 20011", info.Length)
+	}
+
+	var out strings.Builder
+	if err := runInfo([]string{v2OnlyTorrent}, &out); err != nil {
+		t.Fatal(err)
+	}
+	wantLines := "Meta Version: 2\nInfo Hash v2: " + hashV2 + "\n"
+	if !strings.Contains(out.String(), wantLines) {
+		t.Errorf("runInfo() got = %q, want it to contain %q", out.String(), wantLines)
+	}
+
+	out.Reset()
+	if err := runValidate([]string{v2OnlyTorrent}, &out); err != nil || out.String() != "ok\n" {
+		t.Errorf("runValidate() = %q, %v", out.String(), err)
+	}
+}
+
+func Test_parseFileTree(t *testing.T) {
+	leaf := func(length int64) map[string]interface{} {
+		return map[string]interface{}{"": map[string]interface{}{"length": length}}
+	}
+
+	files, err := parseFileTree(map[string]interface{}{"only.bin": leaf(5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &Info{Name: "only.bin"}
+	setV2Files(info, files)
+	if info.Files != nil || info.Length != 5 {
+		t.Errorf("single-file tree gave Files = %+v, Length = %d", info.Files, info.Length)
+	}
+
+	tests := []struct {
+		name string
+		tree map[string]interface{}
+		want string
+	}{
+		{
+			name: "file and directory",
+			tree: map[string]interface{}{"a": map[string]interface{}{"": map[string]interface{}{"length": int64(1)}, "b": leaf(1)}},
+			want: `file tree "a" is both a file and a directory`,
+		},
+		{
+			name: "not a dictionary",
+			tree: map[string]interface{}{"dir": map[string]interface{}{"a": int64(1)}},
+			want: `file tree "dir/a": expected dictionary, got integer`,
+		},
+		{
+			name: "no length",
+			tree: map[string]interface{}{"a": map[string]interface{}{"": map[string]interface{}{}}},
+			want: `file tree "a": missing key "length"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseFileTree(tt.tree)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("parseFileTree() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ValidateMetainfo_v2(t *testing.T) {
+	m := &Metainfo{
+		Announce:     "http://tracker.example/announce",
+		AnnounceList: [][]string{{"http://tracker.example/announce"}},
+		Info: &Info{
+			MetaVersion: 2,
+			Length:      10,
+			PieceLength: 32768,
+			Files: []FileEntry{
+				{Length: 10, Path: []string{"a"}, PiecesRoot: make([]byte, 31)},
+				{Length: 0, Path: []string{"b"}},
+			},
+		},
+	}
+
+	var got []string
+	for _, err := range ValidateMetainfo(m) {
+		got = append(got, err.Error())
+	}
+	if want := []string{"file 0 has a pieces root of 31 bytes, want 32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ValidateMetainfo() = %q, want %q", got, want)
+	}
+}
+
+const hybridTorrent = "testdata/hybrid.torrent"
+
+func Test_parseToInfo_hybrid(t *testing.T) {
+	const (
+		hashV1 = "dde6d94b164a545622aaa62d580607c18b43b437"
+		hashV2 = "a43bfe502b0cead349cc7073aec095e20e83220ee31807b9e5c9829d5832e392"
+	)
+
+	info, err := parseToInfo(hybridTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.IsV2Only() || info.MetaVersion != 2 {
+		t.Errorf("MetaVersion = %d, IsV2Only() = %v, want 2, false", info.MetaVersion, info.IsV2Only())
+	}
+	if got := fmt.Sprintf("%x %x %x", info.InfoHash, info.InfoHashV1, info.InfoHashV2); got != hashV1+" "+hashV1+" "+hashV2 {
+		t.Errorf("InfoHash, InfoHashV1, InfoHashV2 = %s", got)
+	}
+
+	// The padding file between the two has no counterpart in the file
+	// tree, and the pieces roots land on the files around it.
+	if len(info.Files) != 3 || !info.Files[1].IsPadding() || info.Files[0].IsPadding() {
+		t.Fatalf("Files = %+v", info.Files)
+	}
+	if len(info.Files[0].PiecesRoot) != 32 || info.Files[1].PiecesRoot != nil || len(info.Files[2].PiecesRoot) != 32 {
+		t.Errorf("PiecesRoot lengths = %d, %d, %d, want 32, 0, 32",
+			len(info.Files[0].PiecesRoot), len(info.Files[1].PiecesRoot), len(info.Files[2].PiecesRoot))
+	}
+
+	var out strings.Builder
+	if err := runInfo([]string{hybridTorrent}, &out); err != nil {
+		t.Fatal(err)
+	}
+	wantLines := "Info Hash: " + hashV1 + "\nMeta Version: 2\nInfo Hash v1: " + hashV1 + "\nInfo Hash v2: " + hashV2 + "\n"
+	if !strings.Contains(out.String(), wantLines) {
+		t.Errorf("runInfo() got = %q, want it to contain %q", out.String(), wantLines)
+	}
+	out.Reset()
+	if err := runValidate([]string{hybridTorrent}, &out); err != nil || out.String() != "ok\n" {
+		t.Errorf("runValidate() = %q, %v", out.String(), err)
+	}
+
+	defer func(saved bool) { protocolV2 = saved }(protocolV2)
+	_, global := parseGlobalFlags([]string{"--protocol", "v2", "info"})
+	global.apply()
+	info, err = parseToInfo(hybridTorrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("%x", info.InfoHash); got != hashV2[:40] {
+		t.Errorf("InfoHash with --protocol v2 = %s, want %s", got, hashV2[:40])
+	}
+	if got := fmt.Sprintf("%x", info.InfoHashV1); got != hashV1 {
+		t.Errorf("InfoHashV1 with --protocol v2 = %s, want %s", got, hashV1)
+	}
+}
+
+func Test_parseToInfo_hybridMismatch(t *testing.T) {
+	tree := map[string]interface{}{
+		"a.txt": map[string]interface{}{"": map[string]interface{}{"length": 5, "pieces root": strings.Repeat("r", 32)}},
+	}
+	metainfo := map[string]interface{}{
+		"announce": "http://127.0.0.1/announce",
+		"info": map[string]interface{}{
+			"file tree":    tree,
+			"files":        []interface{}{map[string]interface{}{"length": 6, "path": []interface{}{"a.txt"}}},
+			"meta version": 2,
+			"name":         "mismatch",
+			"piece length": 16384,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	}
+	bencoded, err := bencode(metainfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = loadMetainfo(bencoded)
+	if want := `hybrid torrent: v1 file 0 "a.txt" does not match the file tree`; err == nil || err.Error() != want {
+		t.Errorf("loadMetainfo() error = %v, want %q", err, want)
+	}
+}
+
+func Test_globalOptions_protocol(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{args: []string{"info", "a.torrent"}, want: ""},
+		{args: []string{"--protocol", "v2", "info", "a.torrent"}, want: "v2"},
+		{args: []string{"info", "a.torrent", "--protocol=v1"}, want: "v1"},
+		{args: []string{"--protocol", "v3", "info"}, want: "v3", wantErr: true},
+	}
+	for _, tt := range tests {
+		args, global := parseGlobalFlags(tt.args)
+		if global.protocol != tt.want {
+			t.Errorf("parseGlobalFlags(%q) protocol = %q, want %q", tt.args, global.protocol, tt.want)
+		}
+		if args[0] != "info" {
+			t.Errorf("parseGlobalFlags(%q) args = %q", tt.args, args)
+		}
+		if err := global.check(); (err != nil) != tt.wantErr {
+			t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+		}
+	}
+}
+
+func Test_v2Only_notDownloadable(t *testing.T) {
+	if _, err := LoadTorrent(v2OnlyTorrent); err != nil {
+		t.Fatalf("LoadTorrent() error = %v, want v2-only torrents to load", err)
+	}
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{name: "peers", run: func() error { return runPeers([]string{v2OnlyTorrent}, io.Discard) }},
+		{name: "download_piece", run: func() error { return runDownloadPiece([]string{v2OnlyTorrent, "0"}) }},
+		{name: "download", run: func() error { return runDownload([]string{v2OnlyTorrent}, io.Discard) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run()
+			if !errors.Is(err, errV2Only) || exitCode(err) != exitUsage {
+				t.Errorf("%s error = %v, want %v", tt.name, err, errV2Only)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Piece lengths outside this range, or not a power of two, are legal but
+// unusual enough that ValidateMetainfo warns about them.
+const (
+	minUsualPieceLength = 16 << 10
+	maxUsualPieceLength = 16 << 20
+)
+
+// ValidationError is a problem ValidateMetainfo found. A warning is something
+// clients cope with that is still worth fixing in the torrent.
+type ValidationError struct {
+	Msg     string
+	Warning bool
+}
+
+func (e *ValidationError) Error() string {
+	return e.Msg
+}
+
+func validationErrorf(format string, a ...interface{}) error {
+	return &ValidationError{Msg: fmt.Sprintf(format, a...)}
+}
+
+func validationWarningf(format string, a ...interface{}) error {
+	return &ValidationError{Msg: fmt.Sprintf(format, a...), Warning: true}
+}
+
+// isValidationWarning reports whether err is a ValidationError that is only
+// a warning.
+func isValidationWarning(err error) bool {
+	var verr *ValidationError
+	return errors.As(err, &verr) && verr.Warning
+}
+
+// ValidateMetainfo checks m for everything that would keep the torrent from
+// being downloaded as described, returning every problem rather than
+// stopping at the first. m may come from loadMetainfo, which does not reject
+// any of them.
+func ValidateMetainfo(m *Metainfo) []error {
+	var errs []error
+	info := m.Info
+
+	// A v2-only torrent has no v1 pieces to check.
+	v1 := !info.IsV2Only()
+	if v1 && len(info.Pieces)%eachPieceSize != 0 {
+		errs = append(errs, validationErrorf("pieces length %d is not a multiple of %d", len(info.Pieces), eachPieceSize))
+	}
+
+	switch pl := info.PieceLength; {
+	case pl <= 0:
+		errs = append(errs, validationErrorf("invalid piece length %d", pl))
+	default:
+		if pl&(pl-1) != 0 || pl < minUsualPieceLength || pl > maxUsualPieceLength {
+			errs = append(errs, validationWarningf("piece length %d is not a power of two between 16 KiB and 16 MiB", pl))
+		}
+		if v1 && info.Length >= 0 {
+			if err := checkPieceCount(info); err != nil {
+				errs = append(errs, &ValidationError{Msg: err.Error()})
+			}
+		}
+	}
+
+	urls := []string{}
+	if m.Announce != "" {
+		urls = append(urls, m.Announce)
+	}
+	for _, tier := range m.AnnounceList {
+		for _, u := range tier {
+			if u != m.Announce {
+				urls = append(urls, u)
+			}
+		}
+	}
+	// A trackerless torrent finds its peers through its DHT nodes instead.
+	if len(urls) == 0 && len(info.Nodes) == 0 {
+		errs = append(errs, validationErrorf("torrent has no announce URL"))
+	}
+	for _, announce := range urls {
+		if _, err := classifyTracker(announce); err != nil {
+			errs = append(errs, &ValidationError{Msg: err.Error()})
+		}
+	}
+
+	if info.Files != nil {
+		if len(info.Files) == 0 {
+			errs = append(errs, validationErrorf("files list is empty"))
+		}
+		for i, f := range info.Files {
+			if err := checkFile(i, f); err != nil {
+				errs = append(errs, &ValidationError{Msg: err.Error()})
+			}
+		}
+	}
+
+	// Only private trackers look at the source, so elsewhere it does
+	// nothing but split the swarm.
+	if info.Source != "" && !info.Private {
+		errs = append(errs, validationWarningf("source %q is set but the torrent is not private", info.Source))
+	}
+
+	if info.MetaVersion == metaVersionV2 {
+		errs = append(errs, v2Problems(info)...)
+	}
+
+	if info.Length < 0 {
+		errs = append(errs, validationErrorf("negative total length %d", info.Length))
+	}
+
+	return errs
+}
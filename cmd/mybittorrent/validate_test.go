@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ValidateMetainfo(t *testing.T) {
+	valid := func() *Metainfo {
+		return &Metainfo{
+			Announce:     "http://tracker.example/announce",
+			AnnounceList: [][]string{{"http://tracker.example/announce"}},
+			Info: &Info{
+				Length:      40000,
+				PieceLength: 32768,
+				Pieces:      make([]byte, 2*eachPieceSize),
+				PieceHashes: make([][20]byte, 2),
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(m *Metainfo)
+		want   []string
+	}{
+		{name: "valid", modify: func(m *Metainfo) {}},
+		{
+			name:   "unusual piece length",
+			modify: func(m *Metainfo) { m.Info.PieceLength = 30000 },
+			want:   []string{"warning: piece length 30000 is not a power of two between 16 KiB and 16 MiB"},
+		},
+		{
+			name:   "no piece length",
+			modify: func(m *Metainfo) { m.Info.PieceLength = 0 },
+			want:   []string{"error: invalid piece length 0"},
+		},
+		{
+			name: "bad announce URLs",
+			modify: func(m *Metainfo) {
+				m.Announce = "tracker.example"
+				m.AnnounceList = [][]string{
+					{"tracker.example"},
+					{"http://ok.example/announce", "http://%zz", "udp://ok.example:6969"},
+					{"wss://tracker.example", "http:///announce", "udp://tracker.example"},
+				}
+			},
+			want: []string{
+				`error: announce URL "tracker.example" has no scheme`,
+				`error: invalid announce URL "http://%zz"`,
+				`error: announce URL "wss://tracker.example" has unsupported scheme "wss"`,
+				`error: announce URL "http:///announce" has no host`,
+				`error: announce URL "udp://tracker.example" has no port`,
+			},
+		},
+		{
+			name: "no announce URL",
+			modify: func(m *Metainfo) {
+				m.Announce = ""
+				m.AnnounceList = nil
+			},
+			want: []string{"error: torrent has no announce URL"},
+		},
+		{
+			name: "every bad file",
+			modify: func(m *Metainfo) {
+				m.Info.Files = []FileEntry{
+					{Length: 40000, Path: []string{"ok.bin"}},
+					{Length: 0, Path: []string{"dir", "", "a"}},
+					{Length: 0, Path: []string{"..", "b"}},
+				}
+			},
+			want: []string{
+				`error: file 1 has invalid path component ""`,
+				`error: file 2 has invalid path component ".."`,
+			},
+		},
+		{
+			name:   "source of a public torrent",
+			modify: func(m *Metainfo) { m.Info.Source = "SITE" },
+			want:   []string{`warning: source "SITE" is set but the torrent is not private`},
+		},
+		{
+			name: "source of a private torrent",
+			modify: func(m *Metainfo) {
+				m.Info.Source = "SITE"
+				m.Info.Private = true
+			},
+		},
+		{
+			name: "negative length",
+			modify: func(m *Metainfo) {
+				m.Info.Length = -1
+				m.Info.Pieces, m.Info.PieceHashes = nil, nil
+			},
+			want: []string{"error: negative total length -1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := valid()
+			tt.modify(m)
+
+			var got []string
+			for _, err := range ValidateMetainfo(m) {
+				if isValidationWarning(err) {
+					got = append(got, "warning: "+err.Error())
+				} else {
+					got = append(got, "error: "+err.Error())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValidateMetainfo() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		want     string
+		wantCode int
+	}{
+		{name: "valid", path: sampleTorrent, want: "ok\n"},
+		{
+			name: "truncated pieces",
+			path: "testdata/truncated.torrent",
+			want: "error: pieces length 39 is not a multiple of 20\n" +
+				"error: torrent has 1 piece hashes, but 32768 bytes in pieces of 16384 need 2\n",
+			wantCode: exitVerification,
+		},
+		{
+			name:     "piece count mismatch",
+			path:     "testdata/piece_count.torrent",
+			want:     "error: torrent has 2 piece hashes, but 32868 bytes in pieces of 16384 need 3\n",
+			wantCode: exitVerification,
+		},
+		{
+			name: "warnings only",
+			path: "testdata/unsorted_info.torrent",
+			want: "warning: dictionary key \"length\" is out of order\n" +
+				"warning: info dictionary is not canonically encoded, hashing it as written\n" +
+				"ok\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			err := runValidate([]string{tt.path}, &out)
+			if code := exitCode(err); code != tt.wantCode {
+				t.Errorf("runValidate() error = %v, exit code %d, want %d", err, code, tt.wantCode)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("runValidate() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}